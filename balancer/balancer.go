@@ -26,16 +26,37 @@ func New(vss []config.VirtualServer) (*Balancer, error) {
 	return b, nil
 }
 
-// AddVirtualServer loads from config.VirtualServer.
+// AddVirtualServer loads from config.VirtualServer, the virtual servers of the
+// same address share the listener, which dispatches the requests by host.
 func (b *Balancer) AddVirtualServer(cvs *config.VirtualServer) error {
 	vs, err := NewVirtualServer(
 		NameOpt(cvs.Name),
 		AddressOpt(cvs.Address),
 		ServerNameOpt(cvs.ServerName),
+		DefaultServerOpt(cvs.DefaultServer),
 		ProtocolOpt(cvs.Protocol),
+		CertificatesOpt(cvs.Certificates),
 		TLSOpt(cvs.CertFile, cvs.KeyFile),
+		MinTLSVersionOpt(cvs.MinTLSVersion),
+		CipherSuitesOpt(cvs.CipherSuites),
+		CertReloadIntervalOpt(cvs.CertReloadInterval),
 		LBMethodOpt(cvs.LBMethod),
+		HashKeyOpt(cvs.HashKey),
+		ReplicaOpt(cvs.Replica),
+		BoundedLoadOpt(cvs.BoundedLoad),
+		SlowStartOpt(cvs.SlowStart),
+		IdleTimeoutOpt(cvs.IdleTimeout),
+		H2COpt(cvs.H2C),
+		UpstreamProtocolOpt(cvs.UpstreamProtocol),
+		UpstreamTLSOpt(cvs.UpstreamTLS),
+		HeaderRulesOpt(cvs.HeaderRules),
+		PassiveHealthOpt(&cvs.PassiveHealth),
+		HealthCheckOpt(cvs.HealthCheck),
+		OutlierDetectionOpt(cvs.OutlierDetection),
+		CircuitBreakerOpt(cvs.CircuitBreaker),
 		PoolOpt(cvs.Pool),
+		PoolsOpt(cvs.Pools),
+		RoutesOpt(cvs.Routes),
 		RetryOpt(true),
 	)
 	if err != nil {
@@ -44,6 +65,19 @@ func (b *Balancer) AddVirtualServer(cvs *config.VirtualServer) error {
 
 	b.Lock()
 	defer b.Unlock()
+	// the http, https and grpc virtual servers share the listen address
+	var shared *listener
+	for _, v := range b.VServers {
+		if err := v.conflicts(vs); err != nil {
+			return err
+		}
+		if v.Address == vs.Address && v.listener != nil && shared == nil {
+			shared = v.listener
+		}
+	}
+	if shared != nil && vs.listener != nil {
+		shared.add(vs)
+	}
 	b.VServers = append(b.VServers, vs)
 
 	return nil
@@ -0,0 +1,286 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+// DefaultCertReloadInterval is the interval of checking the certificate
+// files for changes in seconds.
+const DefaultCertReloadInterval = 10
+
+// tlsVersions are the supported min TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuites are the secure cipher suites of TLS 1.0-1.2, which have
+// forward secrecy.
+var cipherSuites = map[string]uint16{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+}
+
+// CertificatesOpt returns a function to set the certificates selected by
+// SNI, and should be called before TLSOpt.
+func CertificatesOpt(certs []config.Certificate) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		for _, c := range certs {
+			if _, err := os.Stat(c.CertFile); err != nil {
+				return fmt.Errorf("cert file '%s' does not exist", c.CertFile)
+			}
+			if _, err := os.Stat(c.KeyFile); err != nil {
+				return fmt.Errorf("key file '%s' does not exist", c.KeyFile)
+			}
+		}
+		vs.Certificates = certs
+		return nil
+	}
+}
+
+// MinTLSVersionOpt returns a function to set the min TLS version, e.g. "1.2".
+func MinTLSVersionOpt(version string) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if version == "" {
+			return nil
+		}
+		v, ok := tlsVersions[version]
+		if !ok {
+			return fmt.Errorf("min tls version '%s' is not supported", version)
+		}
+		vs.minTLSVersion = v
+		return nil
+	}
+}
+
+// CipherSuitesOpt returns a function to set the cipher suites of TLS 1.0-1.2,
+// e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", only the secure ones are supported.
+func CipherSuitesOpt(names []string) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if len(names) == 0 {
+			return nil
+		}
+		ids := []uint16{}
+		for _, name := range names {
+			id, ok := cipherSuites[name]
+			if !ok {
+				return fmt.Errorf("cipher suite '%s' is not supported", name)
+			}
+			ids = append(ids, id)
+		}
+		vs.cipherSuites = ids
+		return nil
+	}
+}
+
+// CertReloadIntervalOpt returns a function to set the interval of checking
+// the certificate files, the certificates are reloaded once the files change.
+func CertReloadIntervalOpt(seconds int) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if seconds < 0 {
+			return fmt.Errorf("cert reload interval %d is negative", seconds)
+		}
+		if seconds == 0 {
+			seconds = DefaultCertReloadInterval
+		}
+		vs.CertReloadInterval = time.Duration(seconds) * time.Second
+		return nil
+	}
+}
+
+// certStore selects the certificate by SNI.
+type certStore struct {
+	def    *tls.Certificate
+	byName map[string]*tls.Certificate
+	all    []*tls.Certificate
+}
+
+// loadCertStore loads the key pairs, the first one is the default.
+func loadCertStore(pairs []config.Certificate) (*certStore, error) {
+	store := &certStore{byName: map[string]*tls.Certificate{}}
+	for _, pair := range pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load certificate '%s' error=%v", pair.CertFile, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("parse certificate '%s' error=%v", pair.CertFile, err)
+		}
+		cert.Leaf = leaf
+		store.all = append(store.all, &cert)
+
+		if store.def == nil {
+			store.def = &cert
+		}
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := store.byName[name]; !ok {
+				store.byName[name] = &cert
+			}
+		}
+	}
+	if store.def == nil {
+		return nil, fmt.Errorf("no certificate")
+	}
+	return store, nil
+}
+
+// get returns the certificate of the exact name, or the wildcard name,
+// e.g. "*.example.com" for "www.example.com", or the default one.
+func (c *certStore) get(serverName string) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if cert, ok := c.byName[name]; ok {
+		return cert
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if cert, ok := c.byName["*"+name[i:]]; ok {
+			return cert
+		}
+	}
+	return c.def
+}
+
+// servesTLS returns true if the listener serves TLS.
+func (s *VirtualServer) servesTLS() bool {
+	switch s.Protocol {
+	case ProtoHTTPS:
+		return true
+	case ProtoGRPC:
+		return s.CertFile != "" || len(s.Certificates) > 0
+	}
+	return false
+}
+
+// keyPairs returns the key pairs, the default one comes first.
+func (s *VirtualServer) keyPairs() []config.Certificate {
+	pairs := []config.Certificate{}
+	if s.CertFile != "" {
+		pairs = append(pairs, config.Certificate{CertFile: s.CertFile, KeyFile: s.KeyFile})
+	}
+	return append(pairs, s.Certificates...)
+}
+
+// serverTLSConfig loads the certificates and returns the TLS config of the listener.
+func (s *VirtualServer) serverTLSConfig() (*tls.Config, error) {
+	if err := s.ReloadCertificates(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     s.minTLSVersion,
+		CipherSuites:   s.cipherSuites,
+		GetCertificate: s.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}, nil
+}
+
+// getCertificate selects the certificate by SNI.
+func (s *VirtualServer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	store, ok := s.certs.Load().(*certStore)
+	if !ok {
+		return nil, fmt.Errorf("no certificate")
+	}
+	return store.get(hello.ServerName), nil
+}
+
+// ReloadCertificates loads the certificates and swaps the served ones,
+// the old ones are kept if any key pair is broken.
+func (s *VirtualServer) ReloadCertificates() error {
+	if !s.servesTLS() {
+		return fmt.Errorf("%s does not serve tls", s.Name)
+	}
+	store, err := loadCertStore(s.keyPairs())
+	if err != nil {
+		log.Errorf("%s load certificates error=%v, keep the served ones", s.Name, err)
+		return err
+	}
+	s.certs.Store(store)
+	for _, cert := range store.all {
+		log.Infof("%s load certificate %s, expires at %v", s.Name, cert.Leaf.Subject.CommonName, cert.Leaf.NotAfter)
+	}
+	return nil
+}
+
+// certFileStamps returns the modification time and size of the certificate files.
+func (s *VirtualServer) certFileStamps() map[string]string {
+	stamps := map[string]string{}
+	for _, pair := range s.keyPairs() {
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			if fi, err := os.Stat(file); err == nil {
+				stamps[file] = fmt.Sprintf("%d/%d", fi.ModTime().UnixNano(), fi.Size())
+			} else {
+				stamps[file] = ""
+			}
+		}
+	}
+	return stamps
+}
+
+// watchCertificates reloads the certificates once the files change.
+func (s *VirtualServer) watchCertificates(stopC chan struct{}) {
+	ticker := time.NewTicker(s.CertReloadInterval)
+	defer ticker.Stop()
+	stamps := s.certFileStamps()
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-ticker.C:
+			changed := s.certFileStamps()
+			for file, stamp := range changed {
+				if stamps[file] != stamp {
+					log.Infof("%s certificate file %s changed", s.Name, file)
+					s.ReloadCertificates()
+					break
+				}
+			}
+			stamps = changed
+		}
+	}
+}
+
+// startCertWatcher starts watching the certificate files.
+func (s *VirtualServer) startCertWatcher() {
+	if !s.servesTLS() {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.certWatchC == nil {
+		s.certWatchC = make(chan struct{})
+		go s.watchCertificates(s.certWatchC)
+	}
+}
+
+// stopCertWatcher stops watching the certificate files.
+func (s *VirtualServer) stopCertWatcher() {
+	s.Lock()
+	defer s.Unlock()
+	if s.certWatchC != nil {
+		close(s.certWatchC)
+		s.certWatchC = nil
+	}
+}
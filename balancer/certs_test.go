@@ -0,0 +1,156 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestCertStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defCert, defKey := writeCert(t, dir, "default", "localhost")
+	aCert, aKey := writeCert(t, dir, "a", "a.example.com")
+	bCert, bKey := writeCert(t, dir, "b", "*.b.example.com", "b.example.com")
+
+	store, err := loadCertStore([]config.Certificate{
+		{CertFile: defCert, KeyFile: defKey},
+		{CertFile: aCert, KeyFile: aKey},
+		{CertFile: bCert, KeyFile: bKey},
+	})
+	require.NoError(t, err)
+	for name, expect := range map[string]string{
+		"":                  "default",
+		"localhost":         "default",
+		"A.example.com":     "a",
+		"b.example.com":     "b",
+		"www.b.example.com": "b",
+		"x.y.b.example.com": "default",
+		"c.example.com":     "default",
+	} {
+		assert.Equal(t, expect, store.get(name).Leaf.Subject.CommonName, name)
+	}
+
+	_, err = loadCertStore(nil)
+	assert.EqualError(t, err, "no certificate")
+	_, err = loadCertStore([]config.Certificate{{CertFile: aCert, KeyFile: bKey}})
+	assert.Contains(t, err.Error(), "load certificate '"+aCert+"' error=")
+}
+
+func TestHTTPSCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	aCert, aKey := writeCert(t, dir, "a", "a.example.com")
+	bCert, bKey := writeCert(t, dir, "b", "*.b.example.com")
+
+	addr := "127.0.0.1:8090"
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(addr),
+		ProtocolOpt(ProtoHTTPS),
+		CertificatesOpt([]config.Certificate{{CertFile: aCert, KeyFile: aKey}, {CertFile: bCert, KeyFile: bKey}}),
+		TLSOpt("", ""),
+		MinTLSVersionOpt("1.2"),
+		CipherSuitesOpt([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, vs.Run())
+	defer vs.Stop()
+	// the TLS config is set before the virtual server is enabled
+	vs.RLock()
+	assert.NotNil(t, vs.tlsConfig)
+	vs.RUnlock()
+	time.Sleep(time.Second)
+
+	for name, expect := range map[string]string{
+		"a.example.com":     "a",
+		"www.b.example.com": "b",
+		"unknown.com":       "a",
+	} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		require.NoError(t, err)
+		state := conn.ConnectionState()
+		assert.Equal(t, expect, state.PeerCertificates[0].Subject.CommonName)
+		conn.Close()
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	require.NoError(t, err)
+	assert.Equal(t, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, conn.ConnectionState().CipherSuite)
+	conn.Close()
+
+	_, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11})
+	assert.Error(t, err)
+}
+
+func TestTLSSettingsOpt(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":443"), ProtocolOpt(ProtoHTTPS),
+		CertificatesOpt([]config.Certificate{{CertFile: "not_exist.pem"}}))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "cert file 'not_exist.pem' does not exist")
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":443"), MinTLSVersionOpt("1.4"))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "min tls version '1.4' is not supported")
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":443"), CipherSuitesOpt([]string{"TLS_RSA_WITH_RC4_128_SHA"}))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "cipher suite 'TLS_RSA_WITH_RC4_128_SHA' is not supported")
+}
+
+func serverCertName(t *testing.T, addr string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestReloadCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCert(t, dir, "old", "localhost")
+
+	addr := "127.0.0.1:8091"
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(addr),
+		ProtocolOpt(ProtoHTTPS),
+		TLSOpt(certFile, keyFile),
+		CertReloadIntervalOpt(1),
+	)
+	require.NoError(t, err)
+	require.NoError(t, vs.Run())
+	defer vs.Stop()
+	time.Sleep(time.Second)
+	assert.Equal(t, "old", serverCertName(t, addr))
+
+	// the watcher reloads the rotated certificate
+	newCert, newKey := writeCert(t, dir, "new", "localhost")
+	require.NoError(t, os.Rename(newCert, certFile))
+	require.NoError(t, os.Rename(newKey, keyFile))
+	time.Sleep(2 * time.Second)
+	assert.Equal(t, "new", serverCertName(t, addr))
+
+	// the broken key pair is refused
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("broken"), 0600))
+	assert.Contains(t, vs.ReloadCertificates().Error(), "load certificate '"+certFile+"' error=")
+	assert.Equal(t, "new", serverCertName(t, addr))
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"))
+	require.NoError(t, err)
+	assert.EqualError(t, vs.ReloadCertificates(), "web does not serve tls")
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), CertReloadIntervalOpt(-1))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "cert reload interval -1 is negative")
+}
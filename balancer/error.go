@@ -14,6 +14,8 @@ var (
 	ErrVirtualServerNameExisted    = errors.New("virtual server name existed")
 	ErrVirtualServerAddressExisted = errors.New("virtual server address existed")
 	ErrVirtualServerNotFound       = errors.New("virtual server not found")
+	ErrRouteNameEmpty              = errors.New("route name is not specified")
+	ErrPoolNameEmpty               = errors.New("pool name is not specified")
 )
 
 type balancerError struct {
@@ -0,0 +1,66 @@
+package balancer
+
+import (
+	"net/http"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+)
+
+// grpcPeerFailures maps the grpc status of a failing peer to the http
+// status judged by passive health and outlier detection. The other statuses
+// are answers of the handlers, e.g. Unimplemented or Internal, which tell
+// nothing about the health of the peer.
+var grpcPeerFailures = map[codes.Code]int{
+	codes.Unavailable:      http.StatusServiceUnavailable,
+	codes.DeadlineExceeded: http.StatusGatewayTimeout,
+}
+
+// grpcStatus returns the status of the grpc response, which is sent in the
+// trailers, or in the headers of a trailers-only response.
+func grpcStatus(h http.Header) (codes.Code, bool) {
+	v := h.Get("Grpc-Status")
+	if v == "" {
+		v = h.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	if v == "" {
+		return codes.Unknown, false
+	}
+	code, err := strconv.Atoi(v)
+	if err != nil {
+		return codes.Unknown, true
+	}
+	return codes.Code(code), true
+}
+
+// setGRPCStatus records the grpc status of the response, so that it is
+// counted by the stats and judged by passive health.
+func (w *lbResponseWriter) setGRPCStatus() {
+	if w.err != nil || w.code != http.StatusOK {
+		return
+	}
+	if code, ok := grpcStatus(w.Header()); ok {
+		w.grpcStatus = &code
+	}
+}
+
+// healthCode returns the http status of the response, the grpc status of a
+// failing peer is mapped to the http status, and the others are 200.
+func (w *lbResponseWriter) healthCode() int {
+	if w.grpcStatus == nil {
+		return w.code
+	}
+	if code, ok := grpcPeerFailures[*w.grpcStatus]; ok {
+		return code
+	}
+	return http.StatusOK
+}
+
+// statusCode returns the status recorded in the stats, e.g. "200" or the
+// grpc status "Unavailable".
+func (w *lbResponseWriter) statusCode() string {
+	if w.grpcStatus != nil {
+		return w.grpcStatus.String()
+	}
+	return strconv.Itoa(w.code)
+}
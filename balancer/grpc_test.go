@@ -0,0 +1,150 @@
+package balancer
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"github.com/onestraw/golb/config"
+)
+
+type healthServer struct {
+	code  codes.Code
+	calls int32
+}
+
+func (s *healthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	atomic.AddInt32(&s.calls, 1)
+	if s.code != codes.OK {
+		return nil, status.Error(s.code, "check fails")
+	}
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+func (s *healthServer) Watch(req *grpc_health_v1.HealthCheckRequest, stream grpc_health_v1.Health_WatchServer) error {
+	return status.Error(codes.Unimplemented, "unimplemented")
+}
+
+func grpcServer(t *testing.T, hs *healthServer) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, hs)
+	go server.Serve(ln)
+	return ln.Addr().String(), server.Stop
+}
+
+func TestGRPCVirtualServer(t *testing.T) {
+	good := &healthServer{code: codes.OK}
+	goodAddr, stop := grpcServer(t, good)
+	defer stop()
+	bad := &healthServer{code: codes.Unavailable}
+	badAddr, stop := grpcServer(t, bad)
+	defer stop()
+
+	addr := "127.0.0.1:8088"
+	vs, err := NewVirtualServer(
+		NameOpt("echo"),
+		AddressOpt(addr),
+		ProtocolOpt(ProtoGRPC),
+		PassiveHealthOpt(&config.PassiveHealth{MaxFails: 1}),
+		PoolOpt([]config.Server{{Address: goodAddr, Weight: 1}, {Address: badAddr, Weight: 1}}),
+		RetryOpt(true),
+	)
+	require.NoError(t, err)
+	require.NoError(t, vs.Run())
+	defer vs.Stop()
+	time.Sleep(time.Second)
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithAuthority(DefaultServerName))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+
+	// the unavailable peer is retried and then marked down
+	for i := 0; i < 4; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		cancel()
+		require.NoError(t, err)
+		assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, resp.Status)
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&good.calls))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&bad.calls))
+	assert.Equal(t, map[string]bool{DownByPassive: true}, vs.downBy[badAddr])
+	assert.Contains(t, vs.Stats(), goodAddr+"\nstatus_code: OK:4\n")
+	assert.Contains(t, vs.Stats(), badAddr+"\nstatus_code: Unavailable:1\n")
+}
+
+func TestGRPCStatus(t *testing.T) {
+	code, ok := grpcStatus(http.Header{})
+	assert.False(t, ok)
+
+	code, ok = grpcStatus(http.Header{"Grpc-Status": {"14"}})
+	assert.True(t, ok)
+	assert.Equal(t, codes.Unavailable, code)
+
+	code, ok = grpcStatus(http.Header{http.TrailerPrefix + "Grpc-Status": {"0"}})
+	assert.True(t, ok)
+	assert.Equal(t, codes.OK, code)
+
+	w := &lbResponseWriter{code: http.StatusOK}
+	assert.Equal(t, http.StatusOK, w.healthCode())
+	assert.Equal(t, "200", w.statusCode())
+	code = codes.DeadlineExceeded
+	w.grpcStatus = &code
+	assert.Equal(t, http.StatusGatewayTimeout, w.healthCode())
+	assert.Equal(t, "DeadlineExceeded", w.statusCode())
+	code = codes.Internal
+	assert.Equal(t, http.StatusOK, w.healthCode())
+	assert.Equal(t, "Internal", w.statusCode())
+}
+
+func TestGRPCUnimplemented(t *testing.T) {
+	hs := &healthServer{code: codes.Unimplemented}
+	peer, stop := grpcServer(t, hs)
+	defer stop()
+	other, stop := grpcServer(t, &healthServer{code: codes.Unimplemented})
+	defer stop()
+
+	addr := "127.0.0.1:8094"
+	vs, err := NewVirtualServer(
+		NameOpt("echo"),
+		AddressOpt(addr),
+		ProtocolOpt(ProtoGRPC),
+		PassiveHealthOpt(&config.PassiveHealth{MaxFails: 1}),
+		OutlierDetectionOpt(&config.OutlierDetection{Consecutive5xx: 1}),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1}, {Address: other, Weight: 1}}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, vs.Run())
+	defer vs.Stop()
+	time.Sleep(time.Second)
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(), grpc.WithAuthority(DefaultServerName))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := grpc_health_v1.NewHealthClient(conn)
+
+	// the answers of the handler never mark the peer down
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		cancel()
+		assert.Equal(t, codes.Unimplemented, status.Code(err))
+	}
+	assert.Equal(t, int32(10), atomic.LoadInt32(&hs.calls))
+	assert.Nil(t, vs.downBy[peer])
+	assert.False(t, vs.outlier.Ejected(peer))
+	assert.Contains(t, vs.Stats(), peer+"\nstatus_code: Unimplemented:10\n")
+}
@@ -0,0 +1,121 @@
+package balancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Sources of the hash key.
+const (
+	HashKeyRemoteIP   = "remote_ip"
+	HashKeyRemoteAddr = "remote_addr"
+	HashKeyHost       = "host"
+	HashKeyURI        = "uri"
+	HashKeyHeader     = "header"
+	HashKeyCookie     = "cookie"
+	HashKeyQuery      = "query"
+
+	DefaultHashKey = HashKeyRemoteIP
+)
+
+type hashKeySource struct {
+	kind string
+	name string
+}
+
+// hashKey is a fallback chain of sources, the first non-empty value is used.
+type hashKey []hashKeySource
+
+// parseHashKey parses a comma separated list of sources,
+// e.g. "header:X-User-ID,cookie:session,remote_ip".
+func parseHashKey(key string) (hashKey, error) {
+	if key == "" {
+		key = DefaultHashKey
+	}
+	var result hashKey
+	for _, part := range strings.Split(key, ",") {
+		part = strings.TrimSpace(part)
+		kv := strings.SplitN(part, ":", 2)
+		src := hashKeySource{kind: kv[0]}
+		switch src.kind {
+		case HashKeyRemoteIP, HashKeyRemoteAddr, HashKeyHost, HashKeyURI:
+			if len(kv) != 1 {
+				return nil, fmt.Errorf("hash key '%s' does not take a name", part)
+			}
+		case HashKeyHeader, HashKeyCookie, HashKeyQuery:
+			if len(kv) != 2 || kv[1] == "" {
+				return nil, fmt.Errorf("hash key '%s' requires a name", part)
+			}
+			src.name = kv[1]
+		default:
+			return nil, fmt.Errorf("hash key '%s' is not supported", part)
+		}
+		result = append(result, src)
+	}
+	return result, nil
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (src hashKeySource) value(r *http.Request) string {
+	switch src.kind {
+	case HashKeyRemoteIP:
+		return remoteIP(r)
+	case HashKeyRemoteAddr:
+		return r.RemoteAddr
+	case HashKeyHost:
+		return r.Host
+	case HashKeyURI:
+		return r.URL.RequestURI()
+	case HashKeyHeader:
+		return r.Header.Get(src.name)
+	case HashKeyCookie:
+		if c, err := r.Cookie(src.name); err == nil {
+			return c.Value
+		}
+	case HashKeyQuery:
+		return r.URL.Query().Get(src.name)
+	}
+	return ""
+}
+
+// value returns the first non-empty value in the chain,
+// the client IP is used if all of them are missing.
+func (h hashKey) value(r *http.Request) string {
+	for _, src := range h {
+		if v := src.value(r); v != "" {
+			return v
+		}
+	}
+	return remoteIP(r)
+}
+
+// connOnly returns true if all the sources are available on a raw connection.
+func (h hashKey) connOnly() bool {
+	for _, src := range h {
+		if src.kind != HashKeyRemoteIP && src.kind != HashKeyRemoteAddr {
+			return false
+		}
+	}
+	return true
+}
+
+// connValue returns the hash key of a raw connection.
+func (h hashKey) connValue(remoteAddr string) string {
+	if len(h) > 0 && h[0].kind == HashKeyRemoteAddr {
+		return remoteAddr
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -0,0 +1,71 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHashKey(t *testing.T) {
+	h, err := parseHashKey("")
+	require.NoError(t, err)
+	assert.Equal(t, hashKey{{kind: HashKeyRemoteIP}}, h)
+
+	h, err = parseHashKey("header:X-User-ID, cookie:session,query:tenant,uri")
+	require.NoError(t, err)
+	assert.Equal(t, hashKey{
+		{HashKeyHeader, "X-User-ID"},
+		{HashKeyCookie, "session"},
+		{HashKeyQuery, "tenant"},
+		{HashKeyURI, ""},
+	}, h)
+
+	for _, key := range []string{"header", "cookie:", "uri:x", "body", "remote_ip,"} {
+		_, err = parseHashKey(key)
+		assert.Error(t, err, key)
+	}
+}
+
+func TestHashKeyValue(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost/order?tenant=t1", nil)
+	req.RemoteAddr = "10.0.0.1:34567"
+	req.Header.Set("X-User-ID", "u1")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+
+	tests := []struct {
+		key    string
+		expect string
+	}{
+		{"remote_ip", "10.0.0.1"},
+		{"remote_addr", "10.0.0.1:34567"},
+		{"host", "localhost"},
+		{"uri", "/order?tenant=t1"},
+		{"header:X-User-ID", "u1"},
+		{"cookie:session", "s1"},
+		{"query:tenant", "t1"},
+		{"header:X-Missing,cookie:missing,query:tenant", "t1"},
+		{"header:X-Missing", "10.0.0.1"},
+	}
+	for _, tc := range tests {
+		h, err := parseHashKey(tc.key)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expect, h.value(req), tc.key)
+	}
+}
+
+func TestHashKeyOpt(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"))
+	require.NoError(t, err)
+	assert.Equal(t, DefaultHashKey, vs.HashKey)
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), HashKeyOpt("cookie:session"))
+	require.NoError(t, err)
+	assert.Equal(t, "cookie:session", vs.HashKey)
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), HashKeyOpt("cookie"))
+	assert.Nil(t, vs)
+	assert.Contains(t, err.Error(), "requires a name")
+}
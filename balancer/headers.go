@@ -0,0 +1,202 @@
+package balancer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/onestraw/golb/config"
+)
+
+// headerVariables are the variables of the header values.
+var headerVariables = map[string]bool{
+	"remote_ip":   true,
+	"remote_addr": true,
+	"scheme":      true,
+	"host":        true,
+	"peer":        true,
+	"vs_name":     true,
+	"route":       true,
+	"request_id":  true,
+}
+
+// headerRules modifies the headers of the upstream request and the response,
+// the headers are removed first, then set, then added. A literal "$" of the
+// values is written as "$$". X-Forwarded-For is not removable, as it is
+// appended by the reverse proxy.
+type headerRules struct {
+	cfg *config.HeaderRules
+}
+
+// parseHeaderRules checks the variables of the values, nil if not configured.
+func parseHeaderRules(cfg *config.HeaderRules) (*headerRules, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	for _, name := range cfg.RemoveRequest {
+		if http.CanonicalHeaderKey(name) == "X-Forwarded-For" {
+			return nil, fmt.Errorf("header '%s' is appended by the proxy and cannot be removed", name)
+		}
+	}
+	var err error
+	check := func(name string) string {
+		if name != "$" && !headerVariables[name] && err == nil {
+			err = fmt.Errorf("header variable '$%s' is not supported", name)
+		}
+		return ""
+	}
+	for _, values := range []map[string]string{cfg.SetRequest, cfg.AddRequest, cfg.SetResponse} {
+		for _, value := range values {
+			os.Expand(value, check)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &headerRules{cfg: cfg}, nil
+}
+
+// HeaderRulesOpt returns a function to set the header rules of the upstream
+// requests and the responses, which are applied before the ones of the route.
+func HeaderRulesOpt(cfg *config.HeaderRules) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if cfg == nil {
+			return nil
+		}
+		if vs.Protocol == ProtoTCP || vs.Protocol == ProtoUDP {
+			return fmt.Errorf("header rules are not supported by %s", vs.Protocol)
+		}
+		rules, err := parseHeaderRules(cfg)
+		if err != nil {
+			return err
+		}
+		vs.headerRules = rules
+		return nil
+	}
+}
+
+// headerVars holds the values of the variables of a request.
+type headerVars struct {
+	r         *http.Request
+	peer      string
+	vsName    string
+	route     string
+	requestID string
+}
+
+func (v *headerVars) value(name string) string {
+	switch name {
+	case "remote_ip":
+		return remoteIP(v.r)
+	case "remote_addr":
+		return v.r.RemoteAddr
+	case "scheme":
+		if v.r.TLS != nil {
+			return "https"
+		}
+		return "http"
+	case "host":
+		return v.r.Host
+	case "peer":
+		return v.peer
+	case "vs_name":
+		return v.vsName
+	case "route":
+		return v.route
+	case "$":
+		return "$"
+	case "request_id":
+		// the same one in the request and the response
+		if v.requestID == "" {
+			id := make([]byte, 16)
+			rand.Read(id)
+			v.requestID = hex.EncodeToString(id)
+		}
+		return v.requestID
+	}
+	return ""
+}
+
+func (v *headerVars) expand(value string) string {
+	return os.Expand(value, v.value)
+}
+
+func (h *headerRules) modifyRequest(r *http.Request, vars *headerVars) {
+	for _, name := range h.cfg.RemoveRequest {
+		r.Header.Del(name)
+	}
+	for name, value := range h.cfg.SetRequest {
+		value = vars.expand(value)
+		if strings.EqualFold(name, "Host") {
+			r.Host = value
+			continue
+		}
+		r.Header.Set(name, value)
+	}
+	for name, value := range h.cfg.AddRequest {
+		r.Header.Add(name, vars.expand(value))
+	}
+}
+
+func (h *headerRules) modifyResponse(header http.Header, vars *headerVars) {
+	for _, name := range h.cfg.RemoveResponse {
+		header.Del(name)
+	}
+	for name, value := range h.cfg.SetResponse {
+		header.Set(name, vars.expand(value))
+	}
+}
+
+// headerContext carries the rules and the variables of a request.
+type headerContext struct {
+	rules []*headerRules
+	vars  *headerVars
+}
+
+// headerContext returns the header rules of the virtual server and the
+// route for the request, nil if none.
+func (s *VirtualServer) headerContext(r *http.Request, rt *route) *headerContext {
+	hc := &headerContext{vars: &headerVars{r: r, vsName: s.Name}}
+	if s.headerRules != nil {
+		hc.rules = append(hc.rules, s.headerRules)
+	}
+	if rt != nil {
+		hc.vars.route = rt.cfg.Name
+		if rt.headerRules != nil {
+			hc.rules = append(hc.rules, rt.headerRules)
+		}
+	}
+	if len(hc.rules) == 0 {
+		return nil
+	}
+	return hc
+}
+
+// upstreamRequest returns the request to the peer with the request header
+// rules applied, or r itself if none.
+func (hc *headerContext) upstreamRequest(r *http.Request, peer string) *http.Request {
+	if hc == nil {
+		return r
+	}
+	hc.vars.peer = peer
+	// the retried request is not modified twice
+	out := r.Clone(r.Context())
+	for _, rules := range hc.rules {
+		rules.modifyRequest(out, hc.vars)
+	}
+	return out
+}
+
+// modifyResponse applies the response header rules, which covers the
+// responses of the peers and the errors of the balancer.
+func (hc *headerContext) modifyResponse(header http.Header) {
+	if hc == nil {
+		return
+	}
+	for _, rules := range hc.rules {
+		rules.modifyResponse(header, hc.vars)
+	}
+}
@@ -0,0 +1,122 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestHeaderRules(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Internal", "secret")
+		w.Header().Set("X-Powered-By", "go")
+		w.Write([]byte(strings.Join([]string{
+			r.Host,
+			r.Header.Get("X-Forwarded-Proto"),
+			r.Header.Get("X-Client"),
+			r.Header.Get("X-VS"),
+			r.Header.Get("X-Internal"),
+			strings.Join(r.Header["X-Tag"], ","),
+			r.Header.Get("X-Request-Id"),
+		}, "|")))
+	}))
+	defer backend.Close()
+	peer := backend.Listener.Addr().String()
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		HeaderRulesOpt(&config.HeaderRules{
+			SetRequest:     map[string]string{"Host": "backend.local", "X-Forwarded-Proto": "$scheme", "X-Client": "${remote_ip}", "X-VS": "$vs_name"},
+			AddRequest:     map[string]string{"X-Tag": "vs"},
+			RemoveRequest:  []string{"X-Internal"},
+			SetResponse:    map[string]string{"X-Upstream": "$peer", "X-Price": "$$5"},
+			RemoveResponse: []string{"X-Internal"},
+		}),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1}}),
+		RoutesOpt([]config.Route{{
+			Name:   "api",
+			Prefix: "/api/",
+			HeaderRules: &config.HeaderRules{
+				SetRequest:     map[string]string{"X-Request-Id": "$request_id"},
+				AddRequest:     map[string]string{"X-Tag": "$route"},
+				SetResponse:    map[string]string{"X-Request-Id": "$request_id"},
+				RemoveResponse: []string{"X-Powered-By"},
+			},
+		}}),
+		RetryOpt(true),
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = DefaultServerName
+	req.RemoteAddr = "10.0.0.1:4321"
+	req.Header.Set("X-Internal", "1")
+	rr := httptest.NewRecorder()
+	vs.handler.ServeHTTP(rr, req)
+	assert.Equal(t, "backend.local|http|10.0.0.1|web||vs|", rr.Body.String())
+	assert.Equal(t, peer, rr.Header().Get("X-Upstream"))
+	assert.Equal(t, "$5", rr.Header().Get("X-Price"))
+	assert.Equal(t, "", rr.Header().Get("X-Internal"))
+	assert.Equal(t, "go", rr.Header().Get("X-Powered-By"))
+	// the request of the client is untouched
+	assert.Equal(t, DefaultServerName, req.Host)
+	assert.Equal(t, "1", req.Header.Get("X-Internal"))
+
+	req = httptest.NewRequest("GET", "/api/users", nil)
+	req.Host = DefaultServerName
+	rr = httptest.NewRecorder()
+	vs.handler.ServeHTTP(rr, req)
+	fields := strings.Split(rr.Body.String(), "|")
+	require.Equal(t, 7, len(fields))
+	assert.Equal(t, "vs,api", fields[5])
+	assert.Equal(t, 32, len(fields[6]))
+	assert.Equal(t, fields[6], rr.Header().Get("X-Request-Id"))
+	assert.Equal(t, "", rr.Header().Get("X-Powered-By"))
+	assert.Equal(t, peer, rr.Header().Get("X-Upstream"))
+
+	// the errors of the proxy and the balancer have the response headers too
+	vs.RemovePeer(peer)
+	vs.AddPeer("127.0.0.1:1", 1)
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Host = DefaultServerName
+	rr = httptest.NewRecorder()
+	vs.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.Equal(t, "127.0.0.1:1", rr.Header().Get("X-Upstream"))
+	vs.RemovePeer("127.0.0.1:1")
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Host = DefaultServerName
+	rr = httptest.NewRecorder()
+	vs.handler.ServeHTTP(rr, req)
+	assert.Equal(t, ErrPeerNotFound.StatusCode, rr.Code)
+	assert.Equal(t, "$5", rr.Header().Get("X-Price"))
+}
+
+func TestHeaderRulesOpt(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		HeaderRulesOpt(&config.HeaderRules{SetRequest: map[string]string{"X-Id": "$uuid"}}))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "header variable '$uuid' is not supported")
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), PoolOpt(nil),
+		RoutesOpt([]config.Route{{Name: "api", HeaderRules: &config.HeaderRules{SetResponse: map[string]string{"X-Id": "${id}"}}}}))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "route api header variable '$id' is not supported")
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		HeaderRulesOpt(&config.HeaderRules{RemoveRequest: []string{"x-forwarded-for"}}))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "header 'x-forwarded-for' is appended by the proxy and cannot be removed")
+
+	vs, err = NewVirtualServer(NameOpt("redis"), AddressOpt(":6379"), ProtocolOpt(ProtoTCP),
+		HeaderRulesOpt(&config.HeaderRules{}))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "header rules are not supported by tcp")
+}
@@ -0,0 +1,141 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+)
+
+// The protocols speaking to the peers.
+const (
+	UpstreamHTTP1 = "http1"
+	UpstreamH2    = "h2"
+	UpstreamH2C   = "h2c"
+)
+
+// H2COpt returns a function to accept h2c, i.e. HTTP/2 over plaintext,
+// on the http listener.
+func H2COpt(enable bool) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		vs.H2C = enable
+		return nil
+	}
+}
+
+// UpstreamProtocolOpt returns a function to set the protocol speaking to
+// the peers, h2 is HTTP/2 over TLS and h2c is HTTP/2 with prior knowledge.
+func UpstreamProtocolOpt(proto string) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		switch proto {
+		case "", UpstreamHTTP1, UpstreamH2, UpstreamH2C:
+		default:
+			return fmt.Errorf("upstream protocol '%s' is not supported", proto)
+		}
+		vs.UpstreamProtocol = proto
+		return nil
+	}
+}
+
+// checkHTTP2 sets the default upstream protocol and checks the HTTP/2
+// settings against the protocol of the virtual server.
+func (s *VirtualServer) checkHTTP2() error {
+	switch s.Protocol {
+	case ProtoTCP, ProtoUDP:
+		if s.UpstreamProtocol != "" {
+			return fmt.Errorf("upstream protocol '%s' is not supported by %s", s.UpstreamProtocol, s.Protocol)
+		}
+	case ProtoGRPC:
+		if s.UpstreamProtocol == "" {
+			s.UpstreamProtocol = UpstreamH2C
+		}
+		if s.UpstreamProtocol == UpstreamHTTP1 {
+			return fmt.Errorf("upstream protocol '%s' is not supported by %s", s.UpstreamProtocol, s.Protocol)
+		}
+	default:
+		if s.UpstreamProtocol == "" {
+			s.UpstreamProtocol = UpstreamHTTP1
+		}
+	}
+	if s.H2C && s.Protocol != ProtoHTTP && s.Protocol != ProtoGRPC {
+		return fmt.Errorf("h2c is not supported by %s", s.Protocol)
+	}
+	return nil
+}
+
+// upstreamH2C returns true if the peers speak h2c, which grpc does by
+// default before the upstream protocol is checked.
+func (s *VirtualServer) upstreamH2C() bool {
+	return s.UpstreamProtocol == UpstreamH2C || (s.UpstreamProtocol == "" && s.Protocol == ProtoGRPC)
+}
+
+// acceptH2C returns true if the listener serves h2c.
+func (s *VirtualServer) acceptH2C() bool {
+	switch s.Protocol {
+	case ProtoHTTP:
+		return s.H2C
+	case ProtoGRPC:
+		return !s.servesTLS()
+	}
+	return false
+}
+
+// multiplexed returns true if the requests share the upstream connections.
+func (s *VirtualServer) multiplexed() bool {
+	return s.UpstreamProtocol == UpstreamH2 || s.UpstreamProtocol == UpstreamH2C
+}
+
+// newTransport returns the transport speaking the upstream protocol,
+// nil means http.DefaultTransport.
+func newTransport(proto string, tlsConfig *tls.Config) http.RoundTripper {
+	switch proto {
+	case UpstreamH2:
+		return &http2.Transport{TLSClientConfig: tlsConfig}
+	case UpstreamH2C:
+		return newH2CTransport()
+	}
+	return newHTTP1Transport(tlsConfig)
+}
+
+// newH2CTransport returns a transport speaking HTTP/2 with prior knowledge
+// over plaintext, the requests to a peer share one connection.
+func newH2CTransport() http.RoundTripper {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			conn, err := net.DialTimeout(network, addr, DefaultDialTimeout)
+			if err != nil {
+				return nil, err
+			}
+			return &h2cConn{Conn: conn}, nil
+		},
+	}
+}
+
+// h2cConn tells whether the connection is reused, since the transport
+// starts the stream id of h2c from 3 and always takes it as reused.
+type h2cConn struct {
+	net.Conn
+	used int32
+}
+
+func (c *h2cConn) reused() bool {
+	return !atomic.CompareAndSwapInt32(&c.used, 0, 1)
+}
+
+// connTrace records whether the request is sent over a reused connection.
+func (w *lbResponseWriter) connTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			w.gotConn = true
+			w.reused = info.Reused
+			if c, ok := info.Conn.(*h2cConn); ok {
+				w.reused = c.reused()
+			}
+		},
+	}
+}
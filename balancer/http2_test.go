@@ -0,0 +1,107 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestH2C(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	defer backend.Close()
+	peer := backend.Listener.Addr().String()
+
+	addr := "127.0.0.1:8089"
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(addr),
+		H2COpt(true),
+		UpstreamProtocolOpt(UpstreamH2C),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1}}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, vs.Run())
+	defer vs.Stop()
+	time.Sleep(time.Second)
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("GET", "http://"+addr+"/", nil)
+		require.NoError(t, err)
+		req.Host = DefaultServerName
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/2.0", resp.Proto)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "HTTP/2.0", string(body))
+	}
+	assert.Contains(t, vs.Stats(), "\nnew_conns: 1\nreused_conns: 2\n")
+}
+
+func TestUpstreamProtocolOpt(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"))
+	require.NoError(t, err)
+	assert.Equal(t, UpstreamHTTP1, vs.UpstreamProtocol)
+	assert.Nil(t, vs.transport)
+	assert.False(t, vs.multiplexed())
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), UpstreamProtocolOpt(UpstreamH2))
+	require.NoError(t, err)
+	assert.True(t, vs.multiplexed())
+	rp, err := vs.getReverseProxy("127.0.0.1:10001")
+	require.NoError(t, err)
+	assert.Equal(t, vs.transport, rp.Transport)
+
+	vs, err = NewVirtualServer(NameOpt("echo"), AddressOpt(":50051"), ProtocolOpt(ProtoGRPC))
+	require.NoError(t, err)
+	assert.Equal(t, UpstreamH2C, vs.UpstreamProtocol)
+	assert.True(t, vs.acceptH2C())
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), UpstreamProtocolOpt("spdy"))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "upstream protocol 'spdy' is not supported")
+
+	vs, err = NewVirtualServer(NameOpt("echo"), AddressOpt(":50051"), ProtocolOpt(ProtoGRPC),
+		UpstreamProtocolOpt(UpstreamHTTP1))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "upstream protocol 'http1' is not supported by grpc")
+
+	vs, err = NewVirtualServer(NameOpt("redis"), AddressOpt(":6379"), ProtocolOpt(ProtoTCP), H2COpt(true))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "h2c is not supported by tcp")
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), UpstreamProtocolOpt(UpstreamH2C),
+		PoolOpt([]config.Server{{Address: "https://127.0.0.1:10001", Weight: 1}}))
+	assert.Nil(t, vs)
+	assert.Equal(t, config.ErrPoolMemberTLS, err)
+
+	vs, err = NewVirtualServer(NameOpt("echo"), AddressOpt(":50051"), ProtocolOpt(ProtoGRPC),
+		PoolOpt([]config.Server{{Address: "https://127.0.0.1:10001", Weight: 1}}))
+	assert.Nil(t, vs)
+	assert.Equal(t, config.ErrPoolMemberTLS, err)
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), UpstreamProtocolOpt(UpstreamH2),
+		PoolOpt([]config.Server{{Address: "https://127.0.0.1:10001", Weight: 1}}))
+	require.NoError(t, err)
+	assert.NoError(t, vs.CheckPeer(config.Server{Address: "https://127.0.0.1:10002"}))
+}
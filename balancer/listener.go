@@ -0,0 +1,160 @@
+package balancer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/onestraw/golb/config"
+)
+
+// listener is the listen address shared by the http, https and grpc virtual
+// servers, it dispatches the requests by host and the TLS handshakes by SNI.
+// The listener runs as long as any of the virtual servers is enabled.
+type listener struct {
+	sync.RWMutex
+	address  string
+	vservers []*VirtualServer
+	server   *http.Server
+}
+
+func newListener(vs *VirtualServer) *listener {
+	return &listener{
+		address:  vs.Address,
+		vservers: []*VirtualServer{vs},
+	}
+}
+
+// add shares the listener with the virtual server.
+func (l *listener) add(vs *VirtualServer) {
+	l.Lock()
+	defer l.Unlock()
+	l.vservers = append(l.vservers, vs)
+	vs.listener = l
+}
+
+// lookup returns the enabled virtual server whose server name matches the
+// host, or the default server, or else the first enabled one, which
+// responds 400 Host Not Match.
+func (l *listener) lookup(host string) *VirtualServer {
+	l.RLock()
+	defer l.RUnlock()
+	var def, first *VirtualServer
+	for _, vs := range l.vservers {
+		if vs.Status() != StatusEnabled {
+			continue
+		}
+		if vs.names().Match(host) {
+			return vs
+		}
+		if def == nil && vs.DefaultServer {
+			def = vs
+		}
+		if first == nil {
+			first = vs
+		}
+	}
+	if def != nil {
+		return def
+	}
+	return first
+}
+
+// ServeHTTP dispatches the request to the virtual server by host.
+func (l *listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vs := l.lookup(r.Host)
+	if vs == nil {
+		log.Errorf("Host not match, host=%s", r.Host)
+		WriteError(w, ErrHostNotMatch)
+		return
+	}
+	vs.handler.ServeHTTP(w, r)
+}
+
+// getConfigForClient selects the TLS config of the virtual server by SNI.
+func (l *listener) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	vs := l.lookup(hello.ServerName)
+	if vs == nil {
+		return nil, fmt.Errorf("no virtual server on %s", l.address)
+	}
+	vs.RLock()
+	defer vs.RUnlock()
+	return vs.tlsConfig, nil
+}
+
+// serve starts the listener unless it is running, the virtual servers
+// sharing the listener agree on TLS and h2c.
+func (l *listener) serve(vs *VirtualServer) error {
+	l.Lock()
+	if l.server != nil {
+		l.Unlock()
+		return nil
+	}
+	var handler http.Handler = l
+	if vs.acceptH2C() {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	server := &http.Server{Addr: l.address, Handler: handler}
+	l.server = server
+	l.Unlock()
+
+	var err error
+	if vs.servesTLS() {
+		server.TLSConfig = &tls.Config{GetConfigForClient: l.getConfigForClient}
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	// the listener may be started again once it fails
+	l.Lock()
+	if l.server == server {
+		l.server = nil
+	}
+	l.Unlock()
+	return err
+}
+
+// stop shuts down the listener unless another virtual server is enabled.
+func (l *listener) stop(vs *VirtualServer) error {
+	l.Lock()
+	for _, v := range l.vservers {
+		if v != vs && v.Status() == StatusEnabled {
+			l.Unlock()
+			return nil
+		}
+	}
+	server := l.server
+	l.server = nil
+	l.Unlock()
+
+	if server == nil {
+		return nil
+	}
+	return server.Shutdown(context.Background())
+}
+
+// listenConfig returns how the virtual server listens on its address.
+func (s *VirtualServer) listenConfig() *config.Listen {
+	return &config.Listen{
+		Name:          s.Name,
+		Address:       s.Address,
+		Protocol:      s.Protocol,
+		Exclusive:     s.Protocol == ProtoTCP || s.Protocol == ProtoUDP,
+		Datagram:      s.Protocol == ProtoUDP,
+		TLS:           s.servesTLS(),
+		H2C:           s.acceptH2C(),
+		DefaultServer: s.DefaultServer,
+		ServerNames:   s.names().Names,
+	}
+}
+
+// conflicts returns the error if the virtual servers cannot share the address.
+func (s *VirtualServer) conflicts(o *VirtualServer) error {
+	return config.CheckShared(s.listenConfig(), o.listenConfig())
+}
@@ -0,0 +1,160 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func requestHost(t *testing.T, client *http.Client, url, host string) (int, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	require.NoError(t, err)
+	req.Host = host
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestSharedListener(t *testing.T) {
+	s1 := httptest.NewServer(newHandler("s1"))
+	defer s1.Close()
+	s2 := httptest.NewServer(newHandler("s2"))
+	defer s2.Close()
+
+	addr := "127.0.0.1:8092"
+	b, err := New([]config.VirtualServer{
+		{Name: "a", Address: addr, ServerName: "a.example.com", Pool: []config.Server{{Address: s1.URL[7:], Weight: 1}}},
+		{Name: "b", Address: addr, ServerName: "*.b.example.com", Pool: []config.Server{{Address: s2.URL[7:], Weight: 1}}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, b.Run())
+	time.Sleep(time.Second)
+
+	client := &http.Client{}
+	url := fmt.Sprintf("http://%s/", addr)
+	for host, expect := range map[string]string{
+		"a.example.com":          "s1",
+		"a.example.com:8092":     "s1",
+		"www.b.example.com:8092": "s2",
+		"unknown.com":            "Host Not Match",
+	} {
+		_, body := requestHost(t, client, url, host)
+		assert.Equal(t, expect, body, host)
+	}
+
+	// the listener keeps serving the enabled one
+	a, err := b.FindVirtualServer("a")
+	require.NoError(t, err)
+	require.NoError(t, a.Stop())
+	code, _ := requestHost(t, client, url, "a.example.com")
+	assert.Equal(t, http.StatusBadRequest, code)
+	_, body := requestHost(t, client, url, "www.b.example.com")
+	assert.Equal(t, "s2", body)
+
+	require.NoError(t, a.Run())
+	time.Sleep(100 * time.Millisecond)
+	_, body = requestHost(t, client, url, "a.example.com")
+	assert.Equal(t, "s1", body)
+
+	require.NoError(t, b.Stop())
+	_, err = client.Get(url)
+	assert.Error(t, err)
+}
+
+func TestSharedTLSListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	aCert, aKey := writeCert(t, dir, "a", "a.example.com")
+	bCert, bKey := writeCert(t, dir, "b", "b.example.com")
+	s1 := httptest.NewServer(newHandler("s1"))
+	defer s1.Close()
+	s2 := httptest.NewServer(newHandler("s2"))
+	defer s2.Close()
+
+	addr := "127.0.0.1:8093"
+	b, err := New([]config.VirtualServer{
+		{Name: "a", Address: addr, ServerName: "a.example.com", Protocol: ProtoHTTPS,
+			CertFile: aCert, KeyFile: aKey, MinTLSVersion: "1.2",
+			Pool: []config.Server{{Address: s1.URL[7:], Weight: 1}}},
+		{Name: "b", Address: addr, ServerName: "b.example.com", Protocol: ProtoHTTPS, DefaultServer: true,
+			CertFile: bCert, KeyFile: bKey, MinTLSVersion: "1.3",
+			Pool: []config.Server{{Address: s2.URL[7:], Weight: 1}}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, b.Run())
+	defer b.Stop()
+	time.Sleep(time.Second)
+
+	for name, expect := range map[string][2]string{
+		"a.example.com": {"s1", "a"},
+		"b.example.com": {"s2", "b"},
+		"unknown.com":   {"s2", "b"},
+	} {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: name, InsecureSkipVerify: true},
+		}}
+		req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/", addr), nil)
+		require.NoError(t, err)
+		req.Host = name
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, expect[0], string(body), name)
+		assert.Equal(t, expect[1], resp.TLS.PeerCertificates[0].Subject.CommonName, name)
+	}
+
+	// the TLS settings are selected by SNI as well
+	_, err = tls.Dial("tcp", addr, &tls.Config{ServerName: "a.example.com", InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	assert.NoError(t, err)
+	_, err = tls.Dial("tcp", addr, &tls.Config{ServerName: "b.example.com", InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	assert.Error(t, err)
+}
+
+func TestListenerConflicts(t *testing.T) {
+	b, err := New([]config.VirtualServer{
+		{Name: "a", Address: ":80", ServerName: "a.com"},
+		{Name: "dns", Address: ":80", Protocol: ProtoUDP},
+	})
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		vs     config.VirtualServer
+		expect string
+	}{
+		{config.VirtualServer{Name: "b", Address: ":80", ServerName: "*.a.com .a.com"},
+			"virtual server b conflicts with a on :80, server name 'a.com' is duplicated"},
+		{config.VirtualServer{Name: "b", Address: ":80", ServerName: "www.*.com"},
+			"server name 'www.*.com' is invalid"},
+		{config.VirtualServer{Name: "b", Address: ":80", Protocol: ProtoTCP},
+			"virtual server b conflicts with a on :80, tcp does not share the address"},
+		{config.VirtualServer{Name: "b", Address: ":80", Protocol: ProtoUDP},
+			"virtual server b conflicts with dns on :80, udp does not share the address"},
+		{config.VirtualServer{Name: "b", Address: ":80", Protocol: ProtoGRPC, ServerName: "b.com"},
+			"virtual server b conflicts with a on :80, h2c and http/1.1 do not share the address"},
+	} {
+		assert.EqualError(t, b.AddVirtualServer(&c.vs), c.expect)
+	}
+
+	require.NoError(t, b.AddVirtualServer(&config.VirtualServer{Name: "b", Address: ":80", ServerName: "b.com", DefaultServer: true}))
+	err = b.AddVirtualServer(&config.VirtualServer{Name: "c", Address: ":80", ServerName: "c.com", DefaultServer: true})
+	assert.EqualError(t, err, "virtual server c conflicts with b on :80, default server is duplicated")
+	assert.Equal(t, 3, len(b.VServers))
+	assert.Equal(t, b.VServers[0].listener, b.VServers[2].listener)
+	assert.Nil(t, b.VServers[1].listener)
+}
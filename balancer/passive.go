@@ -0,0 +1,122 @@
+package balancer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/onestraw/golb/config"
+)
+
+// conditions of a failed request
+const (
+	FailOnError = "error"
+	FailOn4xx   = "4xx"
+	FailOn5xx   = "5xx"
+)
+
+// DefaultFailOn is the conditions of a failed request by default.
+var DefaultFailOn = []string{FailOnError, FailOn5xx}
+
+// failPolicy decides if a request fails.
+type failPolicy struct {
+	conditions []string
+	onError    bool
+	classes    map[int]bool
+	codes      map[int]bool
+}
+
+// parseFailOn parses the conditions, which is "error" (the peer is not
+// reachable), "4xx", "5xx" or a status code.
+func parseFailOn(conditions []string) (*failPolicy, error) {
+	if len(conditions) == 0 {
+		conditions = DefaultFailOn
+	}
+	p := &failPolicy{
+		conditions: conditions,
+		classes:    map[int]bool{},
+		codes:      map[int]bool{},
+	}
+	for _, c := range conditions {
+		switch strings.ToLower(c) {
+		case FailOnError:
+			p.onError = true
+		case FailOn4xx:
+			p.classes[4] = true
+		case FailOn5xx:
+			p.classes[5] = true
+		default:
+			code, err := strconv.Atoi(c)
+			if err != nil || code < 100 || code > 599 {
+				return nil, fmt.Errorf("fail on '%s' is not supported", c)
+			}
+			p.codes[code] = true
+		}
+	}
+	return p, nil
+}
+
+// match returns true if the request fails, err is the error of
+// forwarding the request.
+func (p *failPolicy) match(code int, err error) bool {
+	if err != nil {
+		return p.onError
+	}
+	return p.classes[code/100] || p.codes[code]
+}
+
+// PassiveHealthOpt returns a function to set max fails, fail timeout
+// and the conditions of a failed request.
+func PassiveHealthOpt(cfg *config.PassiveHealth) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		return vs.SetPassiveHealth(cfg)
+	}
+}
+
+// SetPassiveHealth updates the passive health settings, the zero values
+// mean the defaults.
+func (s *VirtualServer) SetPassiveHealth(cfg *config.PassiveHealth) error {
+	if cfg.MaxFails < 0 {
+		return fmt.Errorf("max fails %d is negative", cfg.MaxFails)
+	}
+	if cfg.FailTimeout < 0 {
+		return fmt.Errorf("fail timeout %d is negative", cfg.FailTimeout)
+	}
+	policy, err := parseFailOn(cfg.FailOn)
+	if err != nil {
+		return err
+	}
+	maxFails := cfg.MaxFails
+	if maxFails == 0 {
+		maxFails = DefaultMaxFails
+	}
+	failTimeout := int64(cfg.FailTimeout)
+	if failTimeout == 0 {
+		failTimeout = DefaultFailTimeout
+	}
+
+	s.poolLock.Lock()
+	defer s.poolLock.Unlock()
+	s.MaxFails = maxFails
+	s.FailTimeout = failTimeout
+	s.failOn = policy
+	return nil
+}
+
+// PassiveHealth returns the passive health settings.
+func (s *VirtualServer) PassiveHealth() *config.PassiveHealth {
+	s.poolLock.RLock()
+	defer s.poolLock.RUnlock()
+	return &config.PassiveHealth{
+		MaxFails:    s.MaxFails,
+		FailTimeout: int(s.FailTimeout),
+		FailOn:      s.failOn.conditions,
+	}
+}
+
+// isFailure returns true if the request to the peer fails.
+func (s *VirtualServer) isFailure(w *lbResponseWriter) bool {
+	s.poolLock.RLock()
+	defer s.poolLock.RUnlock()
+	return s.failOn.match(w.healthCode(), w.err)
+}
@@ -0,0 +1,133 @@
+package balancer
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestParseFailOn(t *testing.T) {
+	p, err := parseFailOn(nil)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultFailOn, p.conditions)
+	assert.True(t, p.match(0, errors.New("refused")))
+	assert.True(t, p.match(500, nil))
+	assert.False(t, p.match(404, nil))
+
+	p, err = parseFailOn([]string{"4xx", "503"})
+	require.NoError(t, err)
+	assert.False(t, p.match(502, errors.New("refused")))
+	assert.False(t, p.match(502, nil))
+	assert.True(t, p.match(503, nil))
+	assert.True(t, p.match(429, nil))
+
+	for _, c := range []string{"timeout", "600", "3xx"} {
+		_, err = parseFailOn([]string{c})
+		assert.EqualError(t, err, "fail on '"+c+"' is not supported")
+	}
+}
+
+func TestPassiveHealthOpt(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		PassiveHealthOpt(&config.PassiveHealth{MaxFails: -1}))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "max fails -1 is negative")
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		PassiveHealthOpt(&config.PassiveHealth{FailTimeout: -1}))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "fail timeout -1 is negative")
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		PassiveHealthOpt(&config.PassiveHealth{}))
+	require.NoError(t, err)
+	assert.Equal(t, &config.PassiveHealth{MaxFails: DefaultMaxFails, FailTimeout: DefaultFailTimeout,
+		FailOn: DefaultFailOn}, vs.PassiveHealth())
+}
+
+func TestFailOn(t *testing.T) {
+	code := http.StatusBadGateway
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+	defer backend.Close()
+	peer := backend.Listener.Addr().String()
+
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		PassiveHealthOpt(&config.PassiveHealth{MaxFails: 2, FailOn: []string{"error"}}),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1}, {Address: "127.0.0.1:1", Weight: 1}}))
+	require.NoError(t, err)
+	serve := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = DefaultServerName
+		w := httptest.NewRecorder()
+		vs.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// the 502 response of the peer is not an error
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, http.StatusBadGateway, serve())
+	}
+	assert.Equal(t, 0, vs.fails[peer])
+	assert.Equal(t, 2, vs.fails["127.0.0.1:1"])
+	assert.Equal(t, peer, vs.Pool.Get())
+
+	// the fails are counted until the peer recovers, not reset on success
+	require.NoError(t, vs.SetPassiveHealth(&config.PassiveHealth{MaxFails: 2, FailOn: []string{"502"}}))
+	assert.Equal(t, http.StatusBadGateway, serve())
+	assert.Equal(t, 1, vs.fails[peer])
+	code = http.StatusOK
+	assert.Equal(t, http.StatusOK, serve())
+	assert.Equal(t, 1, vs.fails[peer])
+}
+
+func TestFailWindow(t *testing.T) {
+	code := http.StatusOK
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+	defer backend.Close()
+	peer := backend.Listener.Addr().String()
+
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		PassiveHealthOpt(&config.PassiveHealth{MaxFails: 2, FailTimeout: 10}),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1}}))
+	require.NoError(t, err)
+	serve := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = DefaultServerName
+		w := httptest.NewRecorder()
+		vs.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// an occasional failure between the successes never marks the peer down
+	for i := 0; i < 5; i++ {
+		code = http.StatusInternalServerError
+		assert.Equal(t, code, serve())
+		code = http.StatusOK
+		for j := 0; j < 20; j++ {
+			assert.Equal(t, code, serve())
+		}
+		assert.Equal(t, 1, vs.fails[peer])
+		assert.Equal(t, peer, vs.Pool.Get())
+		// the window of the failure is over
+		vs.poolLock.Lock()
+		vs.timeout[peer] -= vs.FailTimeout
+		vs.poolLock.Unlock()
+	}
+
+	// the failures within the window mark the peer down
+	code = http.StatusInternalServerError
+	serve()
+	serve()
+	assert.Equal(t, 2, vs.fails[peer])
+	assert.Equal(t, "", vs.Pool.Get())
+}
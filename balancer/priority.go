@@ -0,0 +1,202 @@
+package balancer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type priorityGroup struct {
+	priority int
+	pool     Pooler
+}
+
+// priorityPool groups the peers by priority, a lower value means a higher
+// priority. The peers of a group are used only if every peer of the higher
+// priority groups is down, so traffic fails back once they recover.
+type priorityPool struct {
+	sync.RWMutex
+	create  func() Pooler
+	groups  []*priorityGroup
+	members map[string]*priorityGroup
+
+	slowStart time.Duration
+}
+
+func newPriorityPool(create func() Pooler) *priorityPool {
+	return &priorityPool{
+		create:  create,
+		groups:  []*priorityGroup{},
+		members: map[string]*priorityGroup{},
+	}
+}
+
+func (p *priorityPool) String() string {
+	p.RLock()
+	defer p.RUnlock()
+	if len(p.groups) == 1 && p.groups[0].priority == 0 {
+		return p.groups[0].pool.String()
+	}
+	result := []string{}
+	for _, g := range p.groups {
+		result = append(result, fmt.Sprintf("priority %d: %s", g.priority, g.pool))
+	}
+	return strings.Join(result, "; ")
+}
+
+// Size return the number of peers of all groups.
+func (p *priorityPool) Size() int {
+	p.RLock()
+	defer p.RUnlock()
+	return len(p.members)
+}
+
+// Get returns a peer from the highest priority group which has healthy peers.
+func (p *priorityPool) Get(args ...interface{}) string {
+	p.RLock()
+	defer p.RUnlock()
+	for _, g := range p.groups {
+		if peer := g.pool.Get(args...); peer != "" {
+			return peer
+		}
+	}
+	return ""
+}
+
+// GetExcluding is Get but skips the excluded peers, the groups whose pool
+// does not implement PeerExcluder are looked up by Get.
+func (p *priorityPool) GetExcluding(exclude map[string]bool, args ...interface{}) string {
+	p.RLock()
+	defer p.RUnlock()
+	for _, g := range p.groups {
+		var peer string
+		if excluder, ok := g.pool.(PeerExcluder); ok {
+			peer = excluder.GetExcluding(exclude, args...)
+		} else {
+			peer = g.pool.Get(args...)
+		}
+		if peer != "" {
+			return peer
+		}
+	}
+	return ""
+}
+
+// Add adds a peer, args[0] is the weight and args[1] is the priority.
+func (p *priorityPool) Add(addr string, args ...interface{}) {
+	if addr == "" {
+		return
+	}
+	priority := 0
+	if len(args) > 1 {
+		if v, ok := args[1].(int); ok {
+			priority = v
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if _, ok := p.members[addr]; ok {
+		return
+	}
+	var group *priorityGroup
+	for _, g := range p.groups {
+		if g.priority == priority {
+			group = g
+			break
+		}
+	}
+	if group == nil {
+		group = &priorityGroup{priority: priority, pool: p.create()}
+		if s, ok := group.pool.(SlowStarter); ok {
+			s.SetSlowStart(p.slowStart)
+		}
+		p.groups = append(p.groups, group)
+		sort.Slice(p.groups, func(i, j int) bool {
+			return p.groups[i].priority < p.groups[j].priority
+		})
+	}
+	group.pool.Add(addr, args...)
+	p.members[addr] = group
+}
+
+// Remove removes the peer and drops the group if it becomes empty.
+func (p *priorityPool) Remove(addr string) {
+	p.Lock()
+	defer p.Unlock()
+
+	group, ok := p.members[addr]
+	if !ok {
+		return
+	}
+	group.pool.Remove(addr)
+	delete(p.members, addr)
+	if group.pool.Size() > 0 {
+		return
+	}
+	for i, g := range p.groups {
+		if g == group {
+			p.groups = append(p.groups[:i], p.groups[i+1:]...)
+			break
+		}
+	}
+}
+
+func (p *priorityPool) poolOf(addr string) Pooler {
+	p.RLock()
+	defer p.RUnlock()
+	if g, ok := p.members[addr]; ok {
+		return g.pool
+	}
+	return nil
+}
+
+// DownPeer mark the peer down.
+func (p *priorityPool) DownPeer(addr string) {
+	if pool := p.poolOf(addr); pool != nil {
+		pool.DownPeer(addr)
+	}
+}
+
+// UpPeer mark the peer up.
+func (p *priorityPool) UpPeer(addr string) {
+	if pool := p.poolOf(addr); pool != nil {
+		pool.UpPeer(addr)
+	}
+}
+
+// Acquire implements ConnTracker if the LB method does.
+func (p *priorityPool) Acquire(addr string) {
+	if t, ok := p.poolOf(addr).(ConnTracker); ok {
+		t.Acquire(addr)
+	}
+}
+
+// Release implements ConnTracker if the LB method does.
+func (p *priorityPool) Release(addr string) {
+	if t, ok := p.poolOf(addr).(ConnTracker); ok {
+		t.Release(addr)
+	}
+}
+
+// Observe implements LatencyTracker if the LB method does.
+func (p *priorityPool) Observe(addr string, cost time.Duration) {
+	if t, ok := p.poolOf(addr).(LatencyTracker); ok {
+		t.Observe(addr, cost)
+	}
+}
+
+// SetSlowStart implements SlowStarter if the LB method does.
+func (p *priorityPool) SetSlowStart(d time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.slowStart = d
+	for _, g := range p.groups {
+		if s, ok := g.pool.(SlowStarter); ok {
+			s.SetSlowStart(d)
+		}
+	}
+}
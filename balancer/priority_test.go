@@ -0,0 +1,120 @@
+package balancer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/roundrobin"
+)
+
+func TestPriorityPool(t *testing.T) {
+	pool := newPriorityPool(func() Pooler { return roundrobin.CreatePool(nil) })
+	pool.Add("a", 1)
+	pool.Add("b", 1, 0)
+	pool.Add("c", 1, 1)
+	pool.Add("d", 1, 2)
+	pool.Add("d", 1, 0)
+	pool.Add("", 1)
+	assert.Equal(t, 4, pool.Size())
+	assert.Equal(t, "priority 0: a, b; priority 1: c; priority 2: d", pool.String())
+
+	assert.Equal(t, "a", pool.Get())
+	assert.Equal(t, "b", pool.Get())
+
+	// fail over to the next group
+	pool.DownPeer("a")
+	pool.DownPeer("b")
+	assert.Equal(t, "c", pool.Get())
+	pool.DownPeer("c")
+	assert.Equal(t, "d", pool.Get())
+
+	// fail back once the primary recovers
+	pool.UpPeer("b")
+	assert.Equal(t, "b", pool.Get())
+	assert.Equal(t, "b", pool.Get())
+
+	pool.DownPeer("b")
+	pool.DownPeer("d")
+	assert.Equal(t, "", pool.Get())
+
+	pool.Remove("c")
+	pool.Remove("d")
+	pool.Remove("d")
+	assert.Equal(t, 2, pool.Size())
+	assert.Equal(t, "a, b", pool.String())
+
+	// no effect on unknown peer
+	pool.UpPeer("x")
+	pool.Acquire("x")
+	pool.Release("x")
+	pool.Observe("x", 0)
+}
+
+func TestPoolOptPriority(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"), LBMethodOpt(LBLeastConn),
+		PoolOpt([]config.Server{
+			{Address: "127.0.0.1:10001"},
+			{Address: "127.0.0.1:10002", Backup: true},
+			{Address: "127.0.0.1:10003", Priority: 2},
+		}))
+	require.NoError(t, err)
+	assert.Equal(t, 3, vs.Pool.Size())
+	assert.Equal(t, "priority 0: 127.0.0.1:10001; priority 1: 127.0.0.1:10002; priority 2: 127.0.0.1:10003", vs.Pool.String())
+
+	vs.Pool.DownPeer("127.0.0.1:10001")
+	assert.Equal(t, "127.0.0.1:10002", vs.Pool.Get())
+
+	vs.AddPeer("127.0.0.1:10004", 1, 1)
+	vs.Pool.(ConnTracker).Acquire("127.0.0.1:10002")
+	assert.Equal(t, "127.0.0.1:10004", vs.Pool.Get())
+
+	vs.Pool.UpPeer("127.0.0.1:10001")
+	assert.Equal(t, "127.0.0.1:10001", vs.Pool.Get())
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		PoolOpt([]config.Server{{Address: "127.0.0.1:10001", Priority: -1}}))
+	assert.Nil(t, vs)
+	assert.Equal(t, config.ErrPoolMemberPriority, err)
+}
+
+func TestPoolOptSlowStart(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"), SlowStartOpt(60),
+		PoolOpt([]config.Server{{Address: "a", Weight: 1}, {Address: "b", Weight: 1}}))
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, vs.SlowStart)
+
+	count := func(n int) map[string]int {
+		result := map[string]int{}
+		for i := 0; i < n; i++ {
+			result[vs.Pool.Get()]++
+		}
+		return result
+	}
+	// the initial peers take full traffic at once
+	assert.Equal(t, map[string]int{"a": 100, "b": 100}, count(200))
+
+	// the new peers in both existing and new group ramp up
+	vs.AddPeer("c", 1)
+	vs.AddPeer("d", 1, 1)
+	result := count(201)
+	assert.Equal(t, 1, result["c"])
+
+	// the recovered peer ramps up
+	vs.Pool.DownPeer("a")
+	vs.Pool.UpPeer("a")
+	result = count(102)
+	assert.Equal(t, map[string]int{"a": 1, "b": 100, "c": 1}, result)
+
+	vs.Pool.DownPeer("a")
+	vs.Pool.DownPeer("b")
+	vs.Pool.DownPeer("c")
+	assert.Equal(t, "d", vs.Pool.Get())
+
+	vs, err = NewVirtualServer(SlowStartOpt(-1))
+	assert.Nil(t, vs)
+	assert.Contains(t, err.Error(), "negative")
+}
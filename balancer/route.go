@@ -0,0 +1,357 @@
+package balancer
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/stats"
+)
+
+// namedPool is a pool of the virtual server which the routes refer to by
+// name, the peers share the health, the stats and the reverse proxy with
+// the other pools of the virtual server by address. The named pools are
+// fixed once the virtual server is built, but not their members.
+type namedPool struct {
+	sync.RWMutex
+	cfg  config.Pool
+	pool *priorityPool
+}
+
+// PoolsOpt returns a function to set the named pools of the routes. It
+// should be called after PoolOpt and before RoutesOpt.
+func PoolsOpt(pools []config.Pool) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if len(pools) == 0 {
+			return nil
+		}
+		if vs.Protocol == ProtoTCP || vs.Protocol == ProtoUDP {
+			return fmt.Errorf("named pools are not supported by %s", vs.Protocol)
+		}
+		for _, cfg := range pools {
+			if cfg.Name == "" {
+				return ErrPoolNameEmpty
+			}
+			if vs.findPool(cfg.Name) != nil {
+				return fmt.Errorf("pool %s existed", cfg.Name)
+			}
+			method := cfg.LBMethod
+			if method == "" {
+				method = vs.LBMethod
+			}
+			switch method {
+			case LBRoundRobin, LBConsistentHash, LBLeastConn, LBP2CEWMA, LBMaglev, LBRendezvous:
+			default:
+				return ErrNotSupportedMethod
+			}
+			cfg.LBMethod = method
+			cfg.Members = append([]config.Server{}, cfg.Members...)
+			pool := newPriorityPool(func() Pooler { return vs.newMethodPooler(method) })
+			for _, peer := range cfg.Members {
+				if err := vs.CheckPeer(peer); err != nil {
+					return err
+				}
+				weight := peer.Weight
+				if weight <= 0 {
+					weight = 1
+				}
+				pool.Add(peer.Address, weight, peer.PriorityLevel())
+				vs.trackPeer(peer.Address)
+			}
+			pool.SetSlowStart(vs.SlowStart)
+			vs.namedPools = append(vs.namedPools, &namedPool{cfg: cfg, pool: pool})
+		}
+		return nil
+	}
+}
+
+// findPool returns the named pool, nil if not found.
+func (s *VirtualServer) findPool(name string) *namedPool {
+	for _, np := range s.namedPools {
+		if np.cfg.Name == name {
+			return np
+		}
+	}
+	return nil
+}
+
+// Pools returns the config of the named pools.
+func (s *VirtualServer) Pools() []config.Pool {
+	pools := []config.Pool{}
+	for _, np := range s.namedPools {
+		np.RLock()
+		cfg := np.cfg
+		cfg.Members = append([]config.Server{}, np.cfg.Members...)
+		np.RUnlock()
+		pools = append(pools, cfg)
+	}
+	return pools
+}
+
+// AddPoolPeer adds the peer to the named pool, the peer shares the state
+// with the same address in the other pools.
+func (s *VirtualServer) AddPoolPeer(name string, peer config.Server) error {
+	np := s.findPool(name)
+	if np == nil {
+		return fmt.Errorf("pool %s not found", name)
+	}
+	if err := s.CheckPeer(peer); err != nil {
+		return err
+	}
+	weight := peer.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+
+	np.Lock()
+	for _, m := range np.cfg.Members {
+		if m.Address == peer.Address {
+			np.Unlock()
+			return fmt.Errorf("pool %s member %s existed", name, peer.Address)
+		}
+	}
+	np.cfg.Members = append(np.cfg.Members, peer)
+	np.Unlock()
+
+	s.trackPeer(peer.Address)
+	s.poolLock.Lock()
+	np.pool.Add(peer.Address, weight, peer.PriorityLevel())
+	if len(s.downBy[peer.Address]) > 0 {
+		np.pool.DownPeer(peer.Address)
+	}
+	s.poolLock.Unlock()
+	return nil
+}
+
+// RemovePoolPeer removes the peer from the named pool, and the related
+// unless another pool has the peer.
+func (s *VirtualServer) RemovePoolPeer(name, addr string) error {
+	np := s.findPool(name)
+	if np == nil {
+		return fmt.Errorf("pool %s not found", name)
+	}
+
+	np.Lock()
+	i := 0
+	for ; i < len(np.cfg.Members); i++ {
+		if np.cfg.Members[i].Address == addr {
+			break
+		}
+	}
+	if i == len(np.cfg.Members) {
+		np.Unlock()
+		return fmt.Errorf("pool %s member %s not found", name, addr)
+	}
+	np.cfg.Members = append(np.cfg.Members[:i:i], np.cfg.Members[i+1:]...)
+	np.Unlock()
+
+	np.pool.Remove(addr)
+	if !s.pooled(addr) {
+		s.forgetPeer(addr)
+	}
+	return nil
+}
+
+// route balances the matched requests over the named pool, or the pool of
+// the virtual server if none.
+type route struct {
+	cfg     config.Route
+	regex   *regexp.Regexp
+	methods map[string]bool
+	pool    Pooler
+	stats   *stats.Stats
+	// applied after the header rules of the virtual server
+	headerRules *headerRules
+}
+
+// newRoute checks the route and looks up its named pool.
+func (s *VirtualServer) newRoute(cfg config.Route) (*route, error) {
+	if cfg.Name == "" {
+		return nil, ErrRouteNameEmpty
+	}
+	matchers := 0
+	for _, m := range []string{cfg.Prefix, cfg.Exact, cfg.Regex} {
+		if m != "" {
+			matchers++
+		}
+	}
+	if matchers > 1 {
+		return nil, fmt.Errorf("route %s has more than one of prefix, exact and regex", cfg.Name)
+	}
+	rt := &route{cfg: cfg, methods: map[string]bool{}, stats: stats.New()}
+	if cfg.Regex != "" {
+		re, err := regexp.Compile(cfg.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("route %s regex '%s' is invalid", cfg.Name, cfg.Regex)
+		}
+		rt.regex = re
+	}
+	for _, m := range cfg.Methods {
+		rt.methods[strings.ToUpper(m)] = true
+	}
+	rules, err := parseHeaderRules(cfg.HeaderRules)
+	if err != nil {
+		return nil, fmt.Errorf("route %s %v", cfg.Name, err)
+	}
+	rt.headerRules = rules
+
+	rt.pool = s.Pool
+	if cfg.Pool != "" {
+		np := s.findPool(cfg.Pool)
+		if np == nil {
+			return nil, fmt.Errorf("route %s pool '%s' is not found", cfg.Name, cfg.Pool)
+		}
+		rt.pool = np.pool
+	}
+	return rt, nil
+}
+
+// match returns true if the request matches the path, one of the methods
+// and all of the headers.
+func (rt *route) match(r *http.Request) bool {
+	path := r.URL.Path
+	switch {
+	case rt.cfg.Exact != "" && path != rt.cfg.Exact:
+		return false
+	case rt.cfg.Prefix != "" && !strings.HasPrefix(path, rt.cfg.Prefix):
+		return false
+	case rt.regex != nil && !rt.regex.MatchString(path):
+		return false
+	}
+	if len(rt.methods) > 0 && !rt.methods[r.Method] {
+		return false
+	}
+	for name, value := range rt.cfg.Headers {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// RoutesOpt returns a function to set the ordered routes, the requests
+// matching none of them go to the pool of the virtual server. It should be
+// called after PoolOpt and PoolsOpt.
+func RoutesOpt(routes []config.Route) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if len(routes) == 0 {
+			return nil
+		}
+		if vs.Protocol == ProtoTCP || vs.Protocol == ProtoUDP {
+			return fmt.Errorf("routes are not supported by %s", vs.Protocol)
+		}
+		for _, cfg := range routes {
+			if err := vs.AddRoute(cfg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// findRoute returns the index of the route, -1 if not found. It must be
+// called with routeLock.
+func (s *VirtualServer) findRoute(name string) int {
+	for i, rt := range s.routes {
+		if rt.cfg.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// matchRoute returns the first route matching the request, nil if none.
+func (s *VirtualServer) matchRoute(r *http.Request) *route {
+	s.routeLock.RLock()
+	defer s.routeLock.RUnlock()
+	for _, rt := range s.routes {
+		if rt.match(r) {
+			return rt
+		}
+	}
+	return nil
+}
+
+// Routes returns the config of the routes in order.
+func (s *VirtualServer) Routes() []config.Route {
+	s.routeLock.RLock()
+	defer s.routeLock.RUnlock()
+	routes := []config.Route{}
+	for _, rt := range s.routes {
+		routes = append(routes, rt.cfg)
+	}
+	return routes
+}
+
+// AddRoute appends the route.
+func (s *VirtualServer) AddRoute(cfg config.Route) error {
+	rt, err := s.newRoute(cfg)
+	if err != nil {
+		return err
+	}
+	s.routeLock.Lock()
+	if s.findRoute(cfg.Name) >= 0 {
+		s.routeLock.Unlock()
+		return fmt.Errorf("route %s existed", cfg.Name)
+	}
+	s.routes = append(s.routes, rt)
+	s.routeLock.Unlock()
+	return nil
+}
+
+// UpdateRoute replaces the route of the same name in place.
+func (s *VirtualServer) UpdateRoute(cfg config.Route) error {
+	rt, err := s.newRoute(cfg)
+	if err != nil {
+		return err
+	}
+	s.routeLock.Lock()
+	i := s.findRoute(cfg.Name)
+	if i < 0 {
+		s.routeLock.Unlock()
+		return fmt.Errorf("route %s not found", cfg.Name)
+	}
+	// the counters go on with the new matchers
+	rt.stats = s.routes[i].stats
+	s.routes[i] = rt
+	s.routeLock.Unlock()
+	return nil
+}
+
+// RemoveRoute removes the route.
+func (s *VirtualServer) RemoveRoute(name string) error {
+	s.routeLock.Lock()
+	i := s.findRoute(name)
+	if i < 0 {
+		s.routeLock.Unlock()
+		return fmt.Errorf("route %s not found", name)
+	}
+	s.routes = append(s.routes[:i], s.routes[i+1:]...)
+	s.routeLock.Unlock()
+	return nil
+}
+
+// pools returns the pool of the virtual server and the named pools.
+func (s *VirtualServer) pools() []Pooler {
+	pools := []Pooler{}
+	if s.Pool != nil {
+		pools = append(pools, s.Pool)
+	}
+	for _, np := range s.namedPools {
+		pools = append(pools, np.pool)
+	}
+	return pools
+}
+
+// pooled returns true if any pool has the peer.
+func (s *VirtualServer) pooled(addr string) bool {
+	for _, pool := range s.pools() {
+		if p, ok := pool.(*priorityPool); ok && p.poolOf(addr) != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func serveRoute(vs *VirtualServer, method, path string, header map[string]string) (int, string) {
+	req := httptest.NewRequest(method, path, nil)
+	req.Host = DefaultServerName
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rr := httptest.NewRecorder()
+	vs.ServeHTTP(rr, req)
+	return rr.Code, rr.Body.String()
+}
+
+func TestRoutes(t *testing.T) {
+	s1 := httptest.NewServer(newHandler("s1"))
+	defer s1.Close()
+	s2 := httptest.NewServer(newHandler("s2"))
+	defer s2.Close()
+	s3 := httptest.NewServer(newHandler("s3"))
+	defer s3.Close()
+	peer1, peer2, peer3 := s1.URL[7:], s2.URL[7:], s3.URL[7:]
+
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		PoolOpt([]config.Server{{Address: peer1, Weight: 1}}),
+		PoolsOpt([]config.Pool{
+			{Name: "s2", LBMethod: LBLeastConn, Members: []config.Server{{Address: peer2}}},
+			{Name: "s3", Members: []config.Server{{Address: peer3}}},
+			{Name: "image", Members: []config.Server{{Address: peer1}, {Address: peer3, Backup: true}}},
+		}),
+		RoutesOpt([]config.Route{
+			{Name: "login", Exact: "/login", Pool: "s3"},
+			{Name: "v2", Prefix: "/api/", Headers: map[string]string{"X-Version": "2"}, Pool: "s3"},
+			{Name: "api", Prefix: "/api/", Methods: []string{"get"}, Pool: "s2"},
+			{Name: "image", Regex: `\.png$`, Pool: "image"},
+		}),
+	)
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		method, path string
+		header       map[string]string
+		expect       string
+	}{
+		{"GET", "/login", nil, "s3"},
+		{"GET", "/login/x", nil, "s1"},
+		{"GET", "/api/users", nil, "s2"},
+		{"POST", "/api/users", nil, "s1"},
+		{"POST", "/api/users", map[string]string{"X-Version": "2"}, "s3"},
+		{"GET", "/logo.png", nil, "s1"},
+		{"GET", "/", nil, "s1"},
+	} {
+		code, body := serveRoute(vs, c.method, c.path, c.header)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, c.expect, body, c.method+" "+c.path)
+	}
+	routes := vs.Routes()
+	require.Equal(t, 4, len(routes))
+	assert.Equal(t, "s2", routes[2].Pool)
+	pools := vs.Pools()
+	require.Equal(t, 3, len(pools))
+	assert.Equal(t, LBLeastConn, pools[0].LBMethod)
+	assert.Equal(t, LBRoundRobin, pools[1].LBMethod)
+	assert.Contains(t, vs.Stats(), "Route-api\n")
+	assert.Contains(t, vs.Stats(), "Route-login\n")
+
+	// the down peer is down in every pool
+	vs.poolLock.Lock()
+	vs.setPeerDown(peer1, DownByPassive, true)
+	vs.poolLock.Unlock()
+	_, body := serveRoute(vs, "GET", "/logo.png", nil)
+	assert.Equal(t, "s3", body)
+	code, _ := serveRoute(vs, "GET", "/", nil)
+	assert.Equal(t, http.StatusBadGateway, code)
+	require.NoError(t, vs.AddRoute(config.Route{Name: "doc", Prefix: "/doc/"}))
+	code, _ = serveRoute(vs, "GET", "/doc/", nil)
+	assert.Equal(t, http.StatusBadGateway, code)
+
+	// the state is kept while a named pool has the peer
+	vs.RemovePeer(peer1)
+	require.NoError(t, vs.RemoveRoute("doc"))
+	assert.True(t, vs.downBy[peer1][DownByPassive])
+	routeStats := vs.routes[3].stats
+	require.NoError(t, vs.UpdateRoute(config.Route{Name: "image", Regex: `\.png$`, Pool: "s3"}))
+	_, body = serveRoute(vs, "GET", "/logo.png", nil)
+	assert.Equal(t, "s3", body)
+	assert.Equal(t, "image", vs.Routes()[3].Name)
+	// the stats of the route are kept
+	assert.True(t, routeStats == vs.routes[3].stats)
+
+	// the down peer joins a named pool as down
+	require.NoError(t, vs.AddPoolPeer("s2", config.Server{Address: peer1}))
+	assert.EqualError(t, vs.AddPoolPeer("s2", config.Server{Address: peer1}), "pool s2 member "+peer1+" existed")
+	assert.EqualError(t, vs.AddPoolPeer("s2", config.Server{Address: "a", Priority: -1}), config.ErrPoolMemberPriority.Error())
+	assert.EqualError(t, vs.AddPoolPeer("web", config.Server{Address: "a"}), "pool web not found")
+	assert.Equal(t, 2, len(vs.Pools()[0].Members))
+	for i := 0; i < 4; i++ {
+		_, body = serveRoute(vs, "GET", "/api/users", nil)
+		assert.Equal(t, "s2", body)
+	}
+	require.NoError(t, vs.RemovePoolPeer("image", peer1))
+	assert.True(t, vs.downBy[peer1][DownByPassive])
+	require.NoError(t, vs.RemovePoolPeer("s2", peer1))
+	assert.Nil(t, vs.downBy[peer1])
+	assert.EqualError(t, vs.RemovePoolPeer("s2", peer1), "pool s2 member "+peer1+" not found")
+	assert.Equal(t, 1, len(vs.Pools()[0].Members))
+}
+
+func TestRoutesOpt(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"), PoolOpt(nil))
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		route  config.Route
+		expect string
+	}{
+		{config.Route{Prefix: "/"}, "route name is not specified"},
+		{config.Route{Name: "a", Prefix: "/", Exact: "/"}, "route a has more than one of prefix, exact and regex"},
+		{config.Route{Name: "a", Regex: "(a"}, "route a regex '(a' is invalid"},
+		{config.Route{Name: "a", Pool: "api"}, "route a pool 'api' is not found"},
+	} {
+		assert.EqualError(t, vs.AddRoute(c.route), c.expect)
+	}
+	require.NoError(t, vs.AddRoute(config.Route{Name: "a"}))
+	assert.EqualError(t, vs.AddRoute(config.Route{Name: "a"}), "route a existed")
+	assert.EqualError(t, vs.UpdateRoute(config.Route{Name: "b"}), "route b not found")
+	assert.EqualError(t, vs.RemoveRoute("b"), "route b not found")
+
+	vs, err = NewVirtualServer(NameOpt("redis"), AddressOpt(":6379"), ProtocolOpt(ProtoTCP),
+		RoutesOpt([]config.Route{{Name: "a"}}))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "routes are not supported by tcp")
+}
+
+func TestPoolsOpt(t *testing.T) {
+	for _, c := range []struct {
+		pools  []config.Pool
+		expect string
+	}{
+		{[]config.Pool{{}}, ErrPoolNameEmpty.Error()},
+		{[]config.Pool{{Name: "a"}, {Name: "a"}}, "pool a existed"},
+		{[]config.Pool{{Name: "a", LBMethod: "random"}}, ErrNotSupportedMethod.Error()},
+		{[]config.Pool{{Name: "a", Members: []config.Server{{Address: "a", Priority: -1}}}}, config.ErrPoolMemberPriority.Error()},
+	} {
+		vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"), PoolsOpt(c.pools))
+		assert.Nil(t, vs)
+		assert.EqualError(t, err, c.expect)
+	}
+
+	vs, err := NewVirtualServer(NameOpt("redis"), AddressOpt(":6379"), ProtocolOpt(ProtoTCP),
+		PoolsOpt([]config.Pool{{Name: "a"}}))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "named pools are not supported by tcp")
+}
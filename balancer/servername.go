@@ -0,0 +1,57 @@
+package balancer
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+// serverNames are the matchers parsed from the ServerName source, see
+// config.ServerNames for the names.
+type serverNames struct {
+	*config.ServerNames
+	source string
+}
+
+// setServerNames parses the names and stores the matchers.
+func (s *VirtualServer) setServerNames(names string) error {
+	parsed, err := config.ParseServerNames(names)
+	if err != nil {
+		return err
+	}
+	s.ServerName = names
+	s.serverNames.Store(&serverNames{ServerNames: parsed, source: names})
+	return nil
+}
+
+// DefaultServerOpt returns a function to serve the requests whose host
+// matches no server name, instead of responding 400 Host Not Match.
+func DefaultServerOpt(enable bool) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		vs.DefaultServer = enable
+		return nil
+	}
+}
+
+// names returns the matchers of ServerName, which are parsed once it is
+// set, or once the field is changed directly. An invalid ServerName matches
+// no host.
+func (s *VirtualServer) names() *serverNames {
+	if n, ok := s.serverNames.Load().(*serverNames); ok && n.source == s.ServerName {
+		return n
+	}
+	source := s.ServerName
+	parsed, err := config.ParseServerNames(source)
+	if err != nil {
+		log.Errorf("Virtual server %s: %v", s.Name, err)
+		parsed = &config.ServerNames{}
+	}
+	n := &serverNames{ServerNames: parsed, source: source}
+	s.serverNames.Store(n)
+	return n
+}
+
+// hostMatched returns true if the virtual server serves the host.
+func (s *VirtualServer) hostMatched(host string) bool {
+	return s.DefaultServer || s.names().Match(host)
+}
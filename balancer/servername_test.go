@@ -0,0 +1,48 @@
+package balancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestDefaultServer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	peer := backend.Listener.Addr().String()
+
+	serve := func(vs *VirtualServer, host string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		rr := httptest.NewRecorder()
+		vs.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"), ServerNameOpt("*.example.com"),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1}}))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, serve(vs, "www.example.com:80"))
+	assert.Equal(t, http.StatusBadRequest, serve(vs, "example.org"))
+	// the server name set directly takes effect as well
+	vs.ServerName = "example.org www.example.*"
+	assert.Equal(t, http.StatusOK, serve(vs, "example.org"))
+	assert.Equal(t, http.StatusOK, serve(vs, "www.example.net"))
+	assert.Equal(t, http.StatusBadRequest, serve(vs, "api.example.com"))
+	vs.ServerName = "www.*.com"
+	assert.Equal(t, http.StatusBadRequest, serve(vs, "www.example.com"))
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), ServerNameOpt("*.example.com"), DefaultServerOpt(true),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1}}))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, serve(vs, "example.org"))
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), ServerNameOpt("www.*.com"))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "server name 'www.*.com' is invalid")
+}
@@ -0,0 +1,203 @@
+package balancer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/stats"
+)
+
+// DefaultDialTimeout is the timeout of connecting a peer of tcp virtual server.
+const DefaultDialTimeout = 5 * time.Second
+
+// errServerClosed is returned after the tcp listener is closed by Stop.
+var errServerClosed = errors.New("tcp: Server closed")
+
+// tcpServer holds the listener and the active connections of a tcp
+// virtual server.
+type tcpServer struct {
+	sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+func (t *tcpServer) track(conn net.Conn, add bool) bool {
+	t.Lock()
+	defer t.Unlock()
+	if add {
+		if t.closed {
+			return false
+		}
+		t.conns[conn] = struct{}{}
+	} else {
+		delete(t.conns, conn)
+	}
+	return true
+}
+
+// close closes the listener and all the active connections.
+func (t *tcpServer) close() error {
+	t.Lock()
+	defer t.Unlock()
+	t.closed = true
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.conns = map[net.Conn]struct{}{}
+	if t.listener == nil {
+		return nil
+	}
+	return t.listener.Close()
+}
+
+// listenTCP opens the listener, which is closed by stopTCP.
+func (s *VirtualServer) listenTCP() error {
+	ln, err := net.Listen("tcp", s.Address)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.tcp = &tcpServer{listener: ln, conns: map[net.Conn]struct{}{}}
+	s.Unlock()
+	return nil
+}
+
+// serveTCP accepts the connections of the listener opened by listenTCP.
+func (s *VirtualServer) serveTCP() error {
+	s.RLock()
+	t := s.tcp
+	s.RUnlock()
+	ln := t.listener
+
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Lock()
+			closed := t.closed
+			t.Unlock()
+			if closed {
+				return errServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// back off like http.Server
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > time.Second {
+					delay = time.Second
+				}
+				log.Errorf("%s Accept error=%v, retrying in %v", s.Name, err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		if !t.track(conn, true) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer t.track(conn, false)
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *VirtualServer) stopTCP() error {
+	s.RLock()
+	t := s.tcp
+	s.RUnlock()
+	if t == nil {
+		return nil
+	}
+	return t.close()
+}
+
+// handleConn forwards a client connection to a peer.
+func (s *VirtualServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+	timeBegin := time.Now()
+	peer := ""
+	var in, out int64
+	defer func() {
+		s.statsIncConn(peer, in, out)
+		cost := time.Since(timeBegin) / time.Millisecond
+		log.Infof("%s - tcp (%s) %dms- in %d out %d", conn.RemoteAddr(), peer, cost, in, out)
+	}()
+
+	s.recovery()
+
+	peer = s.getPeer(s.hashKey.connValue(conn.RemoteAddr().String()))
+	if peer == "" {
+		log.Errorf("Get peer err=%v", ErrPeerNotFound.ErrMsg)
+		return
+	}
+
+	upstream, err := net.DialTimeout("tcp", peer, DefaultDialTimeout)
+	s.reportPeer(peer, s.isConnFailure(err))
+	if s.outlier != nil {
+		// a connect failure is a gateway failure
+		code := http.StatusOK
+		if err != nil {
+			code = http.StatusBadGateway
+		}
+		s.outlier.Report(peer, code)
+	}
+	if err != nil {
+		log.Errorf("Connect peer %s err=%v", peer, err)
+		return
+	}
+	defer upstream.Close()
+
+	if t, ok := s.Pool.(ConnTracker); ok {
+		t.Acquire(peer)
+		defer t.Release(peer)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go splice(upstream, conn, &in, &wg)
+	go splice(conn, upstream, &out, &wg)
+	wg.Wait()
+}
+
+// splice copies from src to dst until EOF, and then half closes dst so that
+// the other direction goes on.
+func splice(dst, src net.Conn, n *int64, wg *sync.WaitGroup) {
+	defer wg.Done()
+	written, err := io.Copy(dst, src)
+	atomic.AddInt64(n, written)
+	if tc, ok := dst.(*net.TCPConn); ok && err == nil {
+		tc.CloseWrite()
+		return
+	}
+	dst.Close()
+	src.Close()
+}
+
+// isConnFailure returns true if the connect error counts as a failure.
+func (s *VirtualServer) isConnFailure(err error) bool {
+	s.poolLock.RLock()
+	defer s.poolLock.RUnlock()
+	return err != nil && s.failOn.match(0, err)
+}
+
+// statsIncConn adds a connection info.
+func (s *VirtualServer) statsIncConn(addr string, in, out int64) {
+	s.serverStats(addr).Inc(&stats.Data{
+		InBytes:  uint64(in),
+		OutBytes: uint64(out),
+	})
+}
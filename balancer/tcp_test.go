@@ -0,0 +1,119 @@
+package balancer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestTCPVirtualServer(t *testing.T) {
+	ln := echoServer(t)
+	defer ln.Close()
+	peer := ln.Addr().String()
+
+	addr := "127.0.0.1:8086"
+	vs, err := NewVirtualServer(
+		NameOpt("redis"),
+		AddressOpt(addr),
+		ProtocolOpt(ProtoTCP),
+		LBMethodOpt(LBConsistentHash),
+		PassiveHealthOpt(&config.PassiveHealth{MaxFails: 1}),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1}}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, vs.Run())
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("PING\r\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "PING\r\n", line)
+	conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.Contains(t, vs.Stats(), peer+"\nrecv_bytes: 6\nsend_bytes: 6\n")
+
+	// the connect failure marks the peer down
+	vs.AddPeer("127.0.0.1:1", 100)
+	vs.RemovePeer(peer)
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, map[string]bool{DownByPassive: true}, vs.downBy["127.0.0.1:1"])
+
+	require.NoError(t, vs.Stop())
+	assert.Equal(t, StatusDisabled, vs.Status())
+	_, err = net.Dial("tcp", addr)
+	assert.Error(t, err)
+
+	// the listener is closed even if Stop follows Run at once
+	require.NoError(t, vs.Run())
+	require.NoError(t, vs.Stop())
+	time.Sleep(100 * time.Millisecond)
+	ln2, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	assert.Error(t, vs.Run())
+	assert.Equal(t, StatusDisabled, vs.Status())
+	ln2.Close()
+}
+
+func TestTCPHashKey(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("redis"), AddressOpt(":6379"), ProtocolOpt(ProtoTCP),
+		HashKeyOpt("header:X-User-ID"))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "hash key 'header:X-User-ID' is not supported by tcp")
+
+	vs, err = NewVirtualServer(NameOpt("redis"), AddressOpt(":6379"), ProtocolOpt(ProtoTCP),
+		HashKeyOpt("remote_addr"))
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:1234", vs.hashKey.connValue("10.0.0.1:1234"))
+
+	vs, err = NewVirtualServer(NameOpt("redis"), AddressOpt(":6379"), ProtocolOpt(ProtoTCP))
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", vs.hashKey.connValue("10.0.0.1:1234"))
+	assert.Equal(t, LBConsistentHash, vs.LBMethod)
+
+	vs, err = NewVirtualServer(NameOpt("redis"), AddressOpt(":6379"), ProtocolOpt(ProtoTCP), LBMethodOpt(""),
+		PoolOpt([]config.Server{{Address: "10.0.0.2:6379", Weight: 1}, {Address: "10.0.0.3:6379", Weight: 1}}))
+	require.NoError(t, err)
+	assert.Equal(t, LBConsistentHash, vs.LBMethod)
+	// the connections of a client go to the same peer
+	peer := vs.getPeer(vs.hashKey.connValue("10.0.0.1:1234"))
+	for port := 1235; port < 1245; port++ {
+		assert.Equal(t, peer, vs.getPeer(vs.hashKey.connValue(fmt.Sprintf("10.0.0.1:%d", port))))
+	}
+
+	vs, err = NewVirtualServer(NameOpt("redis"), AddressOpt(":6379"), ProtocolOpt(ProtoTCP),
+		PoolOpt([]config.Server{{Address: "tcp://10.0.0.2:6379", Weight: 1}}))
+	assert.Nil(t, vs)
+	assert.Equal(t, config.ErrPoolMemberScheme, err)
+}
@@ -0,0 +1,84 @@
+package balancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/onestraw/golb/config"
+)
+
+// UpstreamTLSOpt returns a function to speak TLS to the peers, a client
+// certificate is presented for mutual TLS if cert_file and key_file are set.
+func UpstreamTLSOpt(cfg *config.UpstreamTLS) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if cfg == nil || !cfg.Enable {
+			return nil
+		}
+		tlsConfig := &tls.Config{
+			ServerName:         cfg.ServerName,
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+		}
+		if cfg.CAFile != "" {
+			pem, err := ioutil.ReadFile(cfg.CAFile)
+			if err != nil {
+				return fmt.Errorf("ca file '%s' does not exist", cfg.CAFile)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("ca file '%s' has no certificate", cfg.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		if cfg.CertFile != "" || cfg.KeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+			if err != nil {
+				return fmt.Errorf("load client certificate error=%v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		vs.upstreamTLS = tlsConfig
+		return nil
+	}
+}
+
+// checkUpstreamTLS checks the upstream TLS against the protocols.
+func (s *VirtualServer) checkUpstreamTLS() error {
+	if s.upstreamTLS == nil {
+		return nil
+	}
+	switch s.Protocol {
+	case ProtoTCP, ProtoUDP:
+		return fmt.Errorf("upstream tls is not supported by %s", s.Protocol)
+	}
+	if s.UpstreamProtocol == UpstreamH2C {
+		return fmt.Errorf("upstream tls is not supported by %s", s.UpstreamProtocol)
+	}
+	return nil
+}
+
+// peerURL returns the url of the peer, the scheme of the peer address,
+// e.g. "https://10.0.0.1:443", takes precedence.
+func (s *VirtualServer) peerURL(peer string) string {
+	if strings.HasPrefix(peer, "http://") || strings.HasPrefix(peer, "https://") {
+		return peer
+	}
+	if s.upstreamTLS != nil || s.UpstreamProtocol == UpstreamH2 {
+		return "https://" + peer
+	}
+	return "http://" + peer
+}
+
+// newHTTP1Transport returns a transport speaking HTTP/1.1 over TLS with
+// the config, nil means http.DefaultTransport.
+func newHTTP1Transport(tlsConfig *tls.Config) http.RoundTripper {
+	if tlsConfig == nil {
+		return nil
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	return t
+}
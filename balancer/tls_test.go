@@ -0,0 +1,175 @@
+package balancer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+// writeCert generates a self-signed certificate of the hosts, and returns
+// the file names of the certificate and the key.
+func writeCert(t *testing.T, dir, name string, hosts ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              hosts,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+".key")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func tlsBackend(t *testing.T, clientCA string) *httptest.Server {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.ServerName))
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Write([]byte(" " + r.TLS.PeerCertificates[0].Subject.CommonName))
+		}
+	}))
+	backend.TLS = &tls.Config{}
+	if clientCA != "" {
+		data, err := ioutil.ReadFile(clientCA)
+		require.NoError(t, err)
+		pool := x509.NewCertPool()
+		require.True(t, pool.AppendCertsFromPEM(data))
+		backend.TLS.ClientCAs = pool
+		backend.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	backend.StartTLS()
+	return backend
+}
+
+func testUpstreamTLS(t *testing.T, vs *VirtualServer, expectCode int, expectBody string) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = DefaultServerName
+	rr := httptest.NewRecorder()
+	vs.ServeHTTP(rr, req)
+	assert.Equal(t, expectCode, rr.Code)
+	if expectBody != "" {
+		assert.Equal(t, expectBody, rr.Body.String())
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clientCert, clientKey := writeCert(t, dir, "client")
+
+	backend := tlsBackend(t, clientCert)
+	defer backend.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0600))
+	peer := backend.Listener.Addr().String()
+
+	// mutual TLS with the SNI override
+	vs, err := NewVirtualServer(
+		NameOpt("web"),
+		AddressOpt(":80"),
+		UpstreamTLSOpt(&config.UpstreamTLS{
+			Enable:     true,
+			CAFile:     caFile,
+			CertFile:   clientCert,
+			KeyFile:    clientKey,
+			ServerName: "example.com",
+		}),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1}}),
+	)
+	require.NoError(t, err)
+	testUpstreamTLS(t, vs, http.StatusOK, "example.com client")
+	testUpstreamTLS(t, vs, http.StatusOK, "example.com client")
+	assert.Equal(t, 1, len(vs.ReverseProxy))
+
+	// no client certificate
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		UpstreamTLSOpt(&config.UpstreamTLS{Enable: true, CAFile: caFile}),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1}}),
+	)
+	require.NoError(t, err)
+	testUpstreamTLS(t, vs, http.StatusBadGateway, "")
+
+	// https peer
+	plain := tlsBackend(t, "")
+	defer plain.Close()
+	httpsPeer := "https://" + plain.Listener.Addr().String()
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		PoolOpt([]config.Server{{Address: httpsPeer, Weight: 1}}),
+	)
+	require.NoError(t, err)
+	// the certificate of httptest is unknown
+	testUpstreamTLS(t, vs, http.StatusBadGateway, "")
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		UpstreamTLSOpt(&config.UpstreamTLS{Enable: true, InsecureSkipVerify: true}),
+		PoolOpt([]config.Server{{Address: httpsPeer, Weight: 1}}),
+	)
+	require.NoError(t, err)
+	testUpstreamTLS(t, vs, http.StatusOK, "")
+}
+
+func TestUpstreamTLSOpt(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		UpstreamTLSOpt(&config.UpstreamTLS{CAFile: "not_exist.pem"}))
+	require.NoError(t, err)
+	assert.Nil(t, vs.upstreamTLS)
+	assert.Equal(t, "http://127.0.0.1:10001", vs.peerURL("127.0.0.1:10001"))
+	assert.Equal(t, "https://127.0.0.1:10001", vs.peerURL("https://127.0.0.1:10001"))
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		UpstreamTLSOpt(&config.UpstreamTLS{Enable: true}))
+	require.NoError(t, err)
+	assert.Equal(t, "https://127.0.0.1:10001", vs.peerURL("127.0.0.1:10001"))
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		UpstreamTLSOpt(&config.UpstreamTLS{Enable: true, CAFile: "not_exist.pem"}))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "ca file 'not_exist.pem' does not exist")
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		UpstreamTLSOpt(&config.UpstreamTLS{Enable: true, CertFile: "not_exist.pem"}))
+	assert.Nil(t, vs)
+	assert.Contains(t, err.Error(), "load client certificate error=")
+
+	vs, err = NewVirtualServer(NameOpt("redis"), AddressOpt(":6379"), ProtocolOpt(ProtoTCP),
+		UpstreamTLSOpt(&config.UpstreamTLS{Enable: true}))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "upstream tls is not supported by tcp")
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), UpstreamProtocolOpt(UpstreamH2C),
+		UpstreamTLSOpt(&config.UpstreamTLS{Enable: true}))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "upstream tls is not supported by h2c")
+}
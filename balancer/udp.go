@@ -0,0 +1,239 @@
+package balancer
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/stats"
+)
+
+// DefaultIdleTimeout is the timeout of an idle udp session in seconds.
+const DefaultIdleTimeout = 30
+
+// maxDatagramSize is the maximum size of a udp datagram.
+const maxDatagramSize = 64 * 1024
+
+// udpSession maps a client to a peer, the replies of the peer are sent
+// back to the client.
+type udpSession struct {
+	client   *net.UDPAddr
+	peer     string
+	upstream *net.UDPConn
+	// unix nano of the last datagram in either direction
+	active int64
+}
+
+func (u *udpSession) touch() {
+	atomic.StoreInt64(&u.active, time.Now().UnixNano())
+}
+
+func (u *udpSession) idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&u.active)))
+}
+
+// udpServer holds the listener and the sessions of a udp virtual server.
+type udpServer struct {
+	sync.Mutex
+	conn     *net.UDPConn
+	sessions map[string]*udpSession
+	closed   bool
+	stopC    chan struct{}
+}
+
+// close closes the listener and all the sessions.
+func (u *udpServer) close() error {
+	u.Lock()
+	defer u.Unlock()
+	if u.closed {
+		return nil
+	}
+	u.closed = true
+	close(u.stopC)
+	for key, session := range u.sessions {
+		session.upstream.Close()
+		delete(u.sessions, key)
+	}
+	return u.conn.Close()
+}
+
+// remove closes the session, it returns false if the session is already
+// closed by Stop or the idle timeout.
+func (u *udpServer) remove(key string, session *udpSession) bool {
+	u.Lock()
+	defer u.Unlock()
+	if u.sessions[key] != session {
+		return false
+	}
+	delete(u.sessions, key)
+	session.upstream.Close()
+	return true
+}
+
+// listenUDP opens the socket, which is closed by stopUDP.
+func (s *VirtualServer) listenUDP() error {
+	laddr, err := net.ResolveUDPAddr("udp", s.Address)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.udp = &udpServer{
+		conn:     conn,
+		sessions: map[string]*udpSession{},
+		stopC:    make(chan struct{}),
+	}
+	s.Unlock()
+	return nil
+}
+
+// serveUDP reads the datagrams of the socket opened by listenUDP.
+func (s *VirtualServer) serveUDP() error {
+	s.RLock()
+	u := s.udp
+	s.RUnlock()
+	conn := u.conn
+	go s.expireSessions(u)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			u.Lock()
+			closed := u.closed
+			u.Unlock()
+			if closed {
+				return errServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		session := s.udpSession(u, client)
+		if session == nil {
+			s.serverStats("").Inc(&stats.Data{InBytes: uint64(n), InPackets: 1})
+			continue
+		}
+		if _, err := session.upstream.Write(buf[:n]); err != nil {
+			s.closeUDPSession(u, session, err)
+			continue
+		}
+		session.touch()
+		s.serverStats(session.peer).Inc(&stats.Data{InBytes: uint64(n), InPackets: 1})
+	}
+}
+
+// udpSession returns the session of the client, a peer is chosen for the
+// new client. It returns nil if no peer is available.
+func (s *VirtualServer) udpSession(u *udpServer, client *net.UDPAddr) *udpSession {
+	key := client.String()
+	u.Lock()
+	session, ok := u.sessions[key]
+	u.Unlock()
+	if ok {
+		return session
+	}
+
+	s.recovery()
+	peer := s.getPeer(s.hashKey.connValue(key))
+	if peer == "" {
+		log.Errorf("Get peer err=%v", ErrPeerNotFound.ErrMsg)
+		return nil
+	}
+	raddr, err := net.ResolveUDPAddr("udp", peer)
+	var upstream *net.UDPConn
+	if err == nil {
+		upstream, err = net.DialUDP("udp", nil, raddr)
+	}
+	s.reportPeer(peer, s.isConnFailure(err))
+	if err != nil {
+		log.Errorf("Connect peer %s err=%v", peer, err)
+		return nil
+	}
+
+	session = &udpSession{client: client, peer: peer, upstream: upstream}
+	session.touch()
+	u.Lock()
+	if u.closed {
+		u.Unlock()
+		upstream.Close()
+		return nil
+	}
+	u.sessions[key] = session
+	u.Unlock()
+	log.Infof("%s - udp (%s) new session", key, peer)
+
+	go s.replyUDP(u, session)
+	return session
+}
+
+// replyUDP sends the replies of the peer back to the client until the
+// session is closed.
+func (s *VirtualServer) replyUDP(u *udpServer, session *udpSession) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := session.upstream.Read(buf)
+		if err != nil {
+			s.closeUDPSession(u, session, err)
+			return
+		}
+		session.touch()
+		if _, err := u.conn.WriteToUDP(buf[:n], session.client); err != nil {
+			log.Errorf("Write client %s err=%v", session.client, err)
+			continue
+		}
+		s.serverStats(session.peer).Inc(&stats.Data{OutBytes: uint64(n), OutPackets: 1})
+	}
+}
+
+// closeUDPSession closes the session on an error of the peer, e.g. the
+// port unreachable, so that the next datagram of the client picks a peer
+// again.
+func (s *VirtualServer) closeUDPSession(u *udpServer, session *udpSession, err error) {
+	if !u.remove(session.client.String(), session) {
+		return
+	}
+	log.Errorf("%s - udp (%s) session err=%v", session.client, session.peer, err)
+	s.reportPeer(session.peer, s.isConnFailure(err))
+}
+
+// expireSessions closes the idle sessions periodically.
+func (s *VirtualServer) expireSessions(u *udpServer) {
+	timeout := s.IdleTimeout
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.stopC:
+			return
+		case now := <-ticker.C:
+			u.Lock()
+			for key, session := range u.sessions {
+				if session.idle(now) >= timeout {
+					log.Infof("%s - udp (%s) session expired", key, session.peer)
+					session.upstream.Close()
+					delete(u.sessions, key)
+				}
+			}
+			u.Unlock()
+		}
+	}
+}
+
+func (s *VirtualServer) stopUDP() error {
+	s.RLock()
+	u := s.udp
+	s.RUnlock()
+	if u == nil {
+		return nil
+	}
+	return u.close()
+}
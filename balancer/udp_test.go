@@ -0,0 +1,98 @@
+package balancer
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func udpEchoServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func TestUDPVirtualServer(t *testing.T) {
+	echo := udpEchoServer(t)
+	defer echo.Close()
+	peer := echo.LocalAddr().String()
+
+	addr := "127.0.0.1:8087"
+	vs, err := NewVirtualServer(
+		NameOpt("dns"),
+		AddressOpt(addr),
+		ProtocolOpt(ProtoUDP),
+		IdleTimeoutOpt(1),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1}}),
+	)
+	require.NoError(t, err)
+	require.NoError(t, vs.Run())
+	time.Sleep(time.Second)
+
+	conn, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	buf := make([]byte, 1024)
+	for _, msg := range []string{"ping", "hello"} {
+		_, err = conn.Write([]byte(msg))
+		require.NoError(t, err)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(buf[:n]))
+	}
+	assert.Contains(t, vs.Stats(), peer+"\nrecv_bytes: 9\nsend_bytes: 9\nrecv_packets: 2\nsend_packets: 2\n")
+	vs.udp.Lock()
+	assert.Equal(t, 1, len(vs.udp.sessions))
+	vs.udp.Unlock()
+
+	// the idle session expires
+	time.Sleep(2 * time.Second)
+	vs.udp.Lock()
+	assert.Equal(t, 0, len(vs.udp.sessions))
+	vs.udp.Unlock()
+
+	require.NoError(t, vs.Stop())
+	assert.Equal(t, StatusDisabled, vs.Status())
+
+	// the socket is closed even if Stop follows Run at once
+	require.NoError(t, vs.Run())
+	require.NoError(t, vs.Stop())
+	time.Sleep(100 * time.Millisecond)
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	require.NoError(t, err)
+	conn2, err := net.ListenUDP("udp", laddr)
+	require.NoError(t, err)
+	assert.Error(t, vs.Run())
+	conn2.Close()
+}
+
+func TestIdleTimeoutOpt(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("dns"), AddressOpt(":53"), ProtocolOpt(ProtoUDP))
+	require.NoError(t, err)
+	assert.Equal(t, DefaultIdleTimeout*time.Second, vs.IdleTimeout)
+
+	vs, err = NewVirtualServer(NameOpt("dns"), AddressOpt(":53"), IdleTimeoutOpt(-1))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "idle timeout -1 is negative")
+
+	vs, err = NewVirtualServer(NameOpt("dns"), AddressOpt(":53"), ProtocolOpt(ProtoUDP),
+		HashKeyOpt("cookie:session"))
+	assert.Nil(t, vs)
+	assert.EqualError(t, err, "hash key 'cookie:session' is not supported by udp")
+}
@@ -1,22 +1,31 @@
 package balancer
 
 import (
-	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
 
+	"github.com/onestraw/golb/breaker"
 	"github.com/onestraw/golb/chash"
 	"github.com/onestraw/golb/config"
+	"github.com/onestraw/golb/healthcheck"
+	"github.com/onestraw/golb/leastconn"
+	"github.com/onestraw/golb/maglev"
+	"github.com/onestraw/golb/outlier"
+	"github.com/onestraw/golb/p2c"
+	"github.com/onestraw/golb/rendezvous"
 	"github.com/onestraw/golb/retry"
 	"github.com/onestraw/golb/roundrobin"
 	"github.com/onestraw/golb/stats"
@@ -26,12 +35,24 @@ import (
 const (
 	LBRoundRobin     = "round-robin"
 	LBConsistentHash = "consistent-hash"
+	LBLeastConn      = "least-conn"
+	LBP2CEWMA        = "p2c-ewma"
+	LBMaglev         = "maglev"
+	LBRendezvous     = "rendezvous"
 	ProtoHTTP        = "http"
 	ProtoHTTPS       = "https"
 	ProtoGRPC        = "grpc"
+	ProtoTCP         = "tcp"
+	ProtoUDP         = "udp"
 	StatusEnabled    = "running"
 	StatusDisabled   = "stopped"
 
+	// the sources which mark a peer down
+	DownByPassive     = "passive"
+	DownByHealthCheck = "health_check"
+	DownByOutlier     = "outlier"
+	DownByBreaker     = "circuit_breaker"
+
 	DefaultServerName  = "localhost"
 	DefaultFailTimeout = 7
 	DefaultMaxFails    = 2
@@ -48,6 +69,37 @@ type Pooler interface {
 	UpPeer(addr string)
 }
 
+// ConnTracker is implemented by the Pooler which balances according to
+// the number of in-flight requests of each peer.
+type ConnTracker interface {
+	Acquire(addr string)
+	Release(addr string)
+}
+
+// LatencyTracker is implemented by the Pooler which balances according to
+// the response time of each peer.
+type LatencyTracker interface {
+	Observe(addr string, cost time.Duration)
+}
+
+// failureLatency is the least response time observed of a failed request,
+// so that a peer failing fast is not taken as a fast one.
+const failureLatency = DefaultDialTimeout
+
+// PeerExcluder is implemented by the Pooler which maps a key to the same
+// peer on every Get, it looks up the next candidate of the key when the
+// peers refused by the circuit breaker are excluded.
+type PeerExcluder interface {
+	GetExcluding(exclude map[string]bool, args ...interface{}) string
+}
+
+// SlowStarter is implemented by the Pooler which ramps up the weight of
+// new or recovered peers. The consistent-hash and maglev methods do not
+// implement it, as a changing weight would remap keys all the time.
+type SlowStarter interface {
+	SetSlowStart(d time.Duration)
+}
+
 // VirtualServer defines a LoadBalancer instance.
 type VirtualServer struct {
 	sync.RWMutex
@@ -58,29 +110,95 @@ type VirtualServer struct {
 	CertFile   string
 	KeyFile    string
 	LBMethod   string
+	HashKey    string
+	Replica    int
 	Pool       Pooler
 
-	// maximum fails before mark peer down
+	// the ordered routes, each of which refers to a named pool
+	routes    []*route
+	routeLock sync.RWMutex
+	// the named pools, which are not changed after created, but their members
+	namedPools []*namedPool
+
+	// the matchers of ServerName, *serverNames
+	serverNames atomic.Value
+	// serve the requests whose host matches no server name
+	DefaultServer bool
+
+	// certificates selected by SNI, besides the default CertFile
+	Certificates  []config.Certificate
+	minTLSVersion uint16
+	cipherSuites  []uint16
+	// the loaded *certStore
+	certs atomic.Value
+	// interval of checking the certificate files for reload
+	CertReloadInterval time.Duration
+	certWatchC         chan struct{}
+
+	// epsilon of consistent hashing with bounded loads
+	BoundedLoad float64
+
+	// duration of ramping up the weight of new or recovered peers
+	SlowStart time.Duration
+
+	// timeout of an idle client session of udp virtual server
+	IdleTimeout time.Duration
+
+	// accept h2c on the http listener
+	H2C bool
+	// the protocol speaking to the peers, http1, h2 or h2c
+	UpstreamProtocol string
+	// TLS config of speaking to the peers, nil if not configured
+	upstreamTLS *tls.Config
+
+	// header rules of the upstream requests and the responses, nil if not configured
+	headerRules *headerRules
+
+	hashKey hashKey
+
+	// maximum fails within FailTimeout before mark peer down
 	MaxFails int
 	fails    map[string]int
+	failOn   *failPolicy
 
-	// timeout before retry a down peer
+	// timeout before retry a down peer, and the window of counting the fails
 	FailTimeout int64
-	timeout     map[string]int64
+	// the time of the first fail in the window, or of marking the peer down
+	timeout map[string]int64
+
+	// active health check, nil if not configured
+	healthCheck *healthcheck.Checker
+
+	// outlier detection, nil if not configured
+	outlier *outlier.Detector
 
-	// used for fails/timeout
+	// circuit breaker, which takes over max fails and fail timeout, nil if not configured
+	breaker *breaker.Group
+
+	// the sources marking the peer down, a peer is up only if none
+	downBy map[string]map[string]bool
+
+	// used for fails/timeout/downBy
 	poolLock sync.RWMutex
 
 	retry bool
 
 	ReverseProxy map[string]*httputil.ReverseProxy
 	rpLock       sync.RWMutex
+	// transport of the reverse proxy, nil means http.DefaultTransport
+	transport http.RoundTripper
 
 	ServerStats map[string]*stats.Stats
 	ssLock      sync.RWMutex
 
-	server *http.Server
-	status string
+	// handler serves the requests dispatched by the listener
+	handler  http.Handler
+	listener *listener
+	// TLS config selected by SNI on the listener
+	tlsConfig *tls.Config
+	tcp       *tcpServer
+	udp       *udpServer
+	status    string
 }
 
 // VirtualServerOption provides option setter for VirtualServer.
@@ -108,14 +226,14 @@ func AddressOpt(addr string) VirtualServerOption {
 	}
 }
 
-// ServerNameOpt returns a function to set server name.
+// ServerNameOpt returns a function to set server name, which is a list of
+// exact, wildcard and regex names separated by spaces.
 func ServerNameOpt(serverName string) VirtualServerOption {
 	return func(vs *VirtualServer) error {
 		if serverName == "" {
 			serverName = DefaultServerName
 		}
-		vs.ServerName = serverName
-		return nil
+		return vs.setServerNames(serverName)
 	}
 }
 
@@ -125,18 +243,28 @@ func ProtocolOpt(proto string) VirtualServerOption {
 		if proto == "" {
 			proto = ProtoHTTP
 		}
-		if proto != ProtoHTTP && proto != ProtoHTTPS {
+		switch proto {
+		case ProtoHTTP, ProtoHTTPS, ProtoGRPC, ProtoTCP, ProtoUDP:
+		default:
 			return ErrNotSupportedProto
 		}
 		vs.Protocol = proto
+		if proto == ProtoTCP {
+			vs.LBMethod = LBConsistentHash
+		}
 		return nil
 	}
 }
 
-// TLSOpt returns a function to set TLS and should be called after ProtocolOpt.
+// TLSOpt returns a function to set TLS and should be called after ProtocolOpt,
+// TLS is optional for grpc which accepts h2c without it, and the default
+// certificate is optional if CertificatesOpt is set.
 func TLSOpt(certFile, keyFile string) VirtualServerOption {
 	return func(vs *VirtualServer) error {
-		if vs.Protocol != ProtoHTTPS {
+		if certFile == "" && keyFile == "" && (vs.Protocol == ProtoGRPC || len(vs.Certificates) > 0) {
+			return nil
+		}
+		if vs.Protocol != ProtoHTTPS && vs.Protocol != ProtoGRPC {
 			return nil
 		}
 		if _, err := os.Stat(certFile); err != nil {
@@ -152,13 +280,20 @@ func TLSOpt(certFile, keyFile string) VirtualServerOption {
 	}
 }
 
-// LBMethodOpt returns a function to set LBMethod.
+// LBMethodOpt returns a function to set LBMethod and should be called after
+// ProtocolOpt, tcp is balanced by consistent-hash by default.
 func LBMethodOpt(method string) VirtualServerOption {
 	return func(vs *VirtualServer) error {
 		if method == "" {
 			method = LBRoundRobin
+			if vs.Protocol == ProtoTCP {
+				// the connections of a client go to the same peer
+				method = LBConsistentHash
+			}
 		}
-		if method != LBRoundRobin && method != LBConsistentHash {
+		switch method {
+		case LBRoundRobin, LBConsistentHash, LBLeastConn, LBP2CEWMA, LBMaglev, LBRendezvous:
+		default:
 			return ErrNotSupportedMethod
 		}
 		vs.LBMethod = method
@@ -166,25 +301,175 @@ func LBMethodOpt(method string) VirtualServerOption {
 	}
 }
 
-// PoolOpt returns a function to set pool.
+// HashKeyOpt returns a function to set the hash key of the request.
+func HashKeyOpt(key string) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		h, err := parseHashKey(key)
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			key = DefaultHashKey
+		}
+		vs.HashKey = key
+		vs.hashKey = h
+		return nil
+	}
+}
+
+// ReplicaOpt returns a function to set the number of virtual nodes per weight
+// for consistent-hash method, and should be called before PoolOpt.
+func ReplicaOpt(replica int) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if replica <= 0 {
+			replica = chash.DefaultReplica
+		}
+		vs.Replica = replica
+		return nil
+	}
+}
+
+// BoundedLoadOpt returns a function to set epsilon of consistent hashing
+// with bounded loads, and should be called before PoolOpt.
+func BoundedLoadOpt(epsilon float64) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if epsilon < 0 {
+			return fmt.Errorf("bounded load %v is negative", epsilon)
+		}
+		vs.BoundedLoad = epsilon
+		return nil
+	}
+}
+
+// SlowStartOpt returns a function to set slow start in seconds,
+// and should be called before PoolOpt.
+func SlowStartOpt(seconds int) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if seconds < 0 {
+			return fmt.Errorf("slow start %d is negative", seconds)
+		}
+		vs.SlowStart = time.Duration(seconds) * time.Second
+		return nil
+	}
+}
+
+// IdleTimeoutOpt returns a function to set the timeout of an idle udp session.
+func IdleTimeoutOpt(seconds int) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if seconds < 0 {
+			return fmt.Errorf("idle timeout %d is negative", seconds)
+		}
+		if seconds == 0 {
+			seconds = DefaultIdleTimeout
+		}
+		vs.IdleTimeout = time.Duration(seconds) * time.Second
+		return nil
+	}
+}
+
+// HealthCheckOpt returns a function to set active health check,
+// and should be called before PoolOpt.
+func HealthCheckOpt(cfg *config.HealthCheck) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if cfg == nil {
+			return nil
+		}
+		checker, err := healthcheck.New(cfg, func(addr string, healthy bool) {
+			vs.poolLock.Lock()
+			defer vs.poolLock.Unlock()
+			vs.setPeerDown(addr, DownByHealthCheck, !healthy)
+		})
+		if err != nil {
+			return err
+		}
+		vs.healthCheck = checker
+		return nil
+	}
+}
+
+// OutlierDetectionOpt returns a function to set outlier detection,
+// and should be called before PoolOpt.
+func OutlierDetectionOpt(cfg *config.OutlierDetection) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if cfg == nil {
+			return nil
+		}
+		detector, err := outlier.New(cfg, func(addr string, ejected bool) {
+			vs.poolLock.Lock()
+			defer vs.poolLock.Unlock()
+			vs.setPeerDown(addr, DownByOutlier, ejected)
+		})
+		if err != nil {
+			return err
+		}
+		vs.outlier = detector
+		return nil
+	}
+}
+
+// CircuitBreakerOpt returns a function to set circuit breaker of the peers,
+// and should be called before PoolOpt.
+func CircuitBreakerOpt(cfg *config.CircuitBreaker) VirtualServerOption {
+	return func(vs *VirtualServer) error {
+		if cfg == nil {
+			return nil
+		}
+		group, err := breaker.New(cfg, func(addr string, open bool) {
+			vs.poolLock.Lock()
+			defer vs.poolLock.Unlock()
+			vs.setPeerDown(addr, DownByBreaker, open)
+		})
+		if err != nil {
+			return err
+		}
+		vs.breaker = group
+		return nil
+	}
+}
+
+// newPooler returns an empty pool of the LB method.
+func (vs *VirtualServer) newPooler() Pooler {
+	return vs.newMethodPooler(vs.LBMethod)
+}
+
+// newMethodPooler returns an empty pool of the given LB method.
+func (vs *VirtualServer) newMethodPooler(method string) Pooler {
+	switch method {
+	case LBConsistentHash:
+		pool := chash.NewWithReplica(vs.Replica)
+		pool.SetBoundedLoad(vs.BoundedLoad)
+		return pool
+	case LBLeastConn:
+		return leastconn.CreatePool(nil)
+	case LBP2CEWMA:
+		return p2c.New()
+	case LBMaglev:
+		return maglev.New()
+	case LBRendezvous:
+		return rendezvous.New()
+	}
+	return roundrobin.CreatePool(nil)
+}
+
+// PoolOpt returns a function to set pool, the peers are grouped by priority.
 func PoolOpt(peers []config.Server) VirtualServerOption {
 	return func(vs *VirtualServer) error {
-		method := vs.LBMethod
-		if method == LBRoundRobin {
-			pairs := make(map[string]int)
-			for _, peer := range peers {
-				pairs[peer.Address] = peer.Weight
-			}
-			vs.Pool = roundrobin.CreatePool(pairs)
-		} else if method == LBConsistentHash {
-			addrs := make([]string, len(peers))
-			for i, peer := range peers {
-				addrs[i] = peer.Address
-			}
-			vs.Pool = chash.CreatePool(addrs)
-		} else {
+		switch vs.LBMethod {
+		case LBRoundRobin, LBConsistentHash, LBLeastConn, LBP2CEWMA, LBMaglev, LBRendezvous:
+		default:
 			return ErrNotSupportedMethod
 		}
+		pool := newPriorityPool(vs.newPooler)
+		for _, peer := range peers {
+			if err := vs.CheckPeer(peer); err != nil {
+				return err
+			}
+			pool.Add(peer.Address, peer.Weight, peer.PriorityLevel())
+			vs.trackPeer(peer.Address)
+		}
+		// only the peers joining later ramp up
+		pool.SetSlowStart(vs.SlowStart)
+		vs.Pool = pool
 		return nil
 	}
 }
@@ -199,18 +484,26 @@ func RetryOpt(enable bool) VirtualServerOption {
 
 // NewVirtualServer returns a VirtualServer object.
 func NewVirtualServer(opts ...VirtualServerOption) (*VirtualServer, error) {
+	failOn, _ := parseFailOn(DefaultFailOn)
 	vs := &VirtualServer{
-		Protocol:     ProtoHTTP,
-		ServerName:   DefaultServerName,
-		LBMethod:     LBRoundRobin,
-		MaxFails:     DefaultMaxFails,
-		FailTimeout:  DefaultFailTimeout,
-		retry:        false,
-		fails:        make(map[string]int),
-		timeout:      make(map[string]int64),
-		ReverseProxy: make(map[string]*httputil.ReverseProxy),
-		ServerStats:  make(map[string]*stats.Stats),
-		status:       StatusDisabled,
+		Protocol:           ProtoHTTP,
+		ServerName:         DefaultServerName,
+		LBMethod:           LBRoundRobin,
+		HashKey:            DefaultHashKey,
+		hashKey:            hashKey{{kind: DefaultHashKey}},
+		Replica:            chash.DefaultReplica,
+		MaxFails:           DefaultMaxFails,
+		FailTimeout:        DefaultFailTimeout,
+		IdleTimeout:        DefaultIdleTimeout * time.Second,
+		CertReloadInterval: DefaultCertReloadInterval * time.Second,
+		retry:              false,
+		fails:              make(map[string]int),
+		failOn:             failOn,
+		timeout:            make(map[string]int64),
+		downBy:             make(map[string]map[string]bool),
+		ReverseProxy:       make(map[string]*httputil.ReverseProxy),
+		ServerStats:        make(map[string]*stats.Stats),
+		status:             StatusDisabled,
 	}
 	for _, opt := range opts {
 		if err := opt(vs); err != nil {
@@ -223,9 +516,29 @@ func NewVirtualServer(opts ...VirtualServerOption) (*VirtualServer, error) {
 	if vs.Address == "" {
 		return nil, AddressOpt("")(vs)
 	}
-	vs.server = &http.Server{Addr: vs.Address, Handler: vs}
+	if (vs.Protocol == ProtoTCP || vs.Protocol == ProtoUDP) && !vs.hashKey.connOnly() {
+		return nil, fmt.Errorf("hash key '%s' is not supported by %s", vs.HashKey, vs.Protocol)
+	}
+	if err := vs.checkHTTP2(); err != nil {
+		return nil, err
+	}
+	if err := vs.checkUpstreamTLS(); err != nil {
+		return nil, err
+	}
+	if vs.healthCheck != nil {
+		vs.healthCheck.SetUpstream(vs.UpstreamProtocol, vs.upstreamTLS)
+	}
+	vs.transport = newTransport(vs.UpstreamProtocol, vs.upstreamTLS)
+	vs.handler = vs
 	if vs.retry {
-		vs.server.Handler = retry.Retry(vs)
+		if vs.Protocol == ProtoGRPC {
+			vs.handler = retry.GRPC(vs)
+		} else {
+			vs.handler = retry.Retry(vs)
+		}
+	}
+	if vs.Protocol != ProtoTCP && vs.Protocol != ProtoUDP {
+		vs.listener = newListener(vs)
 	}
 
 	return vs, nil
@@ -236,14 +549,19 @@ func (s *VirtualServer) getReverseProxy(peer string) (*httputil.ReverseProxy, er
 	rp, ok := s.ReverseProxy[peer]
 	s.rpLock.RUnlock()
 	if !ok {
-		if !strings.HasPrefix(peer, "http://") {
-			peer = "http://" + peer
-		}
-		target, err := url.Parse(peer)
+		target, err := url.Parse(s.peerURL(peer))
 		if err != nil {
 			return nil, err
 		}
 		rp = httputil.NewSingleHostReverseProxy(target)
+		rp.ErrorHandler = proxyErrorHandler
+		if s.transport != nil {
+			rp.Transport = s.transport
+		}
+		if s.Protocol == ProtoGRPC {
+			// stream the messages
+			rp.FlushInterval = -1
+		}
 		s.rpLock.Lock()
 		s.ReverseProxy[peer] = rp
 		s.rpLock.Unlock()
@@ -251,16 +569,73 @@ func (s *VirtualServer) getReverseProxy(peer string) (*httputil.ReverseProxy, er
 	return rp, nil
 }
 
-// fail mark the peer down temporarily if the peer fails MaxFails.
+// setPeerDown marks the peer down on behalf of the source, the peer is
+// marked up only if no source marks it down. It must be called with poolLock.
+func (s *VirtualServer) setPeerDown(peer, source string, down bool) {
+	sources := s.downBy[peer]
+	if down {
+		if sources[source] {
+			return
+		}
+		if len(sources) == 0 {
+			log.Infof("Mark down peer: %s, by %s", peer, source)
+			for _, pool := range s.pools() {
+				pool.DownPeer(peer)
+			}
+			sources = make(map[string]bool)
+			s.downBy[peer] = sources
+		}
+		sources[source] = true
+		return
+	}
+
+	if !sources[source] {
+		return
+	}
+	delete(sources, source)
+	if len(sources) == 0 {
+		log.Infof("Mark up peer: %s, by %s", peer, source)
+		delete(s.downBy, peer)
+		for _, pool := range s.pools() {
+			pool.UpPeer(peer)
+		}
+	}
+}
+
+// proxyErrorHandler records the error of forwarding the request,
+// so that it is told apart from the 502 response of the peer.
+func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	log.Errorf("http: proxy error: %v", err)
+	if rw, ok := w.(*lbResponseWriter); ok {
+		rw.err = err
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// fail mark the peer down temporarily if the peer fails MaxFails within
+// FailTimeout, the fails out of the window are forgotten.
 func (s *VirtualServer) fail(peer string) {
 	s.poolLock.Lock()
 	defer s.poolLock.Unlock()
 
+	now := time.Now().Unix()
+	if s.fails[peer] == 0 || (s.fails[peer] < s.MaxFails && now-s.timeout[peer] >= s.FailTimeout) {
+		s.fails[peer] = 0
+		s.timeout[peer] = now
+	}
 	s.fails[peer]++
 	if s.fails[peer] >= s.MaxFails {
-		log.Infof("Mark down peer: %s", peer)
-		s.Pool.DownPeer(peer)
-		s.timeout[peer] = time.Now().Unix()
+		s.setPeerDown(peer, DownByPassive, true)
+		s.timeout[peer] = now
+	}
+}
+
+// reportPeer records the result of a request to the peer for passive health.
+func (s *VirtualServer) reportPeer(peer string, failed bool) {
+	if s.breaker != nil {
+		s.breaker.Report(peer, !failed)
+	} else if failed {
+		s.fail(peer)
 	}
 }
 
@@ -272,8 +647,8 @@ func (s *VirtualServer) recovery() {
 	now := time.Now().Unix()
 	for k, v := range s.timeout {
 		if s.fails[k] >= s.MaxFails && now-v >= s.FailTimeout {
-			log.Infof("Mark up peer: %s", k)
-			s.Pool.UpPeer(k)
+			// stays down if the health check still fails
+			s.setPeerDown(k, DownByPassive, false)
 			s.fails[k] = 0
 		}
 	}
@@ -283,30 +658,84 @@ type lbResponseWriter struct {
 	http.ResponseWriter
 	code  int
 	bytes int
+	// error of forwarding the request
+	err error
+	// status of the grpc response, nil if not grpc
+	grpcStatus *codes.Code
+	// whether the multiplexed upstream connection is reused
+	gotConn bool
+	reused  bool
+	// the header rules applied to the response, nil if none
+	headers     *headerContext
+	wroteHeader bool
 }
 
 func (w *lbResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
 	size, err := w.ResponseWriter.Write(data)
 	w.bytes += size
 	return size, err
 }
 
 func (w *lbResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.headers.modifyResponse(w.Header())
+	}
 	w.code = code
 	w.ResponseWriter.WriteHeader(code)
 }
 
+func (w *lbResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	// a trailers-only grpc response ends with its headers, the client takes
+	// the status in the headers flushed before the end as missing trailers
+	if w.bytes == 0 && w.Header().Get("Grpc-Status") != "" {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 // ServeHTTP dispatch the request between backend servers.
 func (s *VirtualServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	timeBegin := time.Now()
-	rw := &lbResponseWriter{w, http.StatusOK, 0}
+	rw := &lbResponseWriter{ResponseWriter: w, code: http.StatusOK}
 	peer := ""
+	var rt *route
 	defer func() {
+		if s.Protocol == ProtoGRPC {
+			rw.setGRPCStatus()
+		}
 		s.StatsInc(peer, r, rw)
-		if peer != "" && rw.code/100 == 5 {
-			s.fail(peer)
+		if rt != nil {
+			rt.stats.Inc(statsData(r, rw))
+		}
+		failed := peer != "" && s.isFailure(rw)
+		if peer != "" {
+			s.reportPeer(peer, failed)
 		}
-		cost := time.Since(timeBegin) / time.Millisecond
+		if peer != "" && s.outlier != nil {
+			s.outlier.Report(peer, rw.healthCode())
+		}
+		elapsed := time.Since(timeBegin)
+		pool := s.Pool
+		if rt != nil {
+			pool = rt.pool
+		}
+		if t, ok := pool.(LatencyTracker); ok && peer != "" {
+			latency := elapsed
+			if failed && latency < failureLatency {
+				latency = failureLatency
+			}
+			t.Observe(peer, latency)
+		}
+		cost := elapsed / time.Millisecond
 		log.Infof("%s - %s %s(%s)%s %s %dms- %d", r.RemoteAddr, r.Method, r.Host, peer, r.URL, r.Proto, cost, rw.code)
 	}()
 
@@ -316,14 +745,21 @@ func (s *VirtualServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.recovery()
 
 	// check the request’s header field "Host"
-	if r.Host != s.ServerName {
+	if !s.hostMatched(r.Host) {
 		log.Errorf("Host not match, host=%s", r.Host)
 		WriteError(rw, ErrHostNotMatch)
 		return
 	}
 
-	// use client's address as hash key if using consistent-hash method
-	peer = s.Pool.Get(r.RemoteAddr)
+	// the first matched route takes the request, or else the pool
+	var pool Pooler = s.Pool
+	if rt = s.matchRoute(r); rt != nil {
+		pool = rt.pool
+	}
+	rw.headers = s.headerContext(r, rt)
+
+	// the hash key is used by consistent-hash, maglev and rendezvous method
+	peer = s.getPoolPeer(pool, s.hashKey.value(r))
 	if peer == "" {
 		log.Errorf("Get peer err=%v", ErrPeerNotFound.ErrMsg)
 		WriteError(rw, ErrPeerNotFound)
@@ -337,11 +773,47 @@ func (s *VirtualServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rp.ServeHTTP(rw, r)
+	if t, ok := pool.(ConnTracker); ok {
+		t.Acquire(peer)
+		defer t.Release(peer)
+	}
+	out := rw.headers.upstreamRequest(r, peer)
+	if s.multiplexed() {
+		out = out.WithContext(httptrace.WithClientTrace(out.Context(), rw.connTrace()))
+	}
+	rp.ServeHTTP(rw, out)
+}
+
+// getPeer returns a peer admitted by the circuit breaker, a half-open peer
+// takes limited trial requests, so the others are tried.
+func (s *VirtualServer) getPeer(key string) string {
+	return s.getPoolPeer(s.Pool, key)
 }
 
-// StatsInc adds a request info.
-func (s *VirtualServer) StatsInc(addr string, r *http.Request, w *lbResponseWriter) {
+// getPoolPeer returns a peer of the pool admitted by the circuit breaker.
+func (s *VirtualServer) getPoolPeer(pool Pooler, key string) string {
+	peer := pool.Get(key)
+	if s.breaker == nil {
+		return peer
+	}
+	excluder, _ := pool.(PeerExcluder)
+	refused := map[string]bool{}
+	for i := 0; peer != "" && i <= pool.Size(); i++ {
+		if s.breaker.Allow(peer) {
+			return peer
+		}
+		if excluder == nil {
+			peer = pool.Get(key)
+			continue
+		}
+		refused[peer] = true
+		peer = excluder.GetExcluding(refused, key)
+	}
+	return ""
+}
+
+// serverStats returns the stats of the peer.
+func (s *VirtualServer) serverStats(addr string) *stats.Stats {
 	if addr == "" {
 		addr = "Load Balancer Error"
 	}
@@ -350,24 +822,52 @@ func (s *VirtualServer) StatsInc(addr string, r *http.Request, w *lbResponseWrit
 	s.ssLock.RUnlock()
 	if !ok {
 		s.ssLock.Lock()
-		ss = stats.New()
-		s.ServerStats[addr] = ss
+		if ss, ok = s.ServerStats[addr]; !ok {
+			ss = stats.New()
+			s.ServerStats[addr] = ss
+		}
 		s.ssLock.Unlock()
 	}
+	return ss
+}
+
+// StatsInc adds a request info.
+func (s *VirtualServer) StatsInc(addr string, r *http.Request, w *lbResponseWriter) {
+	s.serverStats(addr).Inc(statsData(r, w))
+}
+
+// statsData returns the stats data of the request.
+func statsData(r *http.Request, w *lbResponseWriter) *stats.Data {
 	data := &stats.Data{
-		StatusCode: strconv.Itoa(w.code),
+		StatusCode: w.statusCode(),
 		Method:     r.Method,
 		Path:       r.URL.Path,
-		InBytes:    uint64(r.ContentLength),
 		OutBytes:   uint64(w.bytes),
 	}
-	ss.Inc(data)
+	// unknown for a streaming request
+	if r.ContentLength > 0 {
+		data.InBytes = uint64(r.ContentLength)
+	}
+	if w.gotConn && w.reused {
+		data.ReusedConns = 1
+	} else if w.gotConn {
+		data.NewConns = 1
+	}
+	return data
 }
 
 // Stats return the stats info.
 func (s *VirtualServer) Stats() string {
+	// the connections of tcp and udp add the stats concurrently
+	s.ssLock.RLock()
+	serverStats := make(map[string]*stats.Stats, len(s.ServerStats))
+	for key, ss := range s.ServerStats {
+		serverStats[key] = ss
+	}
+	s.ssLock.RUnlock()
+
 	keys := []string{}
-	for key := range s.ServerStats {
+	for key := range serverStats {
 		keys = append(keys, key)
 	}
 
@@ -376,22 +876,75 @@ func (s *VirtualServer) Stats() string {
 		fmt.Sprintf("Pool-%s", s.Name),
 	}
 	for _, peer := range keys {
-		ss := s.ServerStats[peer]
+		ss := serverStats[peer]
 		result = append(result, fmt.Sprintf("%s\n%s\n------", peer, ss))
 	}
+	s.routeLock.RLock()
+	defer s.routeLock.RUnlock()
+	for _, rt := range s.routes {
+		result = append(result, fmt.Sprintf("Route-%s\n%s\n------", rt.cfg.Name, rt.stats))
+	}
 	return strings.Join(result, "\n")
 }
 
-// AddPeer adds one peer to the pool.
+// AddPeer adds one peer to the pool, args[0] is the weight and args[1] is the priority.
 func (s *VirtualServer) AddPeer(addr string, args ...interface{}) {
 	s.Pool.Add(addr, args...)
+	s.trackPeer(addr)
+}
+
+// CheckPeer returns the error if the peer cannot join the pools.
+func (s *VirtualServer) CheckPeer(peer config.Server) error {
+	if peer.Priority < 0 {
+		return config.ErrPoolMemberPriority
+	}
+	if (s.Protocol == ProtoTCP || s.Protocol == ProtoUDP) && strings.Contains(peer.Address, "://") {
+		return config.ErrPoolMemberScheme
+	}
+	if s.upstreamH2C() && strings.HasPrefix(peer.Address, "https://") {
+		return config.ErrPoolMemberTLS
+	}
+	return nil
+}
+
+// trackPeer starts the health check and outlier detection of the peer.
+func (s *VirtualServer) trackPeer(addr string) {
+	if s.healthCheck != nil {
+		s.healthCheck.Add(addr)
+	}
+	if s.outlier != nil {
+		s.outlier.Add(addr)
+	}
+	if s.breaker != nil {
+		s.breaker.Add(addr)
+	}
 }
 
-// RemovePeer removes the peer from the pool and related.
+// RemovePeer removes the peer from the pool, and the related unless a
+// named pool has the peer.
 func (s *VirtualServer) RemovePeer(addr string) {
+	s.Pool.Remove(addr)
+	if !s.pooled(addr) {
+		s.forgetPeer(addr)
+	}
+}
+
+// forgetPeer stops tracking the peer and drops its state.
+func (s *VirtualServer) forgetPeer(addr string) {
+	if s.healthCheck != nil {
+		s.healthCheck.Remove(addr)
+	}
+	if s.outlier != nil {
+		s.outlier.Remove(addr)
+	}
+	if s.breaker != nil {
+		s.breaker.Remove(addr)
+	}
+
 	s.poolLock.Lock()
 	delete(s.fails, addr)
 	delete(s.timeout, addr)
+	delete(s.downBy, addr)
 	s.poolLock.Unlock()
 
 	s.rpLock.Lock()
@@ -401,8 +954,6 @@ func (s *VirtualServer) RemovePeer(addr string) {
 	s.ssLock.Lock()
 	delete(s.ServerStats, addr)
 	s.ssLock.Unlock()
-
-	s.Pool.Remove(addr)
 }
 
 func (s *VirtualServer) statusSwitch(status string) {
@@ -411,6 +962,31 @@ func (s *VirtualServer) statusSwitch(status string) {
 	s.status = status
 }
 
+// Health return the health of the peers, empty if none of health check,
+// outlier detection and circuit breaker is configured.
+func (s *VirtualServer) Health() string {
+	result := []string{}
+	if s.healthCheck != nil {
+		result = append(result, s.healthCheck.String())
+	}
+	if s.outlier != nil {
+		result = append(result, s.outlier.String())
+	}
+	if s.breaker != nil {
+		result = append(result, s.breaker.String())
+	}
+	return strings.Join(result, "\n")
+}
+
+// CircuitBreaker returns the state and the transition history of the
+// breakers, nil if circuit breaker is not configured.
+func (s *VirtualServer) CircuitBreaker() map[string]*breaker.Status {
+	if s.breaker == nil {
+		return nil
+	}
+	return s.breaker.Status()
+}
+
 // Status return the server status.
 func (s *VirtualServer) Status() string {
 	s.RLock()
@@ -420,24 +996,63 @@ func (s *VirtualServer) Status() string {
 
 func (s *VirtualServer) listenAndServe() error {
 	switch s.Protocol {
-	case ProtoHTTP:
-		return s.server.ListenAndServe()
-	case ProtoHTTPS:
-		return s.server.ListenAndServeTLS(s.CertFile, s.KeyFile)
+	case ProtoHTTP, ProtoHTTPS, ProtoGRPC:
+		return s.listener.serve(s)
+	case ProtoTCP:
+		return s.serveTCP()
+	case ProtoUDP:
+		return s.serveUDP()
 	}
 	return ErrNotSupportedProto
 }
 
+// listen opens the tcp listener or the udp socket before Run returns, so
+// that it is always closed by Stop, and sets the TLS config before the
+// handshakes are routed to the virtual server.
+func (s *VirtualServer) listen() error {
+	switch s.Protocol {
+	case ProtoHTTP, ProtoHTTPS, ProtoGRPC:
+		if !s.servesTLS() {
+			return nil
+		}
+		tlsConfig, err := s.serverTLSConfig()
+		if err != nil {
+			return err
+		}
+		s.Lock()
+		s.tlsConfig = tlsConfig
+		s.Unlock()
+	case ProtoTCP:
+		return s.listenTCP()
+	case ProtoUDP:
+		return s.listenUDP()
+	}
+	return nil
+}
+
 // Run starts the server.
 func (s *VirtualServer) Run() error {
 	if s.Status() == StatusEnabled {
 		return fmt.Errorf("%s is already enabled", s.Name)
 	}
+	if err := s.listen(); err != nil {
+		return fmt.Errorf("%s Listen error=%v", s.Name, err)
+	}
 
 	log.Infof("Starting [%s], listen %s, proto %s, method %s, pool %v",
 		s.Name, s.Address, s.Protocol, s.LBMethod, s.Pool)
+	if s.healthCheck != nil {
+		s.healthCheck.Start()
+	}
+	if s.outlier != nil {
+		s.outlier.Start()
+	}
+	if s.breaker != nil {
+		s.breaker.Start()
+	}
+	s.startCertWatcher()
+	s.statusSwitch(StatusEnabled)
 	go func() {
-		s.statusSwitch(StatusEnabled)
 		err := s.listenAndServe()
 		if err != nil {
 			log.Errorf("%s ListenAndServe error=%v", s.Name, err)
@@ -454,9 +1069,28 @@ func (s *VirtualServer) Stop() error {
 	}
 
 	log.Infof("Stopping [%s]", s.Name)
-	if err := s.server.Shutdown(context.Background()); err != nil {
+	shutdown := func() error {
+		return s.listener.stop(s)
+	}
+	switch s.Protocol {
+	case ProtoTCP:
+		shutdown = s.stopTCP
+	case ProtoUDP:
+		shutdown = s.stopUDP
+	}
+	if err := shutdown(); err != nil {
 		return fmt.Errorf("%s Shutdown error=%v", s.Name, err)
 	}
+	if s.healthCheck != nil {
+		s.healthCheck.Stop()
+	}
+	if s.outlier != nil {
+		s.outlier.Stop()
+	}
+	if s.breaker != nil {
+		s.breaker.Stop()
+	}
+	s.stopCertWatcher()
 	s.statusSwitch(StatusDisabled)
 	return nil
 }
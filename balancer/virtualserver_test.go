@@ -12,6 +12,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/onestraw/golb/chash"
 	"github.com/onestraw/golb/config"
 )
 
@@ -178,10 +179,14 @@ func TestOpt(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, ProtoHTTP, vs.Protocol)
 
-	vs, err = NewVirtualServer(ProtocolOpt("grpc"))
+	vs, err = NewVirtualServer(ProtocolOpt("quic"))
 	require.Nil(t, vs)
 	assert.Equal(t, ErrNotSupportedProto, err)
 
+	vs, err = NewVirtualServer(NameOpt("echo"), AddressOpt(":50051"), ProtocolOpt("grpc"), TLSOpt("", ""))
+	require.NoError(t, err)
+	assert.Equal(t, ProtoGRPC, vs.Protocol)
+
 	vs, err = NewVirtualServer(ProtocolOpt("https"), TLSOpt("", ""))
 	assert.Nil(t, vs)
 	assert.Contains(t, err.Error(), "not exist")
@@ -209,7 +214,234 @@ func TestOpt(t *testing.T) {
 	assert.Nil(t, vs)
 	assert.Equal(t, err, ErrNotSupportedMethod)
 
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), LBMethodOpt(LBLeastConn),
+		PoolOpt([]config.Server{{Address: "127.0.0.1:10001", Weight: 1}}))
+	require.NoError(t, err)
+	assert.Equal(t, LBLeastConn, vs.LBMethod)
+	_, ok := vs.Pool.(ConnTracker)
+	assert.True(t, ok)
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), LBMethodOpt(LBConsistentHash),
+		ReplicaOpt(10), PoolOpt([]config.Server{{Address: "127.0.0.1:10001", Weight: 2}}))
+	require.NoError(t, err)
+	assert.Equal(t, 10, vs.Replica)
+	assert.Equal(t, "127.0.0.1:10001(w=2, vnodes=20, keys=100.00%)", vs.Pool.String())
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), ReplicaOpt(0))
+	require.NoError(t, err)
+	assert.Equal(t, chash.DefaultReplica, vs.Replica)
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), LBMethodOpt(LBConsistentHash),
+		BoundedLoadOpt(0.25), PoolOpt([]config.Server{{Address: "127.0.0.1:10001"}}))
+	require.NoError(t, err)
+	assert.Equal(t, 0.25, vs.BoundedLoad)
+	_, ok = vs.Pool.(ConnTracker)
+	assert.True(t, ok)
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), LBMethodOpt(LBMaglev),
+		PoolOpt([]config.Server{{Address: "127.0.0.1:10001"}}))
+	require.NoError(t, err)
+	assert.Equal(t, LBMaglev, vs.LBMethod)
+	assert.Equal(t, "127.0.0.1:10001", vs.Pool.Get("any"))
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), LBMethodOpt(LBRendezvous),
+		PoolOpt([]config.Server{{Address: "127.0.0.1:10001", Weight: 2}}))
+	require.NoError(t, err)
+	assert.Equal(t, LBRendezvous, vs.LBMethod)
+	assert.Equal(t, "127.0.0.1:10001", vs.Pool.Get("any"))
+
+	vs, err = NewVirtualServer(BoundedLoadOpt(-1))
+	assert.Nil(t, vs)
+	assert.Contains(t, err.Error(), "negative")
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), LBMethodOpt(LBP2CEWMA),
+		PoolOpt([]config.Server{{Address: "127.0.0.1:10001", Weight: 1}}))
+	require.NoError(t, err)
+	assert.Equal(t, LBP2CEWMA, vs.LBMethod)
+	_, ok = vs.Pool.(LatencyTracker)
+	assert.True(t, ok)
+
 	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), RetryOpt(true))
 	require.NoError(t, err)
 	assert.Equal(t, true, vs.retry)
 }
+
+func TestHealthCheckOpt(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		HealthCheckOpt(&config.HealthCheck{Status: "ok"}))
+	assert.Nil(t, vs)
+	assert.Contains(t, err.Error(), "invalid")
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"), HealthCheckOpt(nil),
+		PoolOpt([]config.Server{{Address: "a"}}))
+	require.NoError(t, err)
+	assert.Equal(t, "", vs.Health())
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		HealthCheckOpt(&config.HealthCheck{Path: "/health"}),
+		PoolOpt([]config.Server{{Address: "a"}, {Address: "b"}}))
+	require.NoError(t, err)
+	vs.AddPeer("c", 1)
+	vs.RemovePeer("b")
+	assert.Equal(t, "health check: http /health every 5s\na: healthy\nc: healthy", vs.Health())
+}
+
+func TestSetPeerDown(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		PoolOpt([]config.Server{{Address: "a"}}))
+	require.NoError(t, err)
+
+	vs.setPeerDown("a", DownByHealthCheck, true)
+	assert.Equal(t, "", vs.Pool.Get())
+
+	// the passive recovery does not bring up an unhealthy peer
+	vs.setPeerDown("a", DownByPassive, true)
+	vs.setPeerDown("a", DownByPassive, false)
+	assert.Equal(t, "", vs.Pool.Get())
+
+	vs.setPeerDown("a", DownByHealthCheck, false)
+	assert.Equal(t, "a", vs.Pool.Get())
+	assert.Empty(t, vs.downBy)
+
+	// up by a source which does not mark it down
+	vs.setPeerDown("a", DownByPassive, true)
+	vs.setPeerDown("a", DownByHealthCheck, false)
+	assert.Equal(t, "", vs.Pool.Get())
+}
+
+func TestP2CEWMAFailure(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+	goodAddr, badAddr := good.Listener.Addr().String(), bad.Listener.Addr().String()
+
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"), LBMethodOpt(LBP2CEWMA),
+		PassiveHealthOpt(&config.PassiveHealth{MaxFails: 100}),
+		PoolOpt([]config.Server{{Address: goodAddr, Weight: 1}, {Address: badAddr, Weight: 1}}))
+	require.NoError(t, err)
+
+	// the peer failing fast is not taken as the fastest one
+	codes := map[int]int{}
+	for i := 0; i < 20; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = DefaultServerName
+		w := httptest.NewRecorder()
+		vs.ServeHTTP(w, r)
+		codes[w.Code]++
+	}
+	assert.True(t, codes[http.StatusInternalServerError] <= 2, codes)
+	assert.Nil(t, vs.downBy[badAddr])
+}
+
+func TestOutlierDetectionOpt(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		OutlierDetectionOpt(&config.OutlierDetection{MaxEjectionPercent: 200}))
+	assert.Nil(t, vs)
+	assert.Error(t, err)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+	peer := backend.Listener.Addr().String()
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		OutlierDetectionOpt(&config.OutlierDetection{Consecutive5xx: 3}),
+		PoolOpt([]config.Server{{Address: peer}, {Address: "127.0.0.1:1", Priority: 1}}))
+	require.NoError(t, err)
+	vs.MaxFails = 100
+
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = DefaultServerName
+		w := httptest.NewRecorder()
+		vs.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusInternalServerError, w.Code)
+	}
+	assert.Equal(t, map[string]bool{DownByOutlier: true}, vs.downBy[peer])
+	assert.Equal(t, "127.0.0.1:1", vs.Pool.Get())
+	assert.Contains(t, vs.Health(), peer+": ejected by consecutive 5xx")
+
+	vs.RemovePeer(peer)
+	assert.Equal(t, "outlier detection:\n127.0.0.1:1: ok", vs.Health())
+}
+
+func TestCircuitBreakerOpt(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		CircuitBreakerOpt(&config.CircuitBreaker{OpenTimeout: 600}))
+	assert.Nil(t, vs)
+	assert.Error(t, err)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+	peer := backend.Listener.Addr().String()
+
+	vs, err = NewVirtualServer(NameOpt("web"), AddressOpt(":80"),
+		CircuitBreakerOpt(&config.CircuitBreaker{FailureThreshold: 1, OpenTimeout: 1}),
+		PoolOpt([]config.Server{{Address: peer, Weight: 1}, {Address: "b", Weight: 1}}))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = DefaultServerName
+	vs.ServeHTTP(httptest.NewRecorder(), r)
+	vs.poolLock.RLock()
+	assert.Equal(t, map[string]bool{DownByBreaker: true}, vs.downBy[peer])
+	assert.Equal(t, 0, vs.fails[peer])
+	vs.poolLock.RUnlock()
+	assert.Equal(t, "open", vs.CircuitBreaker()[peer].State)
+
+	// the half-open peer takes one trial request
+	vs.breaker.Start()
+	time.Sleep(2 * time.Second)
+	vs.breaker.Stop()
+	vs.poolLock.RLock()
+	assert.Empty(t, vs.downBy)
+	vs.poolLock.RUnlock()
+	count := map[string]int{}
+	for i := 0; i < 4; i++ {
+		count[vs.getPeer(vs.hashKey.value(r))]++
+	}
+	assert.Equal(t, map[string]int{peer: 1, "b": 3}, count)
+
+	vs.breaker.Report(peer, true)
+	status := vs.CircuitBreaker()[peer]
+	assert.Equal(t, "closed", status.State)
+	assert.Equal(t, []string{"closed", "open", "half-open"},
+		[]string{status.History[0].From, status.History[1].From, status.History[2].From})
+	assert.Contains(t, vs.Health(), "circuit breaker:\n"+peer+": closed\nb: closed")
+}
+
+func TestCircuitBreakerHashPool(t *testing.T) {
+	vs, err := NewVirtualServer(NameOpt("web"), AddressOpt(":80"), LBMethodOpt(LBConsistentHash),
+		CircuitBreakerOpt(&config.CircuitBreaker{FailureThreshold: 1, OpenTimeout: 1}),
+		PoolOpt([]config.Server{{Address: "a", Weight: 1}, {Address: "b", Weight: 1}, {Address: "c", Weight: 1}}))
+	require.NoError(t, err)
+
+	keys := []string{}
+	for i := 0; len(keys) < 3; i++ {
+		if key := fmt.Sprintf("key-%d", i); vs.getPeer(key) == "a" {
+			keys = append(keys, key)
+		}
+	}
+	vs.breaker.Report("a", false)
+	vs.breaker.Start()
+	time.Sleep(2 * time.Second)
+	vs.breaker.Stop()
+	require.Equal(t, "half-open", vs.CircuitBreaker()["a"].State)
+
+	// the keys of the half-open peer go to the next peer on the ring once
+	// the trial request is taken
+	assert.Equal(t, "a", vs.getPeer(keys[0]))
+	for _, key := range keys {
+		peer := vs.getPeer(key)
+		assert.NotEqual(t, "", peer)
+		assert.NotEqual(t, "a", peer)
+	}
+}
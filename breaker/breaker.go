@@ -0,0 +1,323 @@
+package breaker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+// Defaults of circuit breaker.
+const (
+	DefaultFailureThreshold = 5
+	DefaultOpenTimeout      = 10 * time.Second
+	DefaultMaxOpenTimeout   = 300 * time.Second
+	DefaultHalfOpenRequests = 1
+
+	// maxHistory is the number of transitions kept per peer.
+	maxHistory = 20
+	// tick is the interval of checking the open breakers.
+	tick = time.Second
+)
+
+// State of a breaker.
+type State int
+
+// States of a breaker.
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// Transition is a change of the state.
+type Transition struct {
+	Time time.Time `json:"time"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+}
+
+// Status is the state and the transition history of a breaker.
+type Status struct {
+	State   string       `json:"state"`
+	Until   *time.Time   `json:"until,omitempty"`
+	History []Transition `json:"history"`
+}
+
+// breaker is the state machine of a peer.
+type breaker struct {
+	state     State
+	failures  int
+	inflight  int
+	successes int
+	// the times of opening in a row, used for backoff
+	openTimes int
+	until     time.Time
+	history   []Transition
+}
+
+func (b *breaker) setState(to State, now time.Time) {
+	b.history = append(b.history, Transition{Time: now, From: b.state.String(), To: to.String()})
+	if len(b.history) > maxHistory {
+		b.history = b.history[len(b.history)-maxHistory:]
+	}
+	b.state = to
+	b.failures = 0
+	b.inflight = 0
+	b.successes = 0
+}
+
+// Group is the breakers of the peers of a pool.
+type Group struct {
+	sync.Mutex
+	failureThreshold int
+	openTimeout      time.Duration
+	maxOpenTimeout   time.Duration
+	halfOpenRequests int
+
+	breakers map[string]*breaker
+	onChange func(addr string, open bool)
+	stopC    chan struct{}
+}
+
+// New returns a Group object, onChange is called when a breaker opens, or
+// turns half-open so that the peer takes trial requests.
+func New(cfg *config.CircuitBreaker, onChange func(addr string, open bool)) (*Group, error) {
+	g := &Group{
+		failureThreshold: DefaultFailureThreshold,
+		openTimeout:      DefaultOpenTimeout,
+		maxOpenTimeout:   DefaultMaxOpenTimeout,
+		halfOpenRequests: DefaultHalfOpenRequests,
+		breakers:         map[string]*breaker{},
+		onChange:         onChange,
+	}
+	if cfg.FailureThreshold > 0 {
+		g.failureThreshold = cfg.FailureThreshold
+	}
+	if cfg.OpenTimeout > 0 {
+		g.openTimeout = time.Duration(cfg.OpenTimeout) * time.Second
+	}
+	if cfg.MaxOpenTimeout > 0 {
+		g.maxOpenTimeout = time.Duration(cfg.MaxOpenTimeout) * time.Second
+	}
+	if cfg.HalfOpenRequests > 0 {
+		g.halfOpenRequests = cfg.HalfOpenRequests
+	}
+	if g.openTimeout > g.maxOpenTimeout {
+		return nil, fmt.Errorf("open timeout %v is longer than max open timeout %v",
+			g.openTimeout, g.maxOpenTimeout)
+	}
+	return g, nil
+}
+
+// Add creates a closed breaker for the peer.
+func (g *Group) Add(addr string) {
+	g.Lock()
+	defer g.Unlock()
+	if _, ok := g.breakers[addr]; !ok {
+		g.breakers[addr] = &breaker{}
+	}
+}
+
+// Remove removes the breaker of the peer.
+func (g *Group) Remove(addr string) {
+	g.Lock()
+	defer g.Unlock()
+	delete(g.breakers, addr)
+}
+
+// State returns the state of the breaker of the peer.
+func (g *Group) State(addr string) State {
+	g.Lock()
+	defer g.Unlock()
+	if b, ok := g.breakers[addr]; ok {
+		return b.state
+	}
+	return Closed
+}
+
+// Allow returns true if the peer may take the request, and the result
+// must be reported.
+func (g *Group) Allow(addr string) bool {
+	g.Lock()
+	defer g.Unlock()
+	b, ok := g.breakers[addr]
+	if !ok {
+		return true
+	}
+	switch b.state {
+	case Open:
+		return false
+	case HalfOpen:
+		if b.inflight+b.successes >= g.halfOpenRequests {
+			return false
+		}
+		b.inflight++
+	}
+	return true
+}
+
+// Report records the result of a request admitted by Allow.
+func (g *Group) Report(addr string, success bool) {
+	opened := false
+
+	g.Lock()
+	b, ok := g.breakers[addr]
+	if !ok {
+		g.Unlock()
+		return
+	}
+	now := time.Now()
+	switch b.state {
+	case Closed:
+		if success {
+			b.failures = 0
+			break
+		}
+		b.failures++
+		if b.failures >= g.failureThreshold {
+			g.open(addr, b, now)
+			opened = true
+		}
+	case HalfOpen:
+		if b.inflight > 0 {
+			b.inflight--
+		}
+		if !success {
+			g.open(addr, b, now)
+			opened = true
+			break
+		}
+		b.successes++
+		if b.successes >= g.halfOpenRequests {
+			b.openTimes = 0
+			b.setState(Closed, now)
+			log.Infof("Circuit breaker: close peer %s", addr)
+		}
+	}
+	g.Unlock()
+
+	if opened && g.onChange != nil {
+		g.onChange(addr, true)
+	}
+}
+
+// open opens the breaker with the backoff timeout, it must be called with lock.
+func (g *Group) open(addr string, b *breaker, now time.Time) {
+	timeout := g.openTimeout
+	for i := 0; i < b.openTimes && timeout < g.maxOpenTimeout; i++ {
+		timeout *= 2
+	}
+	if timeout > g.maxOpenTimeout {
+		timeout = g.maxOpenTimeout
+	}
+	b.openTimes++
+	b.until = now.Add(timeout)
+	b.setState(Open, now)
+	log.Infof("Circuit breaker: open peer %s for %v", addr, timeout)
+}
+
+// evaluate turns the expired open breakers half-open.
+func (g *Group) evaluate(now time.Time) {
+	halfOpen := []string{}
+	g.Lock()
+	for addr, b := range g.breakers {
+		if b.state == Open && !now.Before(b.until) {
+			b.setState(HalfOpen, now)
+			halfOpen = append(halfOpen, addr)
+			log.Infof("Circuit breaker: half-open peer %s", addr)
+		}
+	}
+	g.Unlock()
+
+	if g.onChange != nil {
+		for _, addr := range halfOpen {
+			g.onChange(addr, false)
+		}
+	}
+}
+
+// Status returns the state and the transition history of the breakers.
+func (g *Group) Status() map[string]*Status {
+	g.Lock()
+	defer g.Unlock()
+	result := make(map[string]*Status, len(g.breakers))
+	for addr, b := range g.breakers {
+		s := &Status{
+			State:   b.state.String(),
+			History: append([]Transition{}, b.history...),
+		}
+		if b.state == Open {
+			until := b.until
+			s.Until = &until
+		}
+		result[addr] = s
+	}
+	return result
+}
+
+// String lists the state of the breakers.
+func (g *Group) String() string {
+	status := g.Status()
+	keys := []string{}
+	for key := range status {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := []string{"circuit breaker:"}
+	for _, key := range keys {
+		result = append(result, fmt.Sprintf("%s: %s", key, status[key].State))
+	}
+	return strings.Join(result, "\n")
+}
+
+// Start checks the open breakers in background.
+func (g *Group) Start() {
+	g.Lock()
+	defer g.Unlock()
+	if g.stopC != nil {
+		return
+	}
+	g.stopC = make(chan struct{})
+	go g.run(g.stopC)
+}
+
+// Stop stops checking.
+func (g *Group) Stop() {
+	g.Lock()
+	defer g.Unlock()
+	if g.stopC != nil {
+		close(g.stopC)
+		g.stopC = nil
+	}
+}
+
+func (g *Group) run(stopC chan struct{}) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopC:
+			return
+		case now := <-ticker.C:
+			g.evaluate(now)
+		}
+	}
+}
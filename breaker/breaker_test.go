@@ -0,0 +1,100 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestNewError(t *testing.T) {
+	_, err := New(&config.CircuitBreaker{OpenTimeout: 60, MaxOpenTimeout: 30}, nil)
+	assert.EqualError(t, err, "open timeout 1m0s is longer than max open timeout 30s")
+}
+
+func TestStateMachine(t *testing.T) {
+	changes := []bool{}
+	g, err := New(&config.CircuitBreaker{FailureThreshold: 2, HalfOpenRequests: 2}, func(addr string, open bool) {
+		assert.Equal(t, "a", addr)
+		changes = append(changes, open)
+	})
+	require.NoError(t, err)
+	g.Add("a")
+	assert.Equal(t, Closed, g.State("a"))
+
+	// failures in a row
+	g.Report("a", false)
+	g.Report("a", true)
+	g.Report("a", false)
+	assert.Equal(t, Closed, g.State("a"))
+	g.Report("a", false)
+	assert.Equal(t, Open, g.State("a"))
+	assert.False(t, g.Allow("a"))
+
+	until := g.breakers["a"].until
+	g.evaluate(until.Add(-time.Second))
+	assert.Equal(t, Open, g.State("a"))
+	g.evaluate(until)
+	assert.Equal(t, HalfOpen, g.State("a"))
+
+	// limited trial requests
+	assert.True(t, g.Allow("a"))
+	assert.True(t, g.Allow("a"))
+	assert.False(t, g.Allow("a"))
+	g.Report("a", true)
+	assert.False(t, g.Allow("a"))
+	assert.Equal(t, HalfOpen, g.State("a"))
+	g.Report("a", true)
+	assert.Equal(t, Closed, g.State("a"))
+	assert.Equal(t, []bool{true, false}, changes)
+
+	status := g.Status()["a"]
+	assert.Equal(t, "closed", status.State)
+	assert.Nil(t, status.Until)
+	assert.Equal(t, 3, len(status.History))
+	assert.Equal(t, "circuit breaker:\na: closed", g.String())
+}
+
+func TestBackoff(t *testing.T) {
+	g, err := New(&config.CircuitBreaker{FailureThreshold: 1, OpenTimeout: 10, MaxOpenTimeout: 30}, nil)
+	require.NoError(t, err)
+	g.Add("a")
+	b := g.breakers["a"]
+
+	for _, expected := range []time.Duration{10, 20, 30, 30} {
+		now := time.Now()
+		g.Report("a", false)
+		assert.Equal(t, Open, g.State("a"))
+		assert.InDelta(t, float64(expected*time.Second), float64(b.until.Sub(now)), float64(time.Second))
+		assert.NotNil(t, g.Status()["a"].Until)
+
+		g.evaluate(b.until)
+		assert.True(t, g.Allow("a"))
+	}
+
+	// the backoff is reset once closed
+	g.Report("a", true)
+	g.Report("a", false)
+	assert.InDelta(t, float64(10*time.Second), float64(time.Until(b.until)), float64(time.Second))
+}
+
+func TestHistory(t *testing.T) {
+	g, err := New(&config.CircuitBreaker{FailureThreshold: 1}, nil)
+	require.NoError(t, err)
+	g.Add("a")
+	for i := 0; i < maxHistory; i++ {
+		g.Report("a", false)
+		g.evaluate(g.breakers["a"].until)
+	}
+	history := g.Status()["a"].History
+	assert.Equal(t, maxHistory, len(history))
+	assert.Equal(t, "half-open", history[0].From)
+
+	g.Remove("a")
+	assert.True(t, g.Allow("a"))
+	g.Report("a", false)
+	assert.Equal(t, Closed, g.State("a"))
+}
@@ -0,0 +1,10 @@
+// Package breaker provides per peer circuit breaker
+//
+// A breaker is closed at first, and opens after failure_threshold failed
+// requests in a row, the peer takes no request until open_timeout passes.
+// Then the breaker is half-open and admits at most half_open_requests trial
+// requests, it closes once all of them succeed, and opens again on any
+// failure with the open timeout doubled up to max_open_timeout.
+//
+// Reference: https://martinfowler.com/bliki/CircuitBreaker.html
+package breaker
@@ -3,16 +3,24 @@ package chash
 import (
 	"fmt"
 	"hash/crc32"
+	"math"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
+// DefaultReplica is the number of virtual nodes of a peer with weight 1.
+const DefaultReplica = 20
+
 // Peer defines a single server.
 type Peer struct {
 	sync.RWMutex
-	addr string
-	down bool
+	addr   string
+	weight int
+	down   bool
+	// in-flight requests
+	load int64
 }
 
 // Pool is a set of Peers.
@@ -21,17 +29,29 @@ type Pool struct {
 	replica      int
 	vNodes       map[uint32]*Peer
 	sortedHashes []uint32
-	nodes        map[string]bool
+	nodes        map[string]*Peer
 	downNum      int
+
+	// epsilon of consistent hashing with bounded loads, 0 means unbounded
+	epsilon   float64
+	totalLoad int64
 }
 
 // New returns a Pool object.
 func New() *Pool {
+	return NewWithReplica(DefaultReplica)
+}
+
+// NewWithReplica returns a Pool object, each peer has replica*weight virtual nodes.
+func NewWithReplica(replica int) *Pool {
+	if replica <= 0 {
+		replica = DefaultReplica
+	}
 	return &Pool{
-		replica:      20,
+		replica:      replica,
 		vNodes:       map[uint32]*Peer{},
 		sortedHashes: []uint32{},
-		nodes:        map[string]bool{},
+		nodes:        map[string]*Peer{},
 		downNum:      0,
 	}
 }
@@ -46,14 +66,41 @@ func (p *Pool) hash(key string) uint32 {
 	return h.Sum32()
 }
 
+// distribution returns the share of the hash space owned by each peer.
+func (p *Pool) distribution() map[string]float64 {
+	result := map[string]float64{}
+	size := len(p.sortedHashes)
+	if size == 0 {
+		return result
+	}
+	// the virtual node owns the keys in (previous hash, its hash]
+	prev := int64(p.sortedHashes[size-1]) - (1 << 32)
+	for _, h := range p.sortedHashes {
+		result[p.vNodes[h].addr] += float64(int64(h)-prev) / (1 << 32)
+		prev = int64(h)
+	}
+	return result
+}
+
+// String lists the peers with their weight, virtual nodes and share of keys.
 func (p *Pool) String() string {
 	p.RLock()
 	defer p.RUnlock()
-	result := []string{}
+	dist := p.distribution()
+	vnodes := map[string]int{}
+	for _, peer := range p.vNodes {
+		vnodes[peer.addr]++
+	}
+	keys := []string{}
 	for key := range p.nodes {
-		result = append(result, key)
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := []string{}
+	for _, key := range keys {
+		result = append(result, fmt.Sprintf("%s(w=%d, vnodes=%d, keys=%.2f%%)",
+			key, p.nodes[key].weight, vnodes[key], dist[key]*100))
 	}
-	sort.Strings(result)
 	return strings.Join(result, ", ")
 }
 
@@ -61,22 +108,34 @@ func (p *Pool) String() string {
 func (p *Pool) Size() int {
 	p.RLock()
 	defer p.RUnlock()
-	return len(p.sortedHashes) / p.replica
+	return len(p.nodes)
 }
 
-// Add adds a peer by address.
+// Add adds a peer by address, the number of its virtual nodes is
+// proportional to the weight in args[0].
 func (p *Pool) Add(addr string, args ...interface{}) {
+	weight := 1
+	if len(args) > 0 {
+		if w, ok := args[0].(int); ok && w > 0 {
+			weight = w
+		}
+	}
+
 	p.Lock()
 	defer p.Unlock()
 
 	if _, ok := p.nodes[addr]; ok {
 		return
 	}
-	p.nodes[addr] = true
-	peer := &Peer{addr: addr, down: false}
+	peer := &Peer{addr: addr, weight: weight, down: false}
+	p.nodes[addr] = peer
 
-	for i := 0; i < p.replica; i++ {
+	for i := 0; i < p.replica*weight; i++ {
 		h := p.hash(p.vKey(peer.addr, i))
+		if _, ok := p.vNodes[h]; ok {
+			// hash collision, the virtual node is owned by the former peer
+			continue
+		}
 		p.vNodes[h] = peer
 		p.sortedHashes = append(p.sortedHashes, h)
 	}
@@ -91,38 +150,35 @@ func (p *Pool) Remove(peerAddr string) {
 	p.Lock()
 	defer p.Unlock()
 
-	if _, ok := p.nodes[peerAddr]; !ok {
+	peer, ok := p.nodes[peerAddr]
+	if !ok {
 		return
 	}
-
-	deleteSortedHashes := func(target uint32) {
-		for idx, val := range p.sortedHashes {
-			if val == target {
-				p.sortedHashes = append(p.sortedHashes[:idx], p.sortedHashes[idx+1:]...)
-			}
-		}
+	if peer.down {
+		p.downNum--
 	}
+	atomic.AddInt64(&p.totalLoad, -atomic.LoadInt64(&peer.load))
+	delete(p.nodes, peerAddr)
 
-	for i := 0; i < p.replica; i++ {
-		h := p.hash(p.vKey(peerAddr, i))
-		if p.vNodes[h].down {
-			p.downNum--
+	hashes := p.sortedHashes[:0]
+	for _, h := range p.sortedHashes {
+		if p.vNodes[h] == peer {
+			delete(p.vNodes, h)
+			continue
 		}
-		delete(p.vNodes, h)
-		deleteSortedHashes(h)
+		hashes = append(hashes, h)
 	}
+	p.sortedHashes = hashes
 }
 
 func (p *Pool) setPeerStatus(peerAddr string, isDown bool) {
 	p.Lock()
 	defer p.Unlock()
 
-	if _, ok := p.nodes[peerAddr]; !ok {
+	peer, ok := p.nodes[peerAddr]
+	if !ok {
 		return
 	}
-	idx := 1
-	h := p.hash(p.vKey(peerAddr, idx))
-	peer := p.vNodes[h]
 	if peer.down != isDown {
 		if isDown {
 			p.downNum++
@@ -145,9 +201,53 @@ func (p *Pool) UpPeer(addr string) {
 	p.setPeerStatus(addr, false)
 }
 
+// SetBoundedLoad sets epsilon of consistent hashing with bounded loads,
+// a peer is skipped if its in-flight requests exceed (1+epsilon) * average.
+func (p *Pool) SetBoundedLoad(epsilon float64) {
+	p.Lock()
+	defer p.Unlock()
+	if epsilon < 0 {
+		epsilon = 0
+	}
+	p.epsilon = epsilon
+}
+
+// Acquire increases the in-flight requests of the peer.
+func (p *Pool) Acquire(addr string) {
+	p.RLock()
+	defer p.RUnlock()
+	if peer, ok := p.nodes[addr]; ok {
+		atomic.AddInt64(&peer.load, 1)
+		atomic.AddInt64(&p.totalLoad, 1)
+	}
+}
+
+// Release decreases the in-flight requests of the peer.
+func (p *Pool) Release(addr string) {
+	p.RLock()
+	defer p.RUnlock()
+	if peer, ok := p.nodes[addr]; ok && atomic.LoadInt64(&peer.load) > 0 {
+		atomic.AddInt64(&peer.load, -1)
+		atomic.AddInt64(&p.totalLoad, -1)
+	}
+}
+
+// maxLoad returns the capacity of each peer, including the coming request.
+func (p *Pool) maxLoad() int64 {
+	upNum := len(p.nodes) - p.downNum
+	avg := float64(atomic.LoadInt64(&p.totalLoad)+1) / float64(upNum)
+	return int64(math.Ceil(avg * (1 + p.epsilon)))
+}
+
 // Get use a key to map the backend server
 // key may be a cookie or request_uri
 func (p *Pool) Get(args ...interface{}) string {
+	return p.GetExcluding(nil, args...)
+}
+
+// GetExcluding is Get but skips the excluded peers on the ring, the key is
+// mapped to the next available peer clockwise.
+func (p *Pool) GetExcluding(exclude map[string]bool, args ...interface{}) string {
 	if len(args) == 0 {
 		return ""
 	}
@@ -160,18 +260,38 @@ func (p *Pool) Get(args ...interface{}) string {
 	p.RLock()
 	defer p.RUnlock()
 
-	if len(p.vNodes) <= 0 || p.downNum >= p.Size() {
+	if len(p.vNodes) <= 0 || p.downNum >= len(p.nodes) {
 		return ""
 	}
 
 	h := p.hash(key)
-	idx := sort.Search(len(p.sortedHashes), func(i int) bool {
-		return p.sortedHashes[i] >= h && !p.vNodes[p.sortedHashes[i]].down
+	size := len(p.sortedHashes)
+	start := sort.Search(size, func(i int) bool {
+		return p.sortedHashes[i] >= h
 	})
-	if idx >= len(p.sortedHashes) {
-		idx = 0
+
+	var limit int64
+	if p.epsilon > 0 {
+		limit = p.maxLoad()
+	}
+	// walk clockwise to the first available peer
+	var first *Peer
+	for i := 0; i < size; i++ {
+		peer := p.vNodes[p.sortedHashes[(start+i)%size]]
+		if peer.down || exclude[peer.addr] {
+			continue
+		}
+		if limit == 0 || atomic.LoadInt64(&peer.load)+1 <= limit {
+			return peer.addr
+		}
+		if first == nil {
+			first = peer
+		}
 	}
-	return p.vNodes[p.sortedHashes[idx]].addr
+	if first != nil {
+		return first.addr
+	}
+	return ""
 }
 
 // CreatePool returns a Pool object.
@@ -183,3 +303,14 @@ func CreatePool(addrs []string) *Pool {
 
 	return pool
 }
+
+// CreateWeightedPool returns a Pool object with weighted peers.
+// Use SetBoundedLoad to enable consistent hashing with bounded loads.
+func CreateWeightedPool(pairs map[string]int, replica int) *Pool {
+	pool := NewWithReplica(replica)
+	for addr, weight := range pairs {
+		pool.Add(addr, weight)
+	}
+
+	return pool
+}
@@ -140,3 +140,112 @@ func TestDownPeer(t *testing.T) {
 		assert.Equal(t, "", result, fmt.Sprintf("%d. got %q, expected '' after down all", i, result))
 	}
 }
+
+func TestWeightedPool(t *testing.T) {
+	pool := CreateWeightedPool(map[string]int{"1.1.1.1": 1, "2.2.2.2": 2, "3.3.3.3": 0}, 50)
+	t.Logf("%v", pool)
+	assert.Equal(t, 3, pool.Size())
+	assert.Equal(t, 50*4, len(pool.sortedHashes))
+	assert.Equal(t, 1, pool.nodes["3.3.3.3"].weight)
+
+	dist := pool.distribution()
+	total := 0.0
+	for _, share := range dist {
+		total += share
+	}
+	assert.InDelta(t, 1.0, total, 1e-9)
+
+	result := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		result[pool.Get(fmt.Sprintf("key-%d", i))]++
+	}
+	t.Logf("%v", result)
+	assert.True(t, result["2.2.2.2"] > result["1.1.1.1"])
+	assert.True(t, result["2.2.2.2"] > result["3.3.3.3"])
+}
+
+func TestReplica(t *testing.T) {
+	pool := NewWithReplica(0)
+	assert.Equal(t, DefaultReplica, pool.replica)
+
+	pool = NewWithReplica(100)
+	pool.Add("1.1.1.1", 3)
+	assert.Equal(t, 300, len(pool.sortedHashes))
+	assert.Equal(t, "1.1.1.1(w=3, vnodes=300, keys=100.00%)", pool.String())
+}
+
+func TestRemoveAndAddAgain(t *testing.T) {
+	pool := CreatePool([]string{"1.1.1.1", "2.2.2.2"})
+	pool.DownPeer("1.1.1.1")
+	assert.Equal(t, 1, pool.downNum)
+
+	pool.Remove("1.1.1.1")
+	assert.Equal(t, 1, pool.Size())
+	assert.Equal(t, 0, pool.downNum)
+	assert.Equal(t, pool.replica, len(pool.sortedHashes))
+	assert.Equal(t, pool.replica, len(pool.vNodes))
+
+	pool.Add("1.1.1.1", 2)
+	assert.Equal(t, 2, pool.Size())
+	assert.Equal(t, pool.replica*3, len(pool.sortedHashes))
+}
+
+func TestBoundedLoad(t *testing.T) {
+	pool := CreatePool([]string{"1.1.1.1", "2.2.2.2", "3.3.3.3"})
+	key := "/redis-B"
+	owner := pool.Get(key)
+	assert.Equal(t, "1.1.1.1", owner)
+
+	// unbounded, the hot key always sticks to its owner
+	for i := 0; i < 10; i++ {
+		pool.Acquire(pool.Get(key))
+	}
+	assert.Equal(t, owner, pool.Get(key))
+	for i := 0; i < 10; i++ {
+		pool.Release(owner)
+	}
+	assert.Equal(t, int64(0), pool.totalLoad)
+
+	pool.SetBoundedLoad(0.5)
+	result := map[string]int{}
+	for i := 0; i < 12; i++ {
+		peer := pool.Get(key)
+		pool.Acquire(peer)
+		result[peer]++
+	}
+	t.Logf("%v", result)
+	// ceil(12/3 * 1.5) = 6
+	assert.Equal(t, 6, result[owner])
+	assert.Equal(t, 12, result["1.1.1.1"]+result["2.2.2.2"]+result["3.3.3.3"])
+	assert.True(t, result["2.2.2.2"] <= 6)
+	assert.True(t, result["3.3.3.3"] <= 6)
+
+	// the removed peer takes its load away
+	pool.Remove(owner)
+	assert.Equal(t, int64(6), pool.totalLoad)
+
+	pool.SetBoundedLoad(-1)
+	assert.Equal(t, 0.0, pool.epsilon)
+}
+
+func TestBoundedLoadAllDown(t *testing.T) {
+	pool := CreatePool([]string{"1.1.1.1", "2.2.2.2"})
+	pool.SetBoundedLoad(0.25)
+	pool.DownPeer("1.1.1.1")
+	for i := 0; i < 5; i++ {
+		pool.Acquire(pool.Get("any"))
+	}
+	assert.Equal(t, "2.2.2.2", pool.Get("any"))
+
+	pool.DownPeer("2.2.2.2")
+	assert.Equal(t, "", pool.Get("any"))
+}
+
+func TestGetExcluding(t *testing.T) {
+	pool := CreatePool([]string{"1.1.1.1", "2.2.2.2", "3.3.3.3"})
+	assert.Equal(t, "1.1.1.1", pool.GetExcluding(nil, "/redis-B"))
+	// the excluded peer is skipped like a down one
+	assert.Equal(t, "3.3.3.3", pool.GetExcluding(map[string]bool{"1.1.1.1": true}, "/redis-B"))
+	assert.Equal(t, "2.2.2.2", pool.GetExcluding(map[string]bool{"1.1.1.1": true, "3.3.3.3": true}, "/redis-B"))
+	assert.Equal(t, "", pool.GetExcluding(map[string]bool{"1.1.1.1": true, "2.2.2.2": true, "3.3.3.3": true}, "/redis-B"))
+}
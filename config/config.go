@@ -3,6 +3,7 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -16,24 +17,157 @@ var (
 	ErrPoolMemberDuplicated      = errors.New("pool member duplicated")
 	ErrVirtualServerNameEmpty    = errors.New("vritual server name is not specified")
 	ErrVirtualServerAddressEmpty = errors.New("vritual server address is not specified")
+	ErrPoolMemberPriority        = errors.New("pool member priority is negative")
+	ErrPoolMemberScheme          = errors.New("pool member address of tcp and udp has no scheme")
+	ErrPoolMemberTLS             = errors.New("pool member of h2c upstream does not speak https")
+	ErrRouteNameEmpty            = errors.New("route name is not specified")
+	ErrRouteDuplicated           = errors.New("route duplicated")
+	ErrPoolNameEmpty             = errors.New("pool name is not specified")
+	ErrPoolDuplicated            = errors.New("pool duplicated")
 )
 
 // Server configuration.
 type Server struct {
-	Address string `json:"address" yaml:"address"`
-	Weight  int    `json:"weight" yaml:"weight"`
+	Address  string `json:"address" yaml:"address"`
+	Weight   int    `json:"weight" yaml:"weight"`
+	Priority int    `json:"priority" yaml:"priority"`
+	Backup   bool   `json:"backup" yaml:"backup"`
+}
+
+// PriorityLevel returns the priority of the server, lower value means higher
+// priority. A backup server without priority is at level 1.
+func (s *Server) PriorityLevel() int {
+	if s.Backup && s.Priority == 0 {
+		return 1
+	}
+	return s.Priority
+}
+
+// HealthCheck configuration of active health check.
+type HealthCheck struct {
+	Type               string `json:"type" yaml:"type"`
+	Path               string `json:"path" yaml:"path"`
+	Status             string `json:"status" yaml:"status"`
+	Body               string `json:"body" yaml:"body"`
+	GRPCService        string `json:"grpc_service" yaml:"grpc_service"`
+	Interval           int    `json:"interval" yaml:"interval"`
+	Timeout            int    `json:"timeout" yaml:"timeout"`
+	HealthyThreshold   int    `json:"healthy_threshold" yaml:"healthy_threshold"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold" yaml:"unhealthy_threshold"`
+}
+
+// OutlierDetection configuration of ejecting the peers with abnormal errors.
+type OutlierDetection struct {
+	Consecutive5xx            int     `json:"consecutive_5xx" yaml:"consecutive_5xx"`
+	ConsecutiveGatewayFailure int     `json:"consecutive_gateway_failure" yaml:"consecutive_gateway_failure"`
+	Interval                  int     `json:"interval" yaml:"interval"`
+	BaseEjectionTime          int     `json:"base_ejection_time" yaml:"base_ejection_time"`
+	MaxEjectionTime           int     `json:"max_ejection_time" yaml:"max_ejection_time"`
+	MaxEjectionPercent        int     `json:"max_ejection_percent" yaml:"max_ejection_percent"`
+	SuccessRateMinimumHosts   int     `json:"success_rate_minimum_hosts" yaml:"success_rate_minimum_hosts"`
+	SuccessRateRequestVolume  int     `json:"success_rate_request_volume" yaml:"success_rate_request_volume"`
+	SuccessRateStdevFactor    float64 `json:"success_rate_stdev_factor" yaml:"success_rate_stdev_factor"`
+}
+
+// PassiveHealth configuration of marking the peer down by the failed requests.
+type PassiveHealth struct {
+	MaxFails    int      `json:"max_fails" yaml:"max_fails"`
+	FailTimeout int      `json:"fail_timeout" yaml:"fail_timeout"`
+	FailOn      []string `json:"fail_on" yaml:"fail_on"`
+}
+
+// CircuitBreaker configuration of per peer circuit breaker.
+type CircuitBreaker struct {
+	FailureThreshold int `json:"failure_threshold" yaml:"failure_threshold"`
+	OpenTimeout      int `json:"open_timeout" yaml:"open_timeout"`
+	MaxOpenTimeout   int `json:"max_open_timeout" yaml:"max_open_timeout"`
+	HalfOpenRequests int `json:"half_open_requests" yaml:"half_open_requests"`
+}
+
+// Certificate configuration of a key pair.
+type Certificate struct {
+	CertFile string `json:"cert_file" yaml:"cert_file"`
+	KeyFile  string `json:"key_file" yaml:"key_file"`
+}
+
+// UpstreamTLS configuration of speaking TLS to the peers.
+type UpstreamTLS struct {
+	Enable             bool   `json:"enable" yaml:"enable"`
+	CAFile             string `json:"ca_file" yaml:"ca_file"`
+	CertFile           string `json:"cert_file" yaml:"cert_file"`
+	KeyFile            string `json:"key_file" yaml:"key_file"`
+	ServerName         string `json:"server_name" yaml:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+}
+
+// HeaderRules configuration, the values may have the variables $remote_ip,
+// $remote_addr, $scheme, $host, $peer, $vs_name, $route and $request_id,
+// and "$$" is a literal "$". Setting the request header "Host" sets the host
+// of the upstream request, and X-Forwarded-For cannot be removed. The
+// response rules apply to the errors of the balancer as well.
+type HeaderRules struct {
+	SetRequest     map[string]string `json:"set_request,omitempty" yaml:"set_request"`
+	AddRequest     map[string]string `json:"add_request,omitempty" yaml:"add_request"`
+	RemoveRequest  []string          `json:"remove_request,omitempty" yaml:"remove_request"`
+	SetResponse    map[string]string `json:"set_response,omitempty" yaml:"set_response"`
+	RemoveResponse []string          `json:"remove_response,omitempty" yaml:"remove_response"`
+}
+
+// Pool configuration of a named pool, which the routes refer to by name.
+// The LB method is the one of the virtual server by default.
+type Pool struct {
+	Name     string   `json:"name" yaml:"name"`
+	LBMethod string   `json:"lb_method,omitempty" yaml:"lb_method"`
+	Members  []Server `json:"members" yaml:"members"`
+}
+
+// Route configuration, the requests matching the path, the methods and the
+// headers are balanced over the named pool of the route, or the pool of the
+// virtual server if not set. The path is matched by one of prefix, exact
+// and regex, or any path if none is set.
+type Route struct {
+	Name    string            `json:"name" yaml:"name"`
+	Prefix  string            `json:"prefix,omitempty" yaml:"prefix"`
+	Exact   string            `json:"exact,omitempty" yaml:"exact"`
+	Regex   string            `json:"regex,omitempty" yaml:"regex"`
+	Methods []string          `json:"methods,omitempty" yaml:"methods"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers"`
+	Pool    string            `json:"pool,omitempty" yaml:"pool"`
+
+	HeaderRules *HeaderRules `json:"header_rules,omitempty" yaml:"header_rules"`
 }
 
 // VirtualServer configuration.
 type VirtualServer struct {
-	Name       string   `json:"name" yaml:"name"`
-	Address    string   `json:"address" yaml:"address"`
-	ServerName string   `json:"server_name" yaml:"server_name"`
-	Protocol   string   `json:"protocol" yaml:"protocol"`
-	CertFile   string   `json:"cert_file" yaml:"cert_file"`
-	KeyFile    string   `json:"key_file" yaml:"key_file"`
-	LBMethod   string   `json:"lb_method" yaml:"lb_method"`
-	Pool       []Server `json:"pool" yaml:"pool"`
+	Name               string        `json:"name" yaml:"name"`
+	Address            string        `json:"address" yaml:"address"`
+	ServerName         string        `json:"server_name" yaml:"server_name"`
+	DefaultServer      bool          `json:"default_server" yaml:"default_server"`
+	Protocol           string        `json:"protocol" yaml:"protocol"`
+	CertFile           string        `json:"cert_file" yaml:"cert_file"`
+	KeyFile            string        `json:"key_file" yaml:"key_file"`
+	Certificates       []Certificate `json:"certificates" yaml:"certificates"`
+	MinTLSVersion      string        `json:"min_tls_version" yaml:"min_tls_version"`
+	CipherSuites       []string      `json:"cipher_suites" yaml:"cipher_suites"`
+	CertReloadInterval int           `json:"cert_reload_interval" yaml:"cert_reload_interval"`
+	LBMethod           string        `json:"lb_method" yaml:"lb_method"`
+	HashKey            string        `json:"hash_key" yaml:"hash_key"`
+	Replica            int           `json:"replica" yaml:"replica"`
+	BoundedLoad        float64       `json:"bounded_load" yaml:"bounded_load"`
+	SlowStart          int           `json:"slow_start" yaml:"slow_start"`
+	IdleTimeout        int           `json:"idle_timeout" yaml:"idle_timeout"`
+	H2C                bool          `json:"h2c" yaml:"h2c"`
+	UpstreamProtocol   string        `json:"upstream_protocol" yaml:"upstream_protocol"`
+	Pool               []Server      `json:"pool" yaml:"pool"`
+	Pools              []Pool        `json:"pools" yaml:"pools"`
+	Routes             []Route       `json:"routes" yaml:"routes"`
+
+	PassiveHealth    `yaml:",inline"`
+	HealthCheck      *HealthCheck      `json:"health_check" yaml:"health_check"`
+	OutlierDetection *OutlierDetection `json:"outlier_detection" yaml:"outlier_detection"`
+	CircuitBreaker   *CircuitBreaker   `json:"circuit_breaker" yaml:"circuit_breaker"`
+	UpstreamTLS      *UpstreamTLS      `json:"upstream_tls" yaml:"upstream_tls"`
+	HeaderRules      *HeaderRules      `json:"header_rules" yaml:"header_rules"`
 }
 
 // Authentication configuration.
@@ -129,7 +263,8 @@ func LoadFromString(config string) (*Configuration, error) {
 
 func (c *Configuration) check() error {
 	set := make(map[string]bool)
-	for _, vs := range c.VServers {
+	listens := []*Listen{}
+	for i, vs := range c.VServers {
 		if vs.Name == "" {
 			return ErrVirtualServerNameEmpty
 		}
@@ -143,6 +278,53 @@ func (c *Configuration) check() error {
 		}
 		set[vs.Name] = true
 
+		for _, p := range vs.Pool {
+			if err := vs.checkMember(p); err != nil {
+				return err
+			}
+		}
+
+		l, err := vs.listen()
+		if err != nil {
+			return err
+		}
+		for _, other := range listens[:i] {
+			if err := CheckShared(other, l); err != nil {
+				return err
+			}
+		}
+		listens = append(listens, l)
+
+		npset := make(map[string]bool)
+		for _, np := range vs.Pools {
+			if np.Name == "" {
+				return ErrPoolNameEmpty
+			}
+			if npset[np.Name] {
+				return ErrPoolDuplicated
+			}
+			npset[np.Name] = true
+			for _, p := range np.Members {
+				if err := vs.checkMember(p); err != nil {
+					return err
+				}
+			}
+		}
+
+		rset := make(map[string]bool)
+		for _, r := range vs.Routes {
+			if r.Name == "" {
+				return ErrRouteNameEmpty
+			}
+			if rset[r.Name] {
+				return ErrRouteDuplicated
+			}
+			rset[r.Name] = true
+			if r.Pool != "" && !npset[r.Pool] {
+				return fmt.Errorf("route %s pool '%s' is not found", r.Name, r.Pool)
+			}
+		}
+
 		if len(vs.Pool) > 1 {
 			pset := make(map[string]bool)
 			for _, p := range vs.Pool {
@@ -155,3 +337,103 @@ func (c *Configuration) check() error {
 	}
 	return nil
 }
+
+// Listen describes a virtual server on its listen address, the virtual
+// servers of the same address share the listener, which dispatches the
+// requests by host.
+type Listen struct {
+	Name     string
+	Address  string
+	Protocol string
+	// the listener is not shared, e.g. tcp and udp
+	Exclusive bool
+	// the udp socket does not conflict with the tcp listener
+	Datagram      bool
+	TLS           bool
+	H2C           bool
+	DefaultServer bool
+	// the parsed server names, ".example.com" is both "example.com" and
+	// "*.example.com"
+	ServerNames []string
+}
+
+// CheckShared returns the error if the virtual servers cannot share the
+// address, they share it if none is exclusive, they agree on TLS and h2c,
+// and no server name or default server is duplicated.
+func CheckShared(l, o *Listen) error {
+	if l.Address != o.Address || l.Datagram != o.Datagram {
+		return nil
+	}
+	conflict := func(reason string) error {
+		return fmt.Errorf("virtual server %s conflicts with %s on %s, %s", o.Name, l.Name, l.Address, reason)
+	}
+	for _, v := range []*Listen{l, o} {
+		if v.Exclusive {
+			return conflict(fmt.Sprintf("%s does not share the address", v.Protocol))
+		}
+	}
+	if l.TLS != o.TLS {
+		return conflict("tls and plaintext do not share the address")
+	}
+	if l.H2C != o.H2C {
+		return conflict("h2c and http/1.1 do not share the address")
+	}
+	if l.DefaultServer && o.DefaultServer {
+		return conflict("default server is duplicated")
+	}
+	for _, name := range l.ServerNames {
+		for _, other := range o.ServerNames {
+			if name == other {
+				return conflict(fmt.Sprintf("server name '%s' is duplicated", name))
+			}
+		}
+	}
+	return nil
+}
+
+// listen returns how the virtual server listens, like the balancer does.
+func (vs *VirtualServer) listen() (*Listen, error) {
+	l := &Listen{
+		Name:          vs.Name,
+		Address:       vs.Address,
+		Protocol:      vs.Protocol,
+		Exclusive:     vs.Protocol == "tcp" || vs.Protocol == "udp",
+		Datagram:      vs.Protocol == "udp",
+		DefaultServer: vs.DefaultServer,
+	}
+	switch vs.Protocol {
+	case "https":
+		l.TLS = true
+	case "grpc":
+		l.TLS = vs.CertFile != "" || len(vs.Certificates) > 0
+		l.H2C = !l.TLS
+	case "", "http":
+		l.H2C = vs.H2C
+	}
+	serverName := vs.ServerName
+	if serverName == "" {
+		serverName = "localhost"
+	}
+	names, err := ParseServerNames(serverName)
+	if err != nil {
+		return nil, fmt.Errorf("virtual server %s %v", vs.Name, err)
+	}
+	l.ServerNames = names.Names
+	return l, nil
+}
+
+// checkMember checks the pool member against the protocols, like the
+// balancer does, grpc speaks h2c to the peers by default.
+func (vs *VirtualServer) checkMember(p Server) error {
+	if p.Priority < 0 {
+		return ErrPoolMemberPriority
+	}
+	if (vs.Protocol == "tcp" || vs.Protocol == "udp") && strings.Contains(p.Address, "://") {
+		return ErrPoolMemberScheme
+	}
+	h2c := vs.UpstreamProtocol == "h2c" || (vs.UpstreamProtocol == "" && vs.Protocol == "grpc")
+	if h2c && strings.HasPrefix(p.Address, "https://") {
+		return ErrPoolMemberTLS
+	}
+	return nil
+}
@@ -68,6 +68,30 @@ func TestLoadFromString(t *testing.T) {
 	assert.Equal(t, 2, s.Weight)
 }
 
+func TestLoadHashKey(t *testing.T) {
+	jsonBody := `{"virtual_server":[{"name":"cache","address":"127.0.0.1:8081","lb_method":"consistent-hash","hash_key":"header:X-User-ID,remote_ip"}]}`
+
+	c, err := LoadFromString(jsonBody)
+	require.NoError(t, err)
+	assert.Equal(t, "header:X-User-ID,remote_ip", c.VServers[0].HashKey)
+}
+
+func TestLoadHealthCheck(t *testing.T) {
+	jsonBody := `{"virtual_server":[{"name":"web","address":"127.0.0.1:8081","health_check":{"path":"/health","status":"200","interval":3,"unhealthy_threshold":5}}]}`
+
+	c, err := LoadFromString(jsonBody)
+	require.NoError(t, err)
+	assert.Equal(t, &HealthCheck{Path: "/health", Status: "200", Interval: 3, UnhealthyThreshold: 5}, c.VServers[0].HealthCheck)
+}
+
+func TestLoadPassiveHealth(t *testing.T) {
+	jsonBody := `{"virtual_server":[{"name":"web","address":"127.0.0.1:8081","max_fails":3,"fail_timeout":10,"fail_on":["error","503"]}]}`
+
+	c, err := LoadFromString(jsonBody)
+	require.NoError(t, err)
+	assert.Equal(t, PassiveHealth{MaxFails: 3, FailTimeout: 10, FailOn: []string{"error", "503"}}, c.VServers[0].PassiveHealth)
+}
+
 func TestLoadEmpty(t *testing.T) {
 	c, err := LoadFromString("{}")
 	require.NoError(t, err)
@@ -107,3 +131,139 @@ func TestCheckVirtualServerAddress(t *testing.T) {
 	assert.Equal(t, ErrVirtualServerAddressEmpty, err)
 	assert.Nil(t, c)
 }
+
+func TestCheckPoolMemberScheme(t *testing.T) {
+	jsonBody := `{"virtual_server":[{"name":"redis","address":"127.0.0.1:6379","protocol":"tcp","pool":[{"address":"tcp://127.0.0.1:10001"}]}]}`
+	c, err := LoadFromString(jsonBody)
+	assert.Equal(t, ErrPoolMemberScheme, err)
+	assert.Nil(t, c)
+
+	jsonBody = `{"virtual_server":[{"name":"echo","address":"127.0.0.1:50051","protocol":"grpc","pools":[{"name":"v2","members":[{"address":"https://127.0.0.1:10001"}]}]}]}`
+	c, err = LoadFromString(jsonBody)
+	assert.Equal(t, ErrPoolMemberTLS, err)
+	assert.Nil(t, c)
+
+	jsonBody = `{"virtual_server":[{"name":"web","address":"127.0.0.1:8081","upstream_protocol":"h2","pool":[{"address":"https://127.0.0.1:10001"}]}]}`
+	c, err = LoadFromString(jsonBody)
+	assert.NoError(t, err)
+	assert.NotNil(t, c)
+}
+
+func TestCheckPoolMemberPriority(t *testing.T) {
+	jsonBody := `{"virtual_server":[{"name":"web","address":"127.0.0.1:8081","pool":[{"address":"127.0.0.1:10001","priority":-1}]}]}`
+	c, err := LoadFromString(jsonBody)
+	assert.Equal(t, ErrPoolMemberPriority, err)
+	assert.Nil(t, c)
+}
+
+func TestPriorityLevel(t *testing.T) {
+	jsonBody := `{"virtual_server":[{"name":"web","address":"127.0.0.1:8081","pool":[{"address":"127.0.0.1:10001"},{"address":"127.0.0.1:10002","backup":true},{"address":"127.0.0.1:10003","backup":true,"priority":3}]}]}`
+	c, err := LoadFromString(jsonBody)
+	require.NoError(t, err)
+
+	pool := c.VServers[0].Pool
+	assert.Equal(t, 0, pool[0].PriorityLevel())
+	assert.Equal(t, 1, pool[1].PriorityLevel())
+	assert.Equal(t, 3, pool[2].PriorityLevel())
+}
+
+func TestCheckSharedAddress(t *testing.T) {
+	jsonBody := `{"virtual_server":[{"name":"a","address":":80","server_name":"a.com"},{"name":"b","address":":80","server_name":"b.com"},{"name":"dns","address":":80","protocol":"udp"}]}`
+	c, err := LoadFromString(jsonBody)
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(c.VServers))
+
+	for vs, expect := range map[string]string{
+		`{"name":"b","address":":80","server_name":"www.a.com .A.com"}`: "virtual server b conflicts with a on :80, server name 'a.com' is duplicated",
+		`{"name":"b","address":":80","server_name":"A.com."}`:           "virtual server b conflicts with a on :80, server name 'a.com' is duplicated",
+		`{"name":"b","address":":80","server_name":"www.*.com"}`:        "virtual server b server name 'www.*.com' is invalid",
+		`{"name":"b","address":":80","protocol":"tcp"}`:                 "virtual server b conflicts with a on :80, tcp does not share the address",
+		`{"name":"b","address":":80","protocol":"https"}`:               "virtual server b conflicts with a on :80, tls and plaintext do not share the address",
+		`{"name":"b","address":":80","protocol":"grpc"}`:                "virtual server b conflicts with a on :80, h2c and http/1.1 do not share the address",
+	} {
+		c, err = LoadFromString(`{"virtual_server":[{"name":"a","address":":80","server_name":"a.com"},` + vs + `]}`)
+		assert.EqualError(t, err, expect)
+		assert.Nil(t, c)
+	}
+
+	jsonBody = `{"virtual_server":[{"name":"a","address":":80","default_server":true},{"name":"b","address":":80","server_name":"b.com","default_server":true}]}`
+	_, err = LoadFromString(jsonBody)
+	assert.EqualError(t, err, "virtual server b conflicts with a on :80, default server is duplicated")
+}
+
+func TestLoadRoutes(t *testing.T) {
+	jsonBody := `{"virtual_server":[{"name":"web","address":"127.0.0.1:8081","pools":[{"name":"api","lb_method":"least-conn","members":[{"address":"127.0.0.1:10001"}]}],"routes":[{"name":"api","prefix":"/api/","methods":["GET"],"headers":{"X-Version":"2"},"pool":"api"}]}]}`
+	c, err := LoadFromString(jsonBody)
+	require.NoError(t, err)
+	pools := c.VServers[0].Pools
+	require.Equal(t, 1, len(pools))
+	assert.Equal(t, "least-conn", pools[0].LBMethod)
+	assert.Equal(t, "127.0.0.1:10001", pools[0].Members[0].Address)
+	routes := c.VServers[0].Routes
+	require.Equal(t, 1, len(routes))
+	assert.Equal(t, "/api/", routes[0].Prefix)
+	assert.Equal(t, "2", routes[0].Headers["X-Version"])
+	assert.Equal(t, "api", routes[0].Pool)
+
+	_, err = LoadFromString(`{"virtual_server":[{"name":"web","address":"127.0.0.1:8081","routes":[{"prefix":"/api/"}]}]}`)
+	assert.Equal(t, ErrRouteNameEmpty, err)
+	_, err = LoadFromString(`{"virtual_server":[{"name":"web","address":"127.0.0.1:8081","routes":[{"name":"api"},{"name":"api"}]}]}`)
+	assert.Equal(t, ErrRouteDuplicated, err)
+	_, err = LoadFromString(`{"virtual_server":[{"name":"web","address":"127.0.0.1:8081","routes":[{"name":"api","pool":"api"}]}]}`)
+	assert.EqualError(t, err, "route api pool 'api' is not found")
+	_, err = LoadFromString(`{"virtual_server":[{"name":"web","address":"127.0.0.1:8081","pools":[{"members":[]}]}]}`)
+	assert.Equal(t, ErrPoolNameEmpty, err)
+	_, err = LoadFromString(`{"virtual_server":[{"name":"web","address":"127.0.0.1:8081","pools":[{"name":"api"},{"name":"api"}]}]}`)
+	assert.Equal(t, ErrPoolDuplicated, err)
+	_, err = LoadFromString(`{"virtual_server":[{"name":"web","address":"127.0.0.1:8081","pools":[{"name":"api","members":[{"address":"127.0.0.1:10001","priority":-1}]}]}]}`)
+	assert.Equal(t, ErrPoolMemberPriority, err)
+}
+
+func TestLoadHeaderRules(t *testing.T) {
+	jsonBody := `{"virtual_server":[{"name":"web","address":"127.0.0.1:8081","header_rules":{"set_request":{"X-Forwarded-Proto":"$scheme"},"remove_response":["Server"]},"routes":[{"name":"api","header_rules":{"add_request":{"X-Route":"$route"}}}]}]}`
+	c, err := LoadFromString(jsonBody)
+	require.NoError(t, err)
+	vs := c.VServers[0]
+	assert.Equal(t, "$scheme", vs.HeaderRules.SetRequest["X-Forwarded-Proto"])
+	assert.Equal(t, []string{"Server"}, vs.HeaderRules.RemoveResponse)
+	assert.Equal(t, "$route", vs.Routes[0].HeaderRules.AddRequest["X-Route"])
+}
+
+func TestParseServerNames(t *testing.T) {
+	names, err := ParseServerNames("example.com  *.example.org www.example.* .example.net ~^api\\d+\\.example\\.io$")
+	require.NoError(t, err)
+	for host, expect := range map[string]bool{
+		"example.com":         true,
+		"EXAMPLE.com:8080":    true,
+		"example.com.":        true,
+		"www.example.com":     true,
+		"mail.example.com":    false,
+		"a.example.org":       true,
+		"a.b.example.org":     true,
+		"example.org":         false,
+		"www.example.net":     true,
+		"example.net":         true,
+		"www.example.co.uk":   true,
+		"www.example":         false,
+		"api12.example.io:80": true,
+		"api.example.io":      false,
+		"localhost":           false,
+	} {
+		assert.Equal(t, expect, names.Match(host), host)
+	}
+
+	names, err = ParseServerNames("::1 [::1]")
+	require.NoError(t, err)
+	assert.True(t, names.Match("[::1]:8080"))
+
+	// the names are normalized as the hosts
+	names, err = ParseServerNames("Example.COM. .example.net. ~^API\\.")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com", "example.net", "*.example.net", "~^API\\."}, names.Names)
+	assert.True(t, names.Match("api.example.org"))
+
+	for _, name := range []string{"www.*.com", "*example.com", "~(api", "."} {
+		_, err = ParseServerNames(name)
+		assert.EqualError(t, err, "server name '"+name+"' is invalid")
+	}
+}
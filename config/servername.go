@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// ServerNames matches the host of the request like the server_name of
+// nginx, the names are separated by spaces, and a name is one of
+//
+//	exact name, e.g. "example.com"
+//	wildcard name, e.g. "*.example.com" or "www.example.*"
+//	".example.com", which matches both "example.com" and "*.example.com"
+//	regex starting with "~", e.g. "~^www\d+\.example\.com$"
+//
+// The port and the trailing dot of the host are ignored and the names are
+// case-insensitive.
+type ServerNames struct {
+	exact    map[string]bool
+	suffixes []string
+	prefixes []string
+	regexps  []*regexp.Regexp
+	// the parsed names, ".example.com" is both "example.com" and "*.example.com"
+	Names []string
+}
+
+// ParseServerNames parses the server_name of a virtual server.
+func ParseServerNames(names string) (*ServerNames, error) {
+	n := &ServerNames{exact: map[string]bool{}}
+	for _, name := range strings.Fields(names) {
+		if strings.HasPrefix(name, "~") {
+			re, err := regexp.Compile("(?i)" + name[1:])
+			if err != nil {
+				return nil, fmt.Errorf("server name '%s' is invalid", name)
+			}
+			n.regexps = append(n.regexps, re)
+			n.Names = append(n.Names, name)
+			continue
+		}
+
+		invalid := fmt.Errorf("server name '%s' is invalid", name)
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		switch {
+		case name == "":
+			return nil, invalid
+		case strings.HasPrefix(name, "*.") && !strings.Contains(name[2:], "*"):
+			n.suffixes = append(n.suffixes, name[1:])
+			n.Names = append(n.Names, name)
+		case strings.HasSuffix(name, ".*") && !strings.Contains(name[:len(name)-2], "*"):
+			n.prefixes = append(n.prefixes, name[:len(name)-1])
+			n.Names = append(n.Names, name)
+		case strings.HasPrefix(name, ".") && !strings.Contains(name, "*"):
+			n.exact[name[1:]] = true
+			n.suffixes = append(n.suffixes, name)
+			n.Names = append(n.Names, name[1:], "*"+name)
+		case !strings.Contains(name, "*"):
+			n.exact[name] = true
+			n.Names = append(n.Names, name)
+		default:
+			return nil, invalid
+		}
+	}
+	return n, nil
+}
+
+// stripPort returns the host without the port, e.g. "example.com" of
+// "example.com:8081", "::1" of "[::1]:8081".
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// Match returns true if the host matches any of the names.
+func (n *ServerNames) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(stripPort(host), "."))
+	if n.exact[host] {
+		return true
+	}
+	for _, suffix := range n.suffixes {
+		if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+			return true
+		}
+	}
+	for _, prefix := range n.prefixes {
+		if strings.HasPrefix(host, prefix) && len(host) > len(prefix) {
+			return true
+		}
+	}
+	for _, re := range n.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
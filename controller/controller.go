@@ -15,6 +15,64 @@
 //	POST http://{controller_address}/vs
 //	Body {"name":"redis","address":"127.0.0.1:6379"}
 //	Example: curl -XPOST -u admin:admin -H 'content-type: application/json' -d '{"name":"redis","address":"127.0.0.1:6379"}' http://127.0.0.1:6587/vs
+//	Optional "protocol": "http" (default), "https", "grpc", "tcp" or "udp", a grpc LB instance balances
+//	per RPC over h2c, or TLS with "cert_file" and "key_file", and retries on UNAVAILABLE,
+//	only UNAVAILABLE and DEADLINE_EXCEEDED count as failures of the member, as 503 and 504,
+//	a tcp LB instance forwards raw connections and hashes the client address,
+//	a udp LB instance forwards datagrams per client session
+//	Optional "server_name": names separated by spaces, e.g. "example.com *.example.com www.example.* ~^api\d+\.",
+//	exact, wildcard or regex (prefixed by "~") names match the host regardless of the port, default "localhost"
+//	Optional "default_server": true to serve the requests whose host matches no server name instead of 400
+//	http, https and grpc LB instances of the same "address" share the listener, which dispatches the requests
+//	by host and the TLS handshakes by SNI, if they agree on TLS and h2c and no server name is duplicated
+//	Optional "certificates" of https and grpc selected by SNI including wildcard names, e.g.
+//	[{"cert_file":"a.pem","key_file":"a.key"}], "cert_file" and "key_file" or else the first one is the default
+//	Optional "cert_reload_interval": seconds of checking the certificate files for reload, default 10
+//	Optional "min_tls_version": "1.0", "1.1", "1.2" or "1.3", and "cipher_suites" of TLS 1.0-1.2,
+//	e.g. ["TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"]
+//	Optional "lb_method": "round-robin" (default), "consistent-hash" (default of tcp), "least-conn", "p2c-ewma",
+//	"maglev" or "rendezvous"
+//	Optional "hash_key" of consistent-hash, maglev and rendezvous: fallback chain of "remote_ip" (default),
+//	"remote_addr", "host", "uri", "header:<name>", "cookie:<name>" or "query:<name>", e.g. "cookie:session,remote_ip"
+//	Optional "replica": virtual nodes per weight of consistent-hash method, default 20
+//	Optional "bounded_load": epsilon of consistent-hash method with bounded loads, e.g. 0.25
+//	Optional "slow_start": seconds of ramping up the weight of new or recovered members
+//	Optional "idle_timeout": seconds before an idle client session of udp expires, default 30
+//	Optional "h2c": true to accept HTTP/2 over plaintext on a http LB instance
+//	Optional "upstream_protocol": "http1" (default), "h2" or "h2c" (default of grpc) speaking to members,
+//	the stats count the new and reused connections of h2 and h2c
+//	Optional "upstream_tls": speak TLS to members, e.g. {"enable":true,"ca_file":"ca.pem","cert_file":"client.pem",
+//	"key_file":"client.key","server_name":"backend.local","insecure_skip_verify":false},
+//	the address of a member may also be "https://host:port" unless the upstream protocol is h2c
+//	Optional "health_check": active HTTP health check of members, e.g. {"path":"/health","status":"200-399",
+//	"body":"ok","interval":5,"timeout":2,"healthy_threshold":2,"unhealthy_threshold":3}
+//	"type" of health check is "http" (default), "tcp" or "grpc", e.g. {"type":"grpc","grpc_service":"echo"},
+//	the http and grpc checks speak the upstream protocol
+//	Optional "outlier_detection": eject members with abnormal errors, e.g. {"consecutive_5xx":5,
+//	"consecutive_gateway_failure":3,"interval":10,"base_ejection_time":30,"max_ejection_time":300,
+//	"max_ejection_percent":10,"success_rate_minimum_hosts":5,"success_rate_request_volume":100,
+//	"success_rate_stdev_factor":1.9}
+//	Optional "circuit_breaker": per member circuit breaker instead of max_fails and fail_timeout, e.g.
+//	{"failure_threshold":5,"open_timeout":10,"max_open_timeout":300,"half_open_requests":1}
+//
+//	Optional "header_rules": headers of the upstream requests and the responses, e.g. {"set_request":
+//	{"X-Forwarded-Proto":"$scheme","Host":"backend.local"},"add_request":{"X-Real-IP":"$remote_ip"},
+//	"remove_request":["X-Debug"],"set_response":{"X-Request-Id":"$request_id"},"remove_response":["Server"]},
+//	the variables are $remote_ip, $remote_addr, $scheme, $host, $peer, $vs_name, $route and $request_id,
+//	"$$" is a literal "$", "X-Forwarded-For" cannot be removed, the response rules apply to the errors as well,
+//	a route may have its own "header_rules" applied after the ones of the LB instance
+//	Optional "pools": named pools of the routes, e.g. [{"name":"static","lb_method":"least-conn",
+//	"members":[{"address":"127.0.0.1:10003","weight":1}]}], "lb_method" is the one of the LB instance by default,
+//	the members share the health with the same address in the other pools
+//	Optional "routes": ordered routes balancing the matched requests over the named pools, e.g.
+//	[{"name":"static","prefix":"/static/","pool":"static"}], a route matches one of "prefix", "exact" and
+//	"regex" of the path, optional "methods" and "headers", a route without "pool" and the other requests
+//	go to "pool" of the LB instance, and the stats list each route
+//
+//	Optional "max_fails": failed requests within "fail_timeout" before marking the member down, default 2
+//	Optional "fail_timeout": seconds of counting the failed requests and before retrying the down member, default 7
+//	Optional "fail_on": conditions of a failed request, "error" (the member is not reachable),
+//	"4xx", "5xx" or a status code, default ["error", "5xx"]
 //
 // - Enable LB instance
 //	POST http://{controller_address}/vs/{name}
@@ -24,12 +82,30 @@
 //	POST http://{controller_address}/vs/{name}
 //	Body {"action":"disable"}
 //
+// - Reload certificates of LB instance, the served ones are kept if any key pair is broken
+//	POST http://{controller_address}/vs/{name}
+//	Body {"action":"reload"}
+//
 // - List pool member of LB instance
 //	GET http://{controller_address}/vs/{name}
+//	The consistent-hash pool lists weight, virtual nodes and share of keys of each member
+//	The health of each member is listed if health check or outlier detection is configured
+//
+// - Get passive health settings of LB instance
+//	GET http://{controller_address}/vs/{name}/passive_health
+//
+// - Update passive health settings of LB instance
+//	PUT http://{controller_address}/vs/{name}/passive_health
+//	Body: {"max_fails":3,"fail_timeout":10,"fail_on":["error","502","503"]}
+//
+// - Get circuit breaker state and transition history of pool members
+//	GET http://{controller_address}/vs/{name}/circuit_breaker
 //
 // - Add pool member to LB instance
 //	POST http://{controller_address}/vs/{name}/pool
 //	Body: {"address":"127.0.0.1:10003","weight":2}
+//	Optional "priority" (lower value is preferred, default 0) or "backup": true (priority 1),
+//	the members of a priority are used only if all members of higher priorities are down
 //	Example: curl -XPOST -u admin:admin -H 'content-type: application/json' -d '{"address":"127.0.0.1:10003"}' http://127.0.0.1:6587/vs/web/pool
 //
 // - Remove pool member from LB instance
@@ -37,6 +113,31 @@
 //	Body: {"address":"127.0.0.1:10002"}
 //	Example: curl -XDELETE -u admin:admin -H 'content-type: application/json' -d '{"address":"127.0.0.1:10002"}' http://127.0.0.1:6587/vs/web/pool
 //
+// - List named pools of LB instance
+//	GET http://{controller_address}/vs/{name}/pools
+//
+// - Add member to named pool of LB instance, the named pools are fixed once the LB instance is added
+//	POST http://{controller_address}/vs/{name}/pools/{pool}
+//	Body: {"address":"127.0.0.1:10005","weight":1}, optional "priority" or "backup" as the pool members
+//
+// - Remove member from named pool of LB instance
+//	DELETE http://{controller_address}/vs/{name}/pools/{pool}
+//	Body: {"address":"127.0.0.1:10005"}
+//
+// - List routes of LB instance
+//	GET http://{controller_address}/vs/{name}/route
+//
+// - Add route to LB instance, which is matched after the existing ones
+//	POST http://{controller_address}/vs/{name}/route
+//	Body: {"name":"api","prefix":"/api/","methods":["GET","POST"],"headers":{"X-Version":"2"},"pool":"api"}
+//
+// - Update route of LB instance in place
+//	PUT http://{controller_address}/vs/{name}/route/{route}
+//	Body: {"exact":"/login","pool":"login"}
+//
+// - Remove route from LB instance
+//	DELETE http://{controller_address}/vs/{name}/route/{route}
+//
 package controller
 
 import (
@@ -78,6 +179,16 @@ func (c *Controller) Run(balancer *balancer.Balancer) {
 	r.Handle("/vs/{name}", listVirtualServer(balancer)).Methods("GET")
 	r.Handle("/vs/{name}/pool", addPoolMember(balancer)).Methods("POST")
 	r.Handle("/vs/{name}/pool", deletePoolMember(balancer)).Methods("DELETE")
+	r.Handle("/vs/{name}/pools", listPools(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/pools/{pool}", addNamedPoolMember(balancer)).Methods("POST")
+	r.Handle("/vs/{name}/pools/{pool}", deleteNamedPoolMember(balancer)).Methods("DELETE")
+	r.Handle("/vs/{name}/route", listRoutes(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/route", addRoute(balancer)).Methods("POST")
+	r.Handle("/vs/{name}/route/{route}", updateRoute(balancer)).Methods("PUT")
+	r.Handle("/vs/{name}/route/{route}", deleteRoute(balancer)).Methods("DELETE")
+	r.Handle("/vs/{name}/passive_health", getPassiveHealth(balancer)).Methods("GET")
+	r.Handle("/vs/{name}/passive_health", updatePassiveHealth(balancer)).Methods("PUT")
+	r.Handle("/vs/{name}/circuit_breaker", getCircuitBreaker(balancer)).Methods("GET")
 	go func() {
 		if err := http.ListenAndServe(c.Address, BasicAuth(c.Auth)(r)); err != nil {
 			panic(err)
@@ -124,6 +235,9 @@ func listVirtualServer(b *balancer.Balancer) http.Handler {
 			return
 		}
 		msg := vs.Pool.String()
+		if health := vs.Health(); health != "" {
+			msg += "\n" + health
+		}
 		io.WriteString(w, msg)
 	})
 }
@@ -132,7 +246,10 @@ type modifyVirtualServer struct {
 	Action string `json:"action"`
 }
 
-var errUnknownAction = errors.New("unknown action")
+var (
+	errUnknownAction    = errors.New("unknown action")
+	errNoCircuitBreaker = errors.New("circuit breaker is not configured")
+)
 
 func modifyVirtualServerStatus(b *balancer.Balancer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -164,6 +281,10 @@ func modifyVirtualServerStatus(b *balancer.Balancer) http.Handler {
 			if err := vs.Stop(); err != nil {
 				msg = err.Error()
 			}
+		} else if action == "reload" {
+			if err := vs.ReloadCertificates(); err != nil {
+				msg = err.Error()
+			}
 		} else {
 			log.Errorf("%v", errUnknownAction)
 			writeBadRequest(w, errUnknownAction)
@@ -224,12 +345,16 @@ func addPoolMember(b *balancer.Balancer) http.Handler {
 			writeBadRequest(w, err)
 			return
 		}
+		if err = vs.CheckPeer(*server); err != nil {
+			writeBadRequest(w, err)
+			return
+		}
 
 		weight := server.Weight
 		if weight <= 0 {
 			weight = 1
 		}
-		vs.AddPeer(server.Address, weight)
+		vs.AddPeer(server.Address, weight, server.PriorityLevel())
 		io.WriteString(w, "Add peer success")
 	})
 }
@@ -254,3 +379,230 @@ func deletePoolMember(b *balancer.Balancer) http.Handler {
 		io.WriteString(w, "Remove peer success")
 	})
 }
+
+func getPassiveHealth(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vs.PassiveHealth())
+	})
+}
+
+func updatePassiveHealth(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		var cfg config.PassiveHealth
+		decoder := json.NewDecoder(r.Body)
+		if err = decoder.Decode(&cfg); err != nil {
+			log.Errorf("Decode request err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+		if err = vs.SetPassiveHealth(&cfg); err != nil {
+			log.Errorf("SetPassiveHealth err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+		io.WriteString(w, "Update success")
+	})
+}
+
+func getCircuitBreaker(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		status := vs.CircuitBreaker()
+		if status == nil {
+			writeBadRequest(w, errNoCircuitBreaker)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+}
+
+func listPools(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vs.Pools())
+	})
+}
+
+func addNamedPoolMember(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+		server, err := decodeServer(r)
+		if err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+
+		if err = vs.AddPoolPeer(vars["pool"], *server); err != nil {
+			log.Errorf("AddPoolPeer err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+		io.WriteString(w, "Add peer success")
+	})
+}
+
+func deleteNamedPoolMember(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+		server, err := decodeServer(r)
+		if err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+
+		if err = vs.RemovePoolPeer(vars["pool"], server.Address); err != nil {
+			log.Errorf("RemovePoolPeer err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+		io.WriteString(w, "Remove peer success")
+	})
+}
+
+func listRoutes(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vs.Routes())
+	})
+}
+
+func decodeRoute(r *http.Request) (*config.Route, error) {
+	var route config.Route
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&route); err != nil {
+		log.Errorf("Decode request err=%v", err)
+		return nil, err
+	}
+	return &route, nil
+}
+
+func addRoute(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+		route, err := decodeRoute(r)
+		if err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+
+		if err = vs.AddRoute(*route); err != nil {
+			log.Errorf("AddRoute err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+		io.WriteString(w, "Add route success")
+	})
+}
+
+func updateRoute(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+		route, err := decodeRoute(r)
+		if err != nil {
+			writeBadRequest(w, err)
+			return
+		}
+
+		route.Name = vars["route"]
+		if err = vs.UpdateRoute(*route); err != nil {
+			log.Errorf("UpdateRoute err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+		io.WriteString(w, "Update route success")
+	})
+}
+
+func deleteRoute(b *balancer.Balancer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		name := vars["name"]
+		vs, err := b.FindVirtualServer(name)
+		if err != nil {
+			log.Errorf("FindVirtualServer err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+
+		if err = vs.RemoveRoute(vars["route"]); err != nil {
+			log.Errorf("RemoveRoute err=%v", err)
+			writeBadRequest(w, err)
+			return
+		}
+		io.WriteString(w, "Remove route success")
+	})
+}
@@ -118,6 +118,12 @@ func TestModifyVirtualServerStatus(t *testing.T) {
 	req = mux.SetURLVars(req, map[string]string{"name": "web"})
 	testCtrlSuit(t, h, req, 200, expect)
 
+	// reload certificates
+	body, _ = json.Marshal(map[string]string{"action": "reload"})
+	req = httptest.NewRequest("POST", "/vs", bytes.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"name": "web"})
+	testCtrlSuit(t, h, req, 200, "web does not serve tls")
+
 	// virtual server not exist
 	body, _ = json.Marshal(map[string]string{"action": "enable"})
 	req = httptest.NewRequest("POST", "/vs", bytes.NewReader(body))
@@ -155,6 +161,17 @@ func TestAddVirtualServer(t *testing.T) {
 	req = httptest.NewRequest("POST", "/vs", bytes.NewReader(body))
 	testCtrlSuit(t, h, req, 400, balancer.ErrVirtualServerNameEmpty.Error())
 
+	// negative priority of the pool members
+	body, _ = json.Marshal(map[string]interface{}{"name": "api", "address": "127.0.0.1:8000",
+		"pool": []map[string]interface{}{{"address": "127.0.0.1:10001", "priority": -1}}})
+	req = httptest.NewRequest("POST", "/vs", bytes.NewReader(body))
+	testCtrlSuit(t, h, req, 400, config.ErrPoolMemberPriority.Error())
+	body, _ = json.Marshal(map[string]interface{}{"name": "api", "address": "127.0.0.1:8000",
+		"pools": []map[string]interface{}{{"name": "a", "members": []map[string]interface{}{{"address": "127.0.0.1:10001", "priority": -1}}}}})
+	req = httptest.NewRequest("POST", "/vs", bytes.NewReader(body))
+	testCtrlSuit(t, h, req, 400, config.ErrPoolMemberPriority.Error())
+	assert.Equal(t, 2, len(b.VServers))
+
 	// test bad request
 	req = httptest.NewRequest("POST", "/vs", strings.NewReader(""))
 	testCtrlSuit(t, h, req, 400, "EOF")
@@ -175,6 +192,13 @@ func TestAddPoolMember(t *testing.T) {
 	req = mux.SetURLVars(req, map[string]string{"name": "db"})
 	testCtrlSuit(t, h, req, 400, balancer.ErrVirtualServerNotFound.Error())
 
+	// negative priority
+	body, _ = json.Marshal(map[string]interface{}{"address": "127.0.0.1:10006", "priority": -1})
+	req = httptest.NewRequest("POST", "/vs/web/pool", bytes.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"name": "web"})
+	testCtrlSuit(t, h, req, 400, config.ErrPoolMemberPriority.Error())
+	assert.Equal(t, 3, b.VServers[0].Pool.Size())
+
 	// test bad request
 	req = httptest.NewRequest("POST", "/vs/web/pool", strings.NewReader(""))
 	req = mux.SetURLVars(req, map[string]string{"name": "web"})
@@ -200,3 +224,136 @@ func TestDeletePoolMember(t *testing.T) {
 	req = mux.SetURLVars(req, map[string]string{"name": "web"})
 	testCtrlSuit(t, h, req, 400, "EOF")
 }
+
+func TestPassiveHealth(t *testing.T) {
+	b := mockBalancer(t)
+	get := getPassiveHealth(b)
+	update := updatePassiveHealth(b)
+
+	req := httptest.NewRequest("GET", "/vs/web/passive_health", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "web"})
+	testCtrlSuit(t, get, req, 200, `{"max_fails":2,"fail_timeout":7,"fail_on":["error","5xx"]}`+"\n")
+
+	body := `{"max_fails":3,"fail_timeout":10,"fail_on":["error","503"]}`
+	req = httptest.NewRequest("PUT", "/vs/web/passive_health", strings.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"name": "web"})
+	testCtrlSuit(t, update, req, 200, "Update success")
+	assert.Equal(t, 3, b.VServers[0].MaxFails)
+
+	req = httptest.NewRequest("GET", "/vs/web/passive_health", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "web"})
+	testCtrlSuit(t, get, req, 200, body+"\n")
+
+	req = httptest.NewRequest("PUT", "/vs/web/passive_health", strings.NewReader(`{"fail_on":["timeout"]}`))
+	req = mux.SetURLVars(req, map[string]string{"name": "web"})
+	testCtrlSuit(t, update, req, 400, "fail on 'timeout' is not supported")
+
+	req = httptest.NewRequest("PUT", "/vs/web/passive_health", strings.NewReader(""))
+	req = mux.SetURLVars(req, map[string]string{"name": "web"})
+	testCtrlSuit(t, update, req, 400, "EOF")
+
+	req = httptest.NewRequest("GET", "/vs/db/passive_health", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "db"})
+	testCtrlSuit(t, get, req, 400, balancer.ErrVirtualServerNotFound.Error())
+}
+
+func TestGetCircuitBreaker(t *testing.T) {
+	b := mockBalancer(t)
+	h := getCircuitBreaker(b)
+
+	req := httptest.NewRequest("GET", "/vs/web/circuit_breaker", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "web"})
+	testCtrlSuit(t, h, req, 400, "circuit breaker is not configured")
+
+	cvs := &config.VirtualServer{
+		Name:           "cb",
+		Address:        "127.0.0.1:8086",
+		Pool:           []config.Server{{Address: "127.0.0.1:10001"}},
+		CircuitBreaker: &config.CircuitBreaker{},
+	}
+	require.NoError(t, b.AddVirtualServer(cvs))
+	req = httptest.NewRequest("GET", "/vs/cb/circuit_breaker", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "cb"})
+	testCtrlSuit(t, h, req, 200, `{"127.0.0.1:10001":{"state":"closed","history":[]}}`+"\n")
+
+	req = mux.SetURLVars(req, map[string]string{"name": "db"})
+	testCtrlSuit(t, h, req, 400, balancer.ErrVirtualServerNotFound.Error())
+}
+
+func TestRoutes(t *testing.T) {
+	jsonBody := `{"virtual_server":[{"name":"web","address":"127.0.0.1:8082","pool":[{"address":"127.0.0.1:10001","weight":1}],"pools":[{"name":"api","members":[{"address":"127.0.0.1:10003"}]},{"name":"login","lb_method":"least-conn","members":[{"address":"127.0.0.1:10004","weight":2}]}]}]}`
+	c, err := config.LoadFromString(jsonBody)
+	require.NoError(t, err)
+	b, err := balancer.New(c.VServers)
+	require.NoError(t, err)
+	pools := listPools(b)
+	list := listRoutes(b)
+	add := addRoute(b)
+	update := updateRoute(b)
+	del := deleteRoute(b)
+	vars := map[string]string{"name": "web", "route": "api"}
+
+	req := httptest.NewRequest("GET", "/vs/web/pools", nil)
+	req = mux.SetURLVars(req, vars)
+	expect := `[{"name":"api","lb_method":"round-robin","members":[{"address":"127.0.0.1:10003","weight":0,"priority":0,"backup":false}]},` +
+		`{"name":"login","lb_method":"least-conn","members":[{"address":"127.0.0.1:10004","weight":2,"priority":0,"backup":false}]}]` + "\n"
+	testCtrlSuit(t, pools, req, 200, expect)
+
+	addMember := addNamedPoolMember(b)
+	delMember := deleteNamedPoolMember(b)
+	req = httptest.NewRequest("POST", "/vs/web/pools/api", strings.NewReader(`{"address":"127.0.0.1:10005","backup":true}`))
+	req = mux.SetURLVars(req, map[string]string{"name": "web", "pool": "api"})
+	testCtrlSuit(t, addMember, req, 200, "Add peer success")
+	req = httptest.NewRequest("POST", "/vs/web/pools/api", strings.NewReader(`{"address":"127.0.0.1:10005"}`))
+	req = mux.SetURLVars(req, map[string]string{"name": "web", "pool": "api"})
+	testCtrlSuit(t, addMember, req, 400, "pool api member 127.0.0.1:10005 existed")
+	req = httptest.NewRequest("POST", "/vs/web/pools/web", strings.NewReader(`{"address":"127.0.0.1:10005"}`))
+	req = mux.SetURLVars(req, map[string]string{"name": "web", "pool": "web"})
+	testCtrlSuit(t, addMember, req, 400, "pool web not found")
+	req = httptest.NewRequest("DELETE", "/vs/web/pools/api", strings.NewReader(`{"address":"127.0.0.1:10003"}`))
+	req = mux.SetURLVars(req, map[string]string{"name": "web", "pool": "api"})
+	testCtrlSuit(t, delMember, req, 200, "Remove peer success")
+	req = httptest.NewRequest("DELETE", "/vs/web/pools/api", strings.NewReader(`{"address":"127.0.0.1:10003"}`))
+	req = mux.SetURLVars(req, map[string]string{"name": "web", "pool": "api"})
+	testCtrlSuit(t, delMember, req, 400, "pool api member 127.0.0.1:10003 not found")
+
+	req = httptest.NewRequest("GET", "/vs/web/pools", nil)
+	req = mux.SetURLVars(req, vars)
+	expect = `[{"name":"api","lb_method":"round-robin","members":[{"address":"127.0.0.1:10005","weight":0,"priority":0,"backup":true}]},` +
+		`{"name":"login","lb_method":"least-conn","members":[{"address":"127.0.0.1:10004","weight":2,"priority":0,"backup":false}]}]` + "\n"
+	testCtrlSuit(t, pools, req, 200, expect)
+
+	req = httptest.NewRequest("POST", "/vs/web/route", strings.NewReader(`{"name":"api","prefix":"/api/","pool":"api"}`))
+	req = mux.SetURLVars(req, vars)
+	testCtrlSuit(t, add, req, 200, "Add route success")
+
+	req = httptest.NewRequest("POST", "/vs/web/route", strings.NewReader(`{"name":"api"}`))
+	req = mux.SetURLVars(req, vars)
+	testCtrlSuit(t, add, req, 400, "route api existed")
+
+	req = httptest.NewRequest("PUT", "/vs/web/route/api", strings.NewReader(`{"exact":"/api","methods":["GET"],"pool":"web"}`))
+	req = mux.SetURLVars(req, vars)
+	testCtrlSuit(t, update, req, 400, "route api pool 'web' is not found")
+
+	req = httptest.NewRequest("PUT", "/vs/web/route/api", strings.NewReader(`{"exact":"/api","methods":["GET"],"pool":"login"}`))
+	req = mux.SetURLVars(req, vars)
+	testCtrlSuit(t, update, req, 200, "Update route success")
+
+	req = httptest.NewRequest("GET", "/vs/web/route", nil)
+	req = mux.SetURLVars(req, vars)
+	expect = `[{"name":"api","exact":"/api","methods":["GET"],"pool":"login"}]` + "\n"
+	testCtrlSuit(t, list, req, 200, expect)
+
+	req = httptest.NewRequest("DELETE", "/vs/web/route/api", nil)
+	req = mux.SetURLVars(req, vars)
+	testCtrlSuit(t, del, req, 200, "Remove route success")
+	testCtrlSuit(t, del, req, 400, "route api not found")
+
+	req = httptest.NewRequest("PUT", "/vs/web/route/api", strings.NewReader(""))
+	req = mux.SetURLVars(req, vars)
+	testCtrlSuit(t, update, req, 400, "EOF")
+
+	req = httptest.NewRequest("GET", "/vs/db/route", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "db"})
+	testCtrlSuit(t, list, req, 400, balancer.ErrVirtualServerNotFound.Error())
+}
@@ -0,0 +1,13 @@
+// Package healthcheck provides active health check of the backend servers
+//
+// The peers are probed periodically, a peer is reported unhealthy after
+// unhealthy_threshold consecutive failures and healthy again after
+// healthy_threshold consecutive successes. All the peers are assumed
+// healthy before the first probe.
+//
+// A probe is one of
+//
+//	http: GET the path, expect the status range and optionally a substring of the body
+//	tcp: connect within the timeout
+//	grpc: grpc.health.v1 Health/Check of the service, SERVING is expected
+package healthcheck
@@ -0,0 +1,240 @@
+package healthcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+// Types of health check.
+const (
+	TypeHTTP = "http"
+	TypeTCP  = "tcp"
+	TypeGRPC = "grpc"
+)
+
+// Defaults of health check.
+const (
+	DefaultPath               = "/"
+	DefaultStatus             = "200-399"
+	DefaultInterval           = 5 * time.Second
+	DefaultTimeout            = 2 * time.Second
+	DefaultHealthyThreshold   = 2
+	DefaultUnhealthyThreshold = 3
+)
+
+type peerState struct {
+	healthy   bool
+	successes int
+	failures  int
+	lastErr   error
+}
+
+func (s *peerState) String() string {
+	if s.healthy {
+		return "healthy"
+	}
+	return fmt.Sprintf("unhealthy, err=%v", s.lastErr)
+}
+
+// Checker probes the peers periodically and reports the change of health.
+type Checker struct {
+	sync.RWMutex
+	interval  time.Duration
+	timeout   time.Duration
+	healthy   int
+	unhealthy int
+	prober    prober
+	peers     map[string]*peerState
+	onChange  func(addr string, healthy bool)
+	stopC     chan struct{}
+}
+
+// New returns a Checker object, onChange is called when a peer turns
+// unhealthy or healthy.
+func New(cfg *config.HealthCheck, onChange func(addr string, healthy bool)) (*Checker, error) {
+	c := &Checker{
+		interval:  DefaultInterval,
+		timeout:   DefaultTimeout,
+		healthy:   DefaultHealthyThreshold,
+		unhealthy: DefaultUnhealthyThreshold,
+		peers:     map[string]*peerState{},
+		onChange:  onChange,
+	}
+	if cfg.Interval > 0 {
+		c.interval = time.Duration(cfg.Interval) * time.Second
+	}
+	if cfg.Timeout > 0 {
+		c.timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	if cfg.HealthyThreshold > 0 {
+		c.healthy = cfg.HealthyThreshold
+	}
+	if cfg.UnhealthyThreshold > 0 {
+		c.unhealthy = cfg.UnhealthyThreshold
+	}
+	if c.timeout > c.interval {
+		return nil, fmt.Errorf("health check timeout %v is longer than interval %v", c.timeout, c.interval)
+	}
+
+	p, err := newProber(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.prober = p
+	return c, nil
+}
+
+// SetUpstream makes the http and grpc probes speak the upstream protocol,
+// i.e. "http1", "h2" or "h2c", to the peers, over TLS with the config if
+// not nil, h2 always speaks TLS.
+func (c *Checker) SetUpstream(proto string, cfg *tls.Config) {
+	c.Lock()
+	defer c.Unlock()
+	if p, ok := c.prober.(upstreamProber); ok {
+		p.setUpstream(proto, cfg)
+	}
+}
+
+// Add starts to check the peer.
+func (c *Checker) Add(addr string) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.peers[addr]; !ok {
+		c.peers[addr] = &peerState{healthy: true}
+	}
+}
+
+// Remove stops checking the peer.
+func (c *Checker) Remove(addr string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.peers, addr)
+}
+
+// Healthy returns false only if the peer is checked and unhealthy.
+func (c *Checker) Healthy(addr string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	if s, ok := c.peers[addr]; ok {
+		return s.healthy
+	}
+	return true
+}
+
+// String lists the health of the peers.
+func (c *Checker) String() string {
+	c.RLock()
+	defer c.RUnlock()
+	keys := []string{}
+	for key := range c.peers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := []string{
+		fmt.Sprintf("health check: %s every %v", c.prober, c.interval),
+	}
+	for _, key := range keys {
+		result = append(result, fmt.Sprintf("%s: %s", key, c.peers[key]))
+	}
+	return strings.Join(result, "\n")
+}
+
+// Start probes the peers in background.
+func (c *Checker) Start() {
+	c.Lock()
+	defer c.Unlock()
+	if c.stopC != nil {
+		return
+	}
+	c.stopC = make(chan struct{})
+	go c.run(c.stopC)
+}
+
+// Stop stops probing.
+func (c *Checker) Stop() {
+	c.Lock()
+	defer c.Unlock()
+	if c.stopC != nil {
+		close(c.stopC)
+		c.stopC = nil
+	}
+}
+
+func (c *Checker) run(stopC chan struct{}) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.checkAll()
+		select {
+		case <-stopC:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll probes all the peers concurrently.
+func (c *Checker) checkAll() {
+	c.RLock()
+	addrs := make([]string, 0, len(c.peers))
+	for addr := range c.peers {
+		addrs = append(addrs, addr)
+	}
+	c.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+			defer cancel()
+			c.update(addr, c.prober.probe(ctx, addr))
+		}(addr)
+	}
+	wg.Wait()
+}
+
+func (c *Checker) update(addr string, err error) {
+	c.Lock()
+	s, ok := c.peers[addr]
+	if !ok {
+		c.Unlock()
+		return
+	}
+	changed := false
+	s.lastErr = err
+	if err == nil {
+		s.successes++
+		s.failures = 0
+		if !s.healthy && s.successes >= c.healthy {
+			s.healthy = true
+			changed = true
+		}
+	} else {
+		s.failures++
+		s.successes = 0
+		if s.healthy && s.failures >= c.unhealthy {
+			s.healthy = false
+			changed = true
+		}
+	}
+	healthy := s.healthy
+	c.Unlock()
+
+	if changed {
+		log.Infof("Health check: peer %s turns healthy=%v, err=%v", addr, healthy, err)
+		if c.onChange != nil {
+			c.onChange(addr, healthy)
+		}
+	}
+}
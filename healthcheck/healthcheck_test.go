@@ -0,0 +1,227 @@
+package healthcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"github.com/onestraw/golb/config"
+)
+
+func TestParseStatus(t *testing.T) {
+	s, err := parseStatus("")
+	assert.NoError(t, err)
+	assert.Equal(t, []statusRange{{200, 399}}, s)
+
+	s, err = parseStatus("200, 300-302")
+	assert.NoError(t, err)
+	assert.Equal(t, []statusRange{{200, 200}, {300, 302}}, s)
+
+	for _, status := range []string{"ok", "200-", "399-200", "99", "200-600"} {
+		_, err = parseStatus(status)
+		assert.Error(t, err, status)
+	}
+}
+
+func TestNewError(t *testing.T) {
+	_, err := New(&config.HealthCheck{Interval: 1, Timeout: 2}, nil)
+	assert.Error(t, err)
+
+	_, err = New(&config.HealthCheck{Path: "health"}, nil)
+	assert.Error(t, err)
+
+	_, err = New(&config.HealthCheck{Status: "2xx"}, nil)
+	assert.Error(t, err)
+}
+
+func TestThreshold(t *testing.T) {
+	var healthy int32 = 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/health", r.URL.Path)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write([]byte("status: ok"))
+	}))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	changes := []bool{}
+	cfg := &config.HealthCheck{Path: "/health", Body: "ok", HealthyThreshold: 2, UnhealthyThreshold: 2}
+	c, err := New(cfg, func(peer string, ok bool) {
+		assert.Equal(t, addr, peer)
+		changes = append(changes, ok)
+	})
+	assert.NoError(t, err)
+	c.Add(addr)
+	assert.True(t, c.Healthy(addr))
+
+	c.checkAll()
+	assert.True(t, c.Healthy(addr))
+
+	atomic.StoreInt32(&healthy, 0)
+	c.checkAll()
+	assert.True(t, c.Healthy(addr))
+	c.checkAll()
+	assert.False(t, c.Healthy(addr))
+	assert.Contains(t, c.String(), addr+": unhealthy, err=unexpected status 503")
+
+	atomic.StoreInt32(&healthy, 1)
+	c.checkAll()
+	assert.False(t, c.Healthy(addr))
+	c.checkAll()
+	assert.True(t, c.Healthy(addr))
+	assert.Equal(t, []bool{false, true}, changes)
+
+	c.Remove(addr)
+	assert.Equal(t, "health check: http /health every 5s", c.String())
+}
+
+func TestBodyMismatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("starting"))
+	}))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	c, err := New(&config.HealthCheck{Body: "ready", UnhealthyThreshold: 1}, nil)
+	assert.NoError(t, err)
+	c.Add(addr)
+	c.Add("127.0.0.1:1")
+	c.checkAll()
+	assert.False(t, c.Healthy(addr))
+	assert.False(t, c.Healthy("127.0.0.1:1"))
+	assert.True(t, c.Healthy("unknown"))
+	assert.Contains(t, c.String(), "body does not contain 'ready'")
+}
+
+func TestHTTPSProber(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ready"))
+	}))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "https://")
+
+	c, err := New(&config.HealthCheck{UnhealthyThreshold: 1}, nil)
+	assert.NoError(t, err)
+	// the scheme of the address is https
+	c.Add(ts.URL)
+	c.checkAll()
+	assert.False(t, c.Healthy(ts.URL))
+	assert.Contains(t, c.String(), "certificate")
+
+	c.SetUpstream("http1", &tls.Config{InsecureSkipVerify: true})
+	c.Add(addr)
+	c.checkAll()
+	assert.True(t, c.Healthy(addr))
+	assert.Contains(t, c.String(), "health check: https / every 5s")
+}
+
+func TestUpstreamProber(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+		}
+	})
+	h2cServer := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer h2cServer.Close()
+	h2cAddr := h2cServer.Listener.Addr().String()
+	h2Server := httptest.NewUnstartedServer(handler)
+	h2Server.EnableHTTP2 = true
+	h2Server.StartTLS()
+	defer h2Server.Close()
+	h2Addr := h2Server.Listener.Addr().String()
+
+	c, err := New(&config.HealthCheck{HealthyThreshold: 1, UnhealthyThreshold: 1}, nil)
+	require.NoError(t, err)
+	c.Add(h2cAddr)
+	c.checkAll()
+	assert.False(t, c.Healthy(h2cAddr))
+	assert.Contains(t, c.String(), "unexpected status 505")
+
+	c.SetUpstream("h2c", nil)
+	c.checkAll()
+	assert.True(t, c.Healthy(h2cAddr))
+	assert.Contains(t, c.String(), "health check: http / every 5s")
+
+	c, err = New(&config.HealthCheck{UnhealthyThreshold: 1}, nil)
+	require.NoError(t, err)
+	c.SetUpstream("h2", &tls.Config{InsecureSkipVerify: true})
+	c.Add(h2Addr)
+	c.checkAll()
+	assert.True(t, c.Healthy(h2Addr))
+	assert.Contains(t, c.String(), "health check: https / every 5s")
+}
+
+func TestTCPProber(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+
+	c, err := New(&config.HealthCheck{Type: TypeTCP, UnhealthyThreshold: 1}, nil)
+	require.NoError(t, err)
+	c.Add(addr)
+	c.checkAll()
+	assert.True(t, c.Healthy(addr))
+
+	ln.Close()
+	c.checkAll()
+	assert.False(t, c.Healthy(addr))
+	assert.Contains(t, c.String(), "health check: tcp every 5s")
+}
+
+type healthServer struct {
+	status grpc_health_v1.HealthCheckResponse_ServingStatus
+}
+
+func (s *healthServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if req.Service != "" && req.Service != "echo" {
+		return nil, status.Error(codes.NotFound, "unknown service")
+	}
+	return &grpc_health_v1.HealthCheckResponse{Status: s.status}, nil
+}
+
+func (s *healthServer) Watch(req *grpc_health_v1.HealthCheckRequest, stream grpc_health_v1.Health_WatchServer) error {
+	return status.Error(codes.Unimplemented, "unimplemented")
+}
+
+func TestGRPCProber(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	hs := &healthServer{status: grpc_health_v1.HealthCheckResponse_SERVING}
+	server := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(server, hs)
+	go server.Serve(ln)
+	defer server.Stop()
+
+	p, err := newProber(&config.HealthCheck{Type: TypeGRPC, GRPCService: "echo"})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, p.probe(ctx, addr))
+
+	hs.status = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	assert.EqualError(t, p.probe(ctx, addr), "serving status NOT_SERVING")
+
+	p = &grpcProber{service: "unknown"}
+	assert.Contains(t, p.probe(ctx, addr).Error(), "unknown service")
+
+	_, err = newProber(&config.HealthCheck{Type: "udp"})
+	assert.EqualError(t, err, "health check type 'udp' is not supported")
+}
@@ -0,0 +1,250 @@
+package healthcheck
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/onestraw/golb/config"
+)
+
+// maxBodySize is the maximum size of the response body to match.
+const maxBodySize = 64 * 1024
+
+type prober interface {
+	probe(ctx context.Context, addr string) error
+}
+
+// upstreamProber is implemented by the prober which speaks the upstream
+// protocol, i.e. "http1", "h2" or "h2c", to the peers.
+type upstreamProber interface {
+	setUpstream(proto string, cfg *tls.Config)
+}
+
+// splitScheme returns the scheme and the host:port of the peer address,
+// e.g. "https://10.0.0.1:443", the scheme is empty if not specified.
+func splitScheme(addr string) (string, string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i], addr[i+3:]
+	}
+	return "", addr
+}
+
+func newProber(cfg *config.HealthCheck) (prober, error) {
+	switch cfg.Type {
+	case "", TypeHTTP:
+		return newHTTPProber(cfg)
+	case TypeTCP:
+		return &tcpProber{}, nil
+	case TypeGRPC:
+		return &grpcProber{service: cfg.GRPCService}, nil
+	}
+	return nil, fmt.Errorf("health check type '%s' is not supported", cfg.Type)
+}
+
+type statusRange struct {
+	min, max int
+}
+
+// parseStatus parses the expected status codes, e.g. "200", "200-399",
+// "200,204,300-399".
+func parseStatus(status string) ([]statusRange, error) {
+	if status == "" {
+		status = DefaultStatus
+	}
+	result := []statusRange{}
+	for _, s := range strings.Split(status, ",") {
+		s = strings.TrimSpace(s)
+		bounds := strings.SplitN(s, "-", 2)
+		min, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		if err != nil {
+			return nil, fmt.Errorf("health check status '%s' is invalid", status)
+		}
+		max := min
+		if len(bounds) == 2 {
+			if max, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+				return nil, fmt.Errorf("health check status '%s' is invalid", status)
+			}
+		}
+		if min < 100 || max > 599 || min > max {
+			return nil, fmt.Errorf("health check status '%s' is invalid", status)
+		}
+		result = append(result, statusRange{min, max})
+	}
+	return result, nil
+}
+
+type httpProber struct {
+	scheme string
+	path   string
+	status []statusRange
+	body   string
+	client *http.Client
+}
+
+func newHTTPProber(cfg *config.HealthCheck) (*httpProber, error) {
+	status, err := parseStatus(cfg.Status)
+	if err != nil {
+		return nil, err
+	}
+	path := cfg.Path
+	if path == "" {
+		path = DefaultPath
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("health check path '%s' should start with '/'", path)
+	}
+	return &httpProber{
+		scheme: "http",
+		path:   path,
+		status: status,
+		body:   cfg.Body,
+		client: &http.Client{
+			Transport: &http.Transport{DisableKeepAlives: true},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+func (p *httpProber) String() string {
+	return p.scheme + " " + p.path
+}
+
+func (p *httpProber) setUpstream(proto string, cfg *tls.Config) {
+	switch proto {
+	case "h2":
+		p.scheme = "https"
+		p.client.Transport = &http2.Transport{TLSClientConfig: cfg}
+	case "h2c":
+		p.scheme = "http"
+		p.client.Transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.DialTimeout(network, addr, DefaultTimeout)
+			},
+		}
+	default:
+		if cfg != nil {
+			p.scheme = "https"
+			p.client.Transport = &http.Transport{DisableKeepAlives: true, TLSClientConfig: cfg}
+		}
+	}
+}
+
+func (p *httpProber) expected(code int) bool {
+	for _, r := range p.status {
+		if code >= r.min && code <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *httpProber) probe(ctx context.Context, addr string) error {
+	scheme, host := splitScheme(addr)
+	if scheme == "" {
+		scheme = p.scheme
+	}
+	req, err := http.NewRequest(http.MethodGet, scheme+"://"+host+p.path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if !p.expected(resp.StatusCode) {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxBodySize))
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if p.body == "" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(body), p.body) {
+		return fmt.Errorf("body does not contain '%s'", p.body)
+	}
+	return nil
+}
+
+// tcpProber checks if the peer accepts the connection.
+type tcpProber struct {
+	dialer net.Dialer
+}
+
+func (p *tcpProber) String() string {
+	return TypeTCP
+}
+
+func (p *tcpProber) probe(ctx context.Context, addr string) error {
+	_, host := splitScheme(addr)
+	conn, err := p.dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// grpcProber checks the peer with the standard grpc.health.v1 protocol,
+// the overall health of the server is checked if service is empty.
+type grpcProber struct {
+	service string
+	tls     *tls.Config
+}
+
+func (p *grpcProber) setUpstream(proto string, cfg *tls.Config) {
+	if cfg == nil && proto == "h2" {
+		cfg = &tls.Config{}
+	}
+	p.tls = cfg
+}
+
+func (p *grpcProber) String() string {
+	if p.service == "" {
+		return TypeGRPC
+	}
+	return TypeGRPC + " " + p.service
+}
+
+func (p *grpcProber) probe(ctx context.Context, addr string) error {
+	scheme, host := splitScheme(addr)
+	creds := grpc.WithInsecure()
+	if p.tls != nil {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(p.tls))
+	} else if scheme == "https" {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+	}
+	conn, err := grpc.DialContext(ctx, host, creds, grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx,
+		&grpc_health_v1.HealthCheckRequest{Service: p.service})
+	if err != nil {
+		return err
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("serving status %s", resp.Status)
+	}
+	return nil
+}
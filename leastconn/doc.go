@@ -0,0 +1,10 @@
+// Package leastconn provides weighted least-connections balancing
+//
+// A request is passed to the peer with the least number of active
+// requests, taking into account the weights of peers, so that long-lived
+// or slow requests do not pile up on one peer.
+// If there are several such peers, they are tried in turn.
+//
+// the basic idea is from nginx, refer details in following link
+// https://nginx.org/en/docs/http/ngx_http_upstream_module.html#least_conn
+package leastconn
@@ -0,0 +1,249 @@
+package leastconn
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// slowStartScale scales the weights in slow start, so that a peer of
+// weight 1 can ramp up too.
+const slowStartScale = 100
+
+// Peer represents a backend server.
+type Peer struct {
+	addr   string
+	weight int
+	active int64
+	down   bool
+	// the time of joining or recovering, used for slow start
+	start time.Time
+}
+
+func (p *Peer) String() string {
+	return fmt.Sprintf("%s: (w=%d, active=%d)", p.addr, p.weight, atomic.LoadInt64(&p.active))
+}
+
+// CreatePeer return a Peer object.
+func CreatePeer(addr string, weight int) *Peer {
+	if weight <= 0 {
+		weight = 1
+	}
+	return &Peer{
+		addr:   addr,
+		weight: weight,
+		active: 0,
+		down:   false,
+	}
+}
+
+// Pool is a group of Peers.
+type Pool struct {
+	peers     []*Peer
+	current   uint64
+	downNum   int
+	slowStart time.Duration
+	sync.RWMutex
+}
+
+// SetSlowStart sets the duration in which the weight of a new or recovered
+// peer ramps up linearly, the peers added before are not affected.
+func (p *Pool) SetSlowStart(d time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.slowStart = d
+}
+
+// weightOf returns the weight of the peer, which is scaled and ramps up
+// linearly in slow start.
+func (p *Pool) weightOf(peer *Peer, now time.Time) int64 {
+	if p.slowStart <= 0 {
+		return int64(peer.weight)
+	}
+	weight := int64(peer.weight * slowStartScale)
+	elapsed := now.Sub(peer.start)
+	if peer.start.IsZero() || elapsed >= p.slowStart {
+		return weight
+	}
+	if w := weight * int64(elapsed) / int64(p.slowStart); w > 1 {
+		return w
+	}
+	return 1
+}
+
+func (p *Pool) String() string {
+	p.RLock()
+	defer p.RUnlock()
+	result := []string{}
+	for _, peer := range p.peers {
+		result = append(result, peer.addr)
+	}
+	sort.Strings(result)
+	return strings.Join(result, ", ")
+}
+
+// Size return the number of the peer.
+func (p *Pool) Size() int {
+	p.RLock()
+	defer p.RUnlock()
+	return len(p.peers)
+}
+
+func (p *Pool) indexOfPeer(addr string) int {
+	for i, peer := range p.peers {
+		if peer.addr == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *Pool) findPeer(addr string) *Peer {
+	p.RLock()
+	defer p.RUnlock()
+	if idx := p.indexOfPeer(addr); idx >= 0 {
+		return p.peers[idx]
+	}
+	return nil
+}
+
+// Add append a peer to the pool if not exists.
+func (p *Pool) Add(addr string, args ...interface{}) {
+	if addr == "" {
+		return
+	}
+	weight := 1
+	if len(args) > 0 {
+		if w, ok := args[0].(int); ok {
+			weight = w
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if idx := p.indexOfPeer(addr); idx >= 0 {
+		return
+	}
+	peer := CreatePeer(addr, weight)
+	if p.slowStart > 0 {
+		peer.start = time.Now()
+	}
+	p.peers = append(p.peers, peer)
+}
+
+// Remove removes the peer from the pool.
+func (p *Pool) Remove(addr string) {
+	p.Lock()
+	defer p.Unlock()
+
+	if idx := p.indexOfPeer(addr); idx >= 0 {
+		if p.peers[idx].down {
+			p.downNum--
+		}
+		p.peers = append(p.peers[:idx], p.peers[idx+1:]...)
+	}
+}
+
+func (p *Pool) setPeerStatus(addr string, isDown bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	idx := p.indexOfPeer(addr)
+	if idx < 0 {
+		return
+	}
+	peer := p.peers[idx]
+	if peer.down != isDown {
+		if isDown {
+			p.downNum++
+		} else {
+			p.downNum--
+		}
+		peer.down = isDown
+		if !isDown && p.slowStart > 0 {
+			peer.start = time.Now()
+		}
+	}
+}
+
+// DownPeer mark the peer down.
+func (p *Pool) DownPeer(addr string) {
+	p.setPeerStatus(addr, true)
+}
+
+// UpPeer mark the peer up.
+func (p *Pool) UpPeer(addr string) {
+	p.setPeerStatus(addr, false)
+}
+
+// Acquire increases the number of active requests of the peer.
+func (p *Pool) Acquire(addr string) {
+	if peer := p.findPeer(addr); peer != nil {
+		atomic.AddInt64(&peer.active, 1)
+	}
+}
+
+// Release decreases the number of active requests of the peer.
+func (p *Pool) Release(addr string) {
+	if peer := p.findPeer(addr); peer != nil {
+		if atomic.AddInt64(&peer.active, -1) < 0 {
+			atomic.StoreInt64(&peer.active, 0)
+		}
+	}
+}
+
+// Get return the peer with the least active requests relative to its weight,
+// the peers with equal load are picked by turn.
+func (p *Pool) Get(args ...interface{}) string {
+	return p.GetExcluding(nil, args...)
+}
+
+// GetExcluding is Get but skips the excluded peers.
+func (p *Pool) GetExcluding(exclude map[string]bool, args ...interface{}) string {
+	p.RLock()
+	defer p.RUnlock()
+
+	size := len(p.peers)
+	if size <= 0 || p.downNum >= size {
+		return ""
+	}
+
+	now := time.Now()
+	start := (atomic.AddUint64(&p.current, 1) - 1) % uint64(size)
+	var best *Peer
+	var bestActive, bestWeight int64
+	for i := 0; i < size; i++ {
+		peer := p.peers[(start+uint64(i))%uint64(size)]
+		if peer.down || exclude[peer.addr] {
+			continue
+		}
+		active := atomic.LoadInt64(&peer.active)
+		weight := p.weightOf(peer, now)
+		// active/weight < bestActive/bestWeight
+		if best == nil || active*bestWeight < bestActive*weight {
+			best = peer
+			bestActive = active
+			bestWeight = weight
+		}
+	}
+	if best != nil {
+		return best.addr
+	}
+	return ""
+}
+
+// CreatePool return a Pool object.
+func CreatePool(pairs map[string]int) *Pool {
+	pool := &Pool{
+		current: 0,
+		downNum: 0,
+	}
+	for addr, weight := range pairs {
+		pool.Add(addr, weight)
+	}
+	return pool
+}
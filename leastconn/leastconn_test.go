@@ -0,0 +1,144 @@
+package leastconn
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testGetPeer(t *testing.T, pool *Pool, getCount int, expected string) {
+	t.Logf("%v", pool)
+	result := []string{}
+	for i := 0; i < getCount; i++ {
+		peer := pool.Get()
+		result = append(result, peer)
+	}
+	assert.Equal(t, expected, strings.Join(result, ","))
+}
+
+func TestGetPeerByTurn(t *testing.T) {
+	pool := &Pool{peers: []*Peer{
+		CreatePeer("a", 1),
+		CreatePeer("b", 1),
+		CreatePeer("c", 1),
+	}}
+	testGetPeer(t, pool, 6, "a,b,c,a,b,c")
+}
+
+func TestGetLeastActive(t *testing.T) {
+	pool := &Pool{peers: []*Peer{
+		CreatePeer("a", 1),
+		CreatePeer("b", 1),
+		CreatePeer("c", 1),
+	}}
+	pool.Acquire("a")
+	pool.Acquire("a")
+	pool.Acquire("b")
+	testGetPeer(t, pool, 3, "c,c,c")
+
+	pool.Acquire("c")
+	pool.Acquire("c")
+	testGetPeer(t, pool, 3, "b,b,b")
+
+	pool.Release("a")
+	pool.Release("a")
+	testGetPeer(t, pool, 3, "a,a,a")
+
+	// release more than acquired
+	pool.Release("a")
+	assert.Equal(t, int64(0), pool.peers[0].active)
+}
+
+func TestGetWithWeight(t *testing.T) {
+	pool := &Pool{peers: []*Peer{
+		CreatePeer("a", 3),
+		CreatePeer("b", 1),
+	}}
+	for i := 0; i < 2; i++ {
+		pool.Acquire("a")
+	}
+	pool.Acquire("b")
+	// a: 2/3 < b: 1/1
+	testGetPeer(t, pool, 2, "a,a")
+
+	pool.Acquire("a")
+	pool.Acquire("a")
+	// a: 4/3 > b: 1/1
+	testGetPeer(t, pool, 2, "b,b")
+}
+
+func TestAddPeer(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1})
+	assert.Equal(t, 1, pool.Size())
+
+	pool.Add("b", 2)
+	assert.Equal(t, 2, pool.Size())
+	assert.Equal(t, 2, pool.findPeer("b").weight)
+
+	pool.Add("b", 1)
+	assert.Equal(t, 2, pool.Size())
+
+	pool.Add("c", 0)
+	assert.Equal(t, 1, pool.findPeer("c").weight)
+	assert.Equal(t, "a, b, c", pool.String())
+}
+
+func TestRemovePeer(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1, "b": 1})
+	assert.Equal(t, 2, pool.Size())
+
+	pool.DownPeer("b")
+	pool.Remove("b")
+	assert.Equal(t, 1, pool.Size())
+	assert.Equal(t, 0, pool.downNum)
+	pool.Remove("b")
+	assert.Equal(t, 1, pool.Size())
+
+	// no effect on the removed peer
+	pool.Acquire("b")
+	pool.Release("b")
+
+	pool.Remove("a")
+	assert.Equal(t, 0, pool.Size())
+}
+
+func TestEmpty(t *testing.T) {
+	pool := CreatePool(map[string]int{})
+	assert.Equal(t, "", pool.Get())
+
+	pool.Add("", 1)
+	assert.Equal(t, 0, pool.Size())
+}
+
+func TestDownPeer(t *testing.T) {
+	pool := &Pool{peers: []*Peer{
+		CreatePeer("a", 1),
+		CreatePeer("b", 1),
+	}}
+	testGetPeer(t, pool, 4, "a,b,a,b")
+
+	pool.DownPeer("b")
+	testGetPeer(t, pool, 4, "a,a,a,a")
+
+	pool.UpPeer("b")
+	testGetPeer(t, pool, 4, "a,b,a,b")
+
+	pool.DownPeer("a")
+	pool.DownPeer("b")
+	testGetPeer(t, pool, 4, ",,,")
+}
+
+func TestGetExcluding(t *testing.T) {
+	pool := &Pool{peers: []*Peer{
+		CreatePeer("a", 1),
+		CreatePeer("b", 1),
+		CreatePeer("c", 1),
+	}}
+	pool.Acquire("b")
+	pool.Acquire("c")
+	pool.Acquire("c")
+	assert.Equal(t, "a", pool.GetExcluding(nil))
+	assert.Equal(t, "b", pool.GetExcluding(map[string]bool{"a": true}))
+	assert.Equal(t, "", pool.GetExcluding(map[string]bool{"a": true, "b": true, "c": true}))
+}
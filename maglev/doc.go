@@ -0,0 +1,11 @@
+// Package maglev provides Maglev consistent hashing balancing
+//
+// Each peer fills a fixed size (prime) lookup table along its own
+// permutation of the table positions, so the lookup is O(1) and the peers
+// own nearly equal shares of the table. When a peer is added, removed or
+// marked down, the table is rebuilt from the healthy peers and only a few
+// keys are remapped besides the ones owned by the changed peer.
+//
+// the basic idea is from google, refer details in following link
+// https://research.google/pubs/pub44824/
+package maglev
@@ -0,0 +1,227 @@
+package maglev
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultTableSize is the size of the lookup table, it must be a prime
+// and much larger than the number of peers.
+const DefaultTableSize = 65537
+
+// Peer defines a single server.
+type Peer struct {
+	addr   string
+	weight int
+	down   bool
+}
+
+// Pool is a set of Peers.
+type Pool struct {
+	sync.RWMutex
+	size    uint64
+	peers   map[string]*Peer
+	table   []*Peer
+	downNum int
+}
+
+// New returns a Pool object.
+func New() *Pool {
+	return newWithSize(DefaultTableSize)
+}
+
+func newWithSize(size uint64) *Pool {
+	return &Pool{
+		size:  size,
+		peers: map[string]*Peer{},
+	}
+}
+
+func hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// populate rebuilds the lookup table from the healthy peers.
+func (p *Pool) populate() {
+	healthy := []*Peer{}
+	for _, peer := range p.peers {
+		if !peer.down {
+			healthy = append(healthy, peer)
+		}
+	}
+	if len(healthy) == 0 {
+		p.table = nil
+		return
+	}
+	// the table must not depend on the order of adding peers
+	sort.Slice(healthy, func(i, j int) bool {
+		return healthy[i].addr < healthy[j].addr
+	})
+
+	offset := make([]uint64, len(healthy))
+	skip := make([]uint64, len(healthy))
+	next := make([]uint64, len(healthy))
+	for i, peer := range healthy {
+		offset[i] = hash(peer.addr+"#offset") % p.size
+		skip[i] = hash(peer.addr+"#skip")%(p.size-1) + 1
+	}
+
+	table := make([]*Peer, p.size)
+	filled := uint64(0)
+	for {
+		for i, peer := range healthy {
+			// a peer fills as many positions as its weight in each round
+			for w := 0; w < peer.weight; w++ {
+				c := (offset[i] + next[i]*skip[i]) % p.size
+				for table[c] != nil {
+					next[i]++
+					c = (offset[i] + next[i]*skip[i]) % p.size
+				}
+				table[c] = peer
+				next[i]++
+				filled++
+				if filled == p.size {
+					p.table = table
+					return
+				}
+			}
+		}
+	}
+}
+
+func (p *Pool) String() string {
+	p.RLock()
+	defer p.RUnlock()
+	result := []string{}
+	for addr := range p.peers {
+		result = append(result, addr)
+	}
+	sort.Strings(result)
+	return strings.Join(result, ", ")
+}
+
+// Size return the number of peers.
+func (p *Pool) Size() int {
+	p.RLock()
+	defer p.RUnlock()
+	return len(p.peers)
+}
+
+// Add adds a peer by address, the share of the table is proportional to
+// the weight in args[0].
+func (p *Pool) Add(addr string, args ...interface{}) {
+	if addr == "" {
+		return
+	}
+	weight := 1
+	if len(args) > 0 {
+		if w, ok := args[0].(int); ok && w > 0 {
+			weight = w
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if _, ok := p.peers[addr]; ok {
+		return
+	}
+	p.peers[addr] = &Peer{addr: addr, weight: weight}
+	p.populate()
+}
+
+// Remove deletes a peer by address.
+func (p *Pool) Remove(addr string) {
+	p.Lock()
+	defer p.Unlock()
+
+	peer, ok := p.peers[addr]
+	if !ok {
+		return
+	}
+	if peer.down {
+		p.downNum--
+	}
+	delete(p.peers, addr)
+	p.populate()
+}
+
+func (p *Pool) setPeerStatus(addr string, isDown bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	peer, ok := p.peers[addr]
+	if !ok || peer.down == isDown {
+		return
+	}
+	if isDown {
+		p.downNum++
+	} else {
+		p.downNum--
+	}
+	peer.down = isDown
+	p.populate()
+}
+
+// DownPeer mark the peer down.
+func (p *Pool) DownPeer(addr string) {
+	p.setPeerStatus(addr, true)
+}
+
+// UpPeer mark the peer up.
+func (p *Pool) UpPeer(addr string) {
+	p.setPeerStatus(addr, false)
+}
+
+// Get use a key to look up the backend server in the table.
+func (p *Pool) Get(args ...interface{}) string {
+	return p.GetExcluding(nil, args...)
+}
+
+// GetExcluding is Get but skips the excluded peers, the key is mapped to
+// the peer of the next entry in the table.
+func (p *Pool) GetExcluding(exclude map[string]bool, args ...interface{}) string {
+	if len(args) == 0 {
+		return ""
+	}
+	key, ok := args[0].(string)
+	if !ok {
+		return ""
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+
+	if len(p.table) == 0 {
+		return ""
+	}
+	h := hash(key)
+	for i := uint64(0); i < p.size; i++ {
+		if peer := p.table[(h+i)%p.size]; !exclude[peer.addr] {
+			return peer.addr
+		}
+	}
+	return ""
+}
+
+// CreatePool returns a Pool object.
+func CreatePool(pairs map[string]int) *Pool {
+	pool := New()
+	pool.Lock()
+	defer pool.Unlock()
+	for addr, weight := range pairs {
+		if addr == "" {
+			continue
+		}
+		if weight <= 0 {
+			weight = 1
+		}
+		pool.peers[addr] = &Peer{addr: addr, weight: weight}
+	}
+	pool.populate()
+	return pool
+}
@@ -0,0 +1,108 @@
+package maglev
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func lookupAll(pool *Pool, n int) []string {
+	result := make([]string, n)
+	for i := 0; i < n; i++ {
+		result[i] = pool.Get(fmt.Sprintf("key-%d", i))
+	}
+	return result
+}
+
+func TestGetEmpty(t *testing.T) {
+	pool := New()
+	assert.Equal(t, "", pool.Get("any"))
+	assert.Equal(t, "", pool.Get())
+	assert.Equal(t, "", pool.Get(10))
+
+	pool.Add("")
+	assert.Equal(t, 0, pool.Size())
+}
+
+func TestPopulate(t *testing.T) {
+	pool := newWithSize(13)
+	pool.Add("1.1.1.1")
+	pool.Add("2.2.2.2")
+	pool.Add("3.3.3.3", 2)
+	assert.Equal(t, 3, pool.Size())
+	assert.Equal(t, "1.1.1.1, 2.2.2.2, 3.3.3.3", pool.String())
+
+	count := map[string]int{}
+	for _, peer := range pool.table {
+		count[peer.addr]++
+	}
+	t.Logf("%v", count)
+	assert.Equal(t, 13, count["1.1.1.1"]+count["2.2.2.2"]+count["3.3.3.3"])
+	assert.True(t, count["3.3.3.3"] >= 6)
+}
+
+func TestDeterministic(t *testing.T) {
+	a := CreatePool(map[string]int{"1.1.1.1": 1, "2.2.2.2": 1, "3.3.3.3": 1})
+	b := New()
+	b.Add("3.3.3.3")
+	b.Add("1.1.1.1")
+	b.Add("2.2.2.2")
+	assert.Equal(t, lookupAll(a, 1000), lookupAll(b, 1000))
+}
+
+func TestMinimalDisruption(t *testing.T) {
+	pool := CreatePool(map[string]int{"1.1.1.1": 1, "2.2.2.2": 1, "3.3.3.3": 1, "4.4.4.4": 1})
+	before := lookupAll(pool, 10000)
+
+	pool.DownPeer("4.4.4.4")
+	after := lookupAll(pool, 10000)
+	moved := 0
+	for i := range before {
+		assert.NotEqual(t, "4.4.4.4", after[i])
+		if before[i] != "4.4.4.4" && before[i] != after[i] {
+			moved++
+		}
+	}
+	t.Logf("moved %d keys of other peers", moved)
+	assert.True(t, moved < 1000)
+
+	pool.UpPeer("4.4.4.4")
+	assert.Equal(t, before, lookupAll(pool, 10000))
+
+	pool.Remove("4.4.4.4")
+	assert.Equal(t, after, lookupAll(pool, 10000))
+	assert.Equal(t, 3, pool.Size())
+}
+
+func TestDownPeer(t *testing.T) {
+	pool := CreatePool(map[string]int{"1.1.1.1": 1, "2.2.2.2": 1})
+	pool.DownPeer("1.1.1.1")
+	pool.DownPeer("1.1.1.1")
+	assert.Equal(t, 1, pool.downNum)
+	for _, peer := range lookupAll(pool, 100) {
+		assert.Equal(t, "2.2.2.2", peer)
+	}
+
+	pool.DownPeer("2.2.2.2")
+	assert.Equal(t, "", pool.Get("any"))
+
+	pool.Remove("2.2.2.2")
+	assert.Equal(t, 1, pool.downNum)
+	pool.UpPeer("1.1.1.1")
+	assert.Equal(t, "1.1.1.1", pool.Get("any"))
+}
+
+func TestGetExcluding(t *testing.T) {
+	pool := CreatePool(map[string]int{"1.1.1.1": 1, "2.2.2.2": 1, "3.3.3.3": 1})
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		peer := pool.Get(key)
+		assert.Equal(t, peer, pool.GetExcluding(nil, key))
+		other := pool.GetExcluding(map[string]bool{peer: true}, key)
+		assert.NotEqual(t, "", other)
+		assert.NotEqual(t, peer, other)
+	}
+	all := map[string]bool{"1.1.1.1": true, "2.2.2.2": true, "3.3.3.3": true}
+	assert.Equal(t, "", pool.GetExcluding(all, "any"))
+}
@@ -0,0 +1,17 @@
+// Package outlier provides outlier detection of the backend servers
+//
+// A peer is ejected from the pool when
+//   - it returns consecutive_5xx 5xx responses in a row
+//   - it returns consecutive_gateway_failure 502/503/504 responses or connect errors
+//     in a row, which is lower than consecutive_5xx by default
+//   - its success rate in the last interval is below mean - stdev_factor * stdev of the
+//     pool, if at least success_rate_minimum_hosts peers serve success_rate_request_volume
+//     requests in the last interval, the window slides by a tenth of the interval
+//
+// An ejected peer returns after base_ejection_time, which doubles on every
+// ejection in a row up to max_ejection_time, and no more than max_ejection_percent
+// of the peers are ejected at the same time. The doubling is undone by one every
+// interval the peer stays healthy after base_ejection_time.
+//
+// Reference: https://www.envoyproxy.io/docs/envoy/latest/intro/arch_overview/upstream/outlier
+package outlier
@@ -0,0 +1,375 @@
+package outlier
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/onestraw/golb/config"
+)
+
+// Defaults of outlier detection.
+const (
+	DefaultConsecutive5xx            = 5
+	DefaultConsecutiveGatewayFailure = 3
+	DefaultInterval                  = 10 * time.Second
+	DefaultBaseEjectionTime          = 30 * time.Second
+	DefaultMaxEjectionTime           = 300 * time.Second
+	DefaultMaxEjectionPercent        = 10
+	DefaultSuccessRateMinimumHosts   = 5
+	DefaultSuccessRateRequestVolume  = 100
+	DefaultSuccessRateStdevFactor    = 1.9
+
+	// windowBuckets is the number of buckets of the success rate window,
+	// the window slides by a bucket every interval / windowBuckets.
+	windowBuckets = 10
+)
+
+// bucket counts the requests of a part of the window.
+type bucket struct {
+	requests  int
+	successes int
+}
+
+type peerStats struct {
+	// the ring of buckets of the last interval, current is being filled
+	buckets [windowBuckets]bucket
+	current int
+
+	consecutive5xx     int
+	consecutiveGateway int
+
+	ejected    bool
+	ejectTimes int
+	until      time.Time
+	reason     string
+	// the last time the ejection times decayed
+	decayed time.Time
+}
+
+func (s *peerStats) String() string {
+	if s.ejected {
+		return fmt.Sprintf("ejected by %s until %s", s.reason, s.until.Format(time.RFC3339))
+	}
+	return "ok"
+}
+
+func (s *peerStats) reset() {
+	s.consecutive5xx = 0
+	s.consecutiveGateway = 0
+	s.buckets = [windowBuckets]bucket{}
+}
+
+// window returns the requests and the successes in the window.
+func (s *peerStats) window() (int, int) {
+	requests, successes := 0, 0
+	for _, b := range s.buckets {
+		requests += b.requests
+		successes += b.successes
+	}
+	return requests, successes
+}
+
+// slide drops the oldest bucket of the window.
+func (s *peerStats) slide() {
+	s.current = (s.current + 1) % windowBuckets
+	s.buckets[s.current] = bucket{}
+}
+
+// Detector ejects the peers with abnormal errors temporarily.
+type Detector struct {
+	sync.Mutex
+	consecutive5xx     int
+	consecutiveGateway int
+	interval           time.Duration
+	baseEjectionTime   time.Duration
+	maxEjectionTime    time.Duration
+	maxEjectionPercent int
+	minimumHosts       int
+	requestVolume      int
+	stdevFactor        float64
+
+	peers    map[string]*peerStats
+	onChange func(addr string, ejected bool)
+	stopC    chan struct{}
+}
+
+// New returns a Detector object, onChange is called when a peer is ejected
+// or returns.
+func New(cfg *config.OutlierDetection, onChange func(addr string, ejected bool)) (*Detector, error) {
+	d := &Detector{
+		consecutive5xx:     DefaultConsecutive5xx,
+		consecutiveGateway: DefaultConsecutiveGatewayFailure,
+		interval:           DefaultInterval,
+		baseEjectionTime:   DefaultBaseEjectionTime,
+		maxEjectionTime:    DefaultMaxEjectionTime,
+		maxEjectionPercent: DefaultMaxEjectionPercent,
+		minimumHosts:       DefaultSuccessRateMinimumHosts,
+		requestVolume:      DefaultSuccessRateRequestVolume,
+		stdevFactor:        DefaultSuccessRateStdevFactor,
+		peers:              map[string]*peerStats{},
+		onChange:           onChange,
+	}
+	if cfg.Consecutive5xx > 0 {
+		d.consecutive5xx = cfg.Consecutive5xx
+	}
+	if cfg.ConsecutiveGatewayFailure > 0 {
+		d.consecutiveGateway = cfg.ConsecutiveGatewayFailure
+	}
+	if cfg.Interval > 0 {
+		d.interval = time.Duration(cfg.Interval) * time.Second
+	}
+	if cfg.BaseEjectionTime > 0 {
+		d.baseEjectionTime = time.Duration(cfg.BaseEjectionTime) * time.Second
+	}
+	if cfg.MaxEjectionTime > 0 {
+		d.maxEjectionTime = time.Duration(cfg.MaxEjectionTime) * time.Second
+	}
+	if cfg.MaxEjectionPercent > 0 {
+		d.maxEjectionPercent = cfg.MaxEjectionPercent
+	}
+	if cfg.SuccessRateMinimumHosts > 0 {
+		d.minimumHosts = cfg.SuccessRateMinimumHosts
+	}
+	if cfg.SuccessRateRequestVolume > 0 {
+		d.requestVolume = cfg.SuccessRateRequestVolume
+	}
+	if cfg.SuccessRateStdevFactor > 0 {
+		d.stdevFactor = cfg.SuccessRateStdevFactor
+	}
+	if d.maxEjectionPercent > 100 {
+		return nil, fmt.Errorf("max ejection percent %d is greater than 100", d.maxEjectionPercent)
+	}
+	if d.baseEjectionTime > d.maxEjectionTime {
+		return nil, fmt.Errorf("base ejection time %v is longer than max ejection time %v",
+			d.baseEjectionTime, d.maxEjectionTime)
+	}
+	return d, nil
+}
+
+// Add starts to track the peer.
+func (d *Detector) Add(addr string) {
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.peers[addr]; !ok {
+		d.peers[addr] = &peerStats{}
+	}
+}
+
+// Remove stops tracking the peer.
+func (d *Detector) Remove(addr string) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.peers, addr)
+}
+
+// Ejected returns true if the peer is ejected.
+func (d *Detector) Ejected(addr string) bool {
+	d.Lock()
+	defer d.Unlock()
+	if s, ok := d.peers[addr]; ok {
+		return s.ejected
+	}
+	return false
+}
+
+// String lists the ejected peers.
+func (d *Detector) String() string {
+	d.Lock()
+	defer d.Unlock()
+	keys := []string{}
+	for key := range d.peers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := []string{"outlier detection:"}
+	for _, key := range keys {
+		result = append(result, fmt.Sprintf("%s: %s", key, d.peers[key]))
+	}
+	return strings.Join(result, "\n")
+}
+
+func isGatewayFailure(code int) bool {
+	return code == http.StatusBadGateway ||
+		code == http.StatusServiceUnavailable ||
+		code == http.StatusGatewayTimeout
+}
+
+// Report records the status code of a response from the peer, a connect
+// error is reported as 502.
+func (d *Detector) Report(addr string, code int) {
+	d.Lock()
+	s, ok := d.peers[addr]
+	if !ok {
+		d.Unlock()
+		return
+	}
+	b := &s.buckets[s.current]
+	b.requests++
+	if code/100 == 5 {
+		s.consecutive5xx++
+	} else {
+		b.successes++
+		s.consecutive5xx = 0
+	}
+	if isGatewayFailure(code) {
+		s.consecutiveGateway++
+	} else {
+		s.consecutiveGateway = 0
+	}
+
+	ejected := false
+	if !s.ejected {
+		if s.consecutiveGateway >= d.consecutiveGateway {
+			ejected = d.eject(addr, s, "consecutive gateway failure", time.Now())
+		} else if s.consecutive5xx >= d.consecutive5xx {
+			ejected = d.eject(addr, s, "consecutive 5xx", time.Now())
+		}
+	}
+	d.Unlock()
+
+	if ejected && d.onChange != nil {
+		d.onChange(addr, true)
+	}
+}
+
+// eject ejects the peer if max ejection percent is not reached,
+// it must be called with lock.
+func (d *Detector) eject(addr string, s *peerStats, reason string, now time.Time) bool {
+	ejected := 0
+	for _, p := range d.peers {
+		if p.ejected {
+			ejected++
+		}
+	}
+	// never eject the whole pool, but at least one peer may be ejected
+	if ejected+1 >= len(d.peers) {
+		return false
+	}
+	if ejected > 0 && (ejected+1)*100 > len(d.peers)*d.maxEjectionPercent {
+		return false
+	}
+
+	s.ejected = true
+	s.ejectTimes++
+	s.reason = reason
+	duration := d.baseEjectionTime
+	for i := 1; i < s.ejectTimes && duration < d.maxEjectionTime; i++ {
+		duration *= 2
+	}
+	if duration > d.maxEjectionTime {
+		duration = d.maxEjectionTime
+	}
+	s.until = now.Add(duration)
+	s.reset()
+	log.Infof("Outlier detection: eject peer %s by %s for %v", addr, reason, duration)
+	return true
+}
+
+// evaluate brings back the peers whose ejection expires, ejects the peers
+// by the success rate of the window and slides the window.
+func (d *Detector) evaluate(now time.Time) {
+	changes := map[string]bool{}
+
+	d.Lock()
+	for addr, s := range d.peers {
+		if !s.ejected {
+			// the multiplier decays by one every interval the peer stays healthy
+			if s.ejectTimes > 0 && now.After(s.until.Add(d.baseEjectionTime)) &&
+				now.Sub(s.decayed) >= d.interval {
+				s.ejectTimes--
+				s.decayed = now
+			}
+			continue
+		}
+		if !now.Before(s.until) {
+			s.ejected = false
+			s.reset()
+			changes[addr] = false
+			log.Infof("Outlier detection: return peer %s", addr)
+		}
+	}
+
+	rates := map[string]float64{}
+	for addr, s := range d.peers {
+		if s.ejected {
+			continue
+		}
+		if requests, successes := s.window(); requests >= d.requestVolume {
+			rates[addr] = float64(successes) / float64(requests)
+		}
+	}
+	if len(rates) >= d.minimumHosts {
+		mean, stdev := meanAndStdev(rates)
+		threshold := mean - d.stdevFactor*stdev
+		for addr, rate := range rates {
+			if rate < threshold && d.eject(addr, d.peers[addr], "success rate", now) {
+				changes[addr] = true
+			}
+		}
+	}
+
+	for _, s := range d.peers {
+		s.slide()
+	}
+	d.Unlock()
+
+	if d.onChange != nil {
+		for addr, ejected := range changes {
+			d.onChange(addr, ejected)
+		}
+	}
+}
+
+func meanAndStdev(rates map[string]float64) (float64, float64) {
+	sum := 0.0
+	for _, rate := range rates {
+		sum += rate
+	}
+	mean := sum / float64(len(rates))
+	variance := 0.0
+	for _, rate := range rates {
+		variance += (rate - mean) * (rate - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(rates)))
+}
+
+// Start evaluates the peers every interval in background.
+func (d *Detector) Start() {
+	d.Lock()
+	defer d.Unlock()
+	if d.stopC != nil {
+		return
+	}
+	d.stopC = make(chan struct{})
+	go d.run(d.stopC)
+}
+
+// Stop stops evaluating.
+func (d *Detector) Stop() {
+	d.Lock()
+	defer d.Unlock()
+	if d.stopC != nil {
+		close(d.stopC)
+		d.stopC = nil
+	}
+}
+
+func (d *Detector) run(stopC chan struct{}) {
+	ticker := time.NewTicker(d.interval / windowBuckets)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopC:
+			return
+		case now := <-ticker.C:
+			d.evaluate(now)
+		}
+	}
+}
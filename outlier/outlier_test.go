@@ -0,0 +1,188 @@
+package outlier
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/onestraw/golb/config"
+)
+
+func createDetector(t *testing.T, cfg *config.OutlierDetection, n int) (*Detector, map[string]bool) {
+	changes := map[string]bool{}
+	d, err := New(cfg, func(addr string, ejected bool) {
+		changes[addr] = ejected
+	})
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		d.Add(fmt.Sprintf("10.0.0.%d", i))
+	}
+	return d, changes
+}
+
+func TestNewError(t *testing.T) {
+	_, err := New(&config.OutlierDetection{MaxEjectionPercent: 101}, nil)
+	assert.EqualError(t, err, "max ejection percent 101 is greater than 100")
+
+	_, err = New(&config.OutlierDetection{BaseEjectionTime: 60, MaxEjectionTime: 30}, nil)
+	assert.Error(t, err)
+}
+
+func TestConsecutive5xx(t *testing.T) {
+	d, changes := createDetector(t, &config.OutlierDetection{Consecutive5xx: 3}, 2)
+	d.Report("10.0.0.0", 500)
+	d.Report("10.0.0.0", 500)
+	d.Report("10.0.0.0", 200)
+	d.Report("10.0.0.0", 500)
+	d.Report("10.0.0.0", 500)
+	assert.False(t, d.Ejected("10.0.0.0"))
+
+	d.Report("10.0.0.0", 500)
+	assert.True(t, d.Ejected("10.0.0.0"))
+	assert.Equal(t, map[string]bool{"10.0.0.0": true}, changes)
+	assert.Contains(t, d.String(), "10.0.0.0: ejected by consecutive 5xx until")
+	assert.Contains(t, d.String(), "10.0.0.1: ok")
+
+	// never eject the whole pool
+	for i := 0; i < 3; i++ {
+		d.Report("10.0.0.1", 500)
+	}
+	assert.False(t, d.Ejected("10.0.0.1"))
+	d.Report("unknown", 500)
+}
+
+func TestConsecutiveGatewayFailure(t *testing.T) {
+	// the gateway failures are ejected first by default
+	d, _ := createDetector(t, &config.OutlierDetection{}, 2)
+	for i := 0; i < DefaultConsecutiveGatewayFailure; i++ {
+		d.Report("10.0.0.0", 502)
+	}
+	assert.Contains(t, d.String(), "10.0.0.0: ejected by consecutive gateway failure")
+
+	d, _ = createDetector(t, &config.OutlierDetection{Consecutive5xx: 10, ConsecutiveGatewayFailure: 2}, 2)
+	d.Report("10.0.0.0", 502)
+	d.Report("10.0.0.0", 500)
+	d.Report("10.0.0.0", 503)
+	assert.False(t, d.Ejected("10.0.0.0"))
+	d.Report("10.0.0.0", 504)
+	assert.True(t, d.Ejected("10.0.0.0"))
+	assert.Contains(t, d.String(), "ejected by consecutive gateway failure")
+}
+
+func TestMaxEjectionPercent(t *testing.T) {
+	d, _ := createDetector(t, &config.OutlierDetection{Consecutive5xx: 1, MaxEjectionPercent: 20}, 10)
+	for i := 0; i < 10; i++ {
+		d.Report(fmt.Sprintf("10.0.0.%d", i), 500)
+	}
+	ejected := 0
+	for i := 0; i < 10; i++ {
+		if d.Ejected(fmt.Sprintf("10.0.0.%d", i)) {
+			ejected++
+		}
+	}
+	assert.Equal(t, 2, ejected)
+}
+
+func TestEjectionTime(t *testing.T) {
+	d, changes := createDetector(t, &config.OutlierDetection{Consecutive5xx: 1, MaxEjectionTime: 100}, 2)
+	peer := d.peers["10.0.0.0"]
+	for _, expected := range []time.Duration{30, 60, 100, 100} {
+		now := time.Now()
+		d.Report("10.0.0.0", 500)
+		assert.True(t, d.Ejected("10.0.0.0"))
+		assert.InDelta(t, float64(expected*time.Second), float64(peer.until.Sub(now)), float64(time.Second))
+
+		d.evaluate(peer.until.Add(-time.Second))
+		assert.True(t, d.Ejected("10.0.0.0"))
+		d.evaluate(peer.until)
+		assert.False(t, d.Ejected("10.0.0.0"))
+		assert.Equal(t, map[string]bool{"10.0.0.0": false}, changes)
+	}
+
+	// the multiplier decays by one every interval while the peer stays healthy
+	assert.Equal(t, 4, peer.ejectTimes)
+	begin := peer.until.Add(time.Minute)
+	for i := 0; i < windowBuckets; i++ {
+		d.evaluate(begin.Add(time.Duration(i) * DefaultInterval / windowBuckets))
+	}
+	assert.Equal(t, 3, peer.ejectTimes)
+	d.evaluate(begin.Add(DefaultInterval))
+	assert.Equal(t, 2, peer.ejectTimes)
+}
+
+func TestEjectionTimeInARow(t *testing.T) {
+	d, _ := createDetector(t, &config.OutlierDetection{Consecutive5xx: 1}, 2)
+	peer := d.peers["10.0.0.0"]
+	eject := func() time.Duration {
+		now := time.Now()
+		d.Report("10.0.0.0", 500)
+		require.True(t, d.Ejected("10.0.0.0"))
+		duration := peer.until.Sub(now).Round(time.Second)
+		d.evaluate(peer.until)
+		require.False(t, d.Ejected("10.0.0.0"))
+		return duration
+	}
+
+	// the second ejection in a row lasts longer
+	assert.Equal(t, DefaultBaseEjectionTime, eject())
+	assert.Equal(t, 2*DefaultBaseEjectionTime, eject())
+
+	// the ticks of one interval after base ejection time decay the multiplier once
+	begin := peer.until.Add(DefaultBaseEjectionTime + time.Second)
+	for i := 0; i < windowBuckets; i++ {
+		d.evaluate(begin.Add(time.Duration(i) * DefaultInterval / windowBuckets))
+	}
+	assert.Equal(t, 1, peer.ejectTimes)
+	assert.Equal(t, 2*DefaultBaseEjectionTime, eject())
+}
+
+func TestSuccessRate(t *testing.T) {
+	d, changes := createDetector(t, &config.OutlierDetection{
+		Consecutive5xx:           100,
+		SuccessRateMinimumHosts:  3,
+		SuccessRateRequestVolume: 10,
+		MaxEjectionPercent:       50,
+	}, 5)
+	for i := 0; i < 100; i++ {
+		for j := 0; j < 5; j++ {
+			code := 200
+			// 10.0.0.0 fails 30%, 10.0.0.1 fails 2%
+			if (j == 0 && i%10 < 3) || (j == 1 && i%50 == 0) {
+				code = 500
+			}
+			d.Report(fmt.Sprintf("10.0.0.%d", j), code)
+		}
+	}
+	d.evaluate(time.Now())
+	assert.Equal(t, map[string]bool{"10.0.0.0": true}, changes)
+	assert.Contains(t, d.String(), "10.0.0.0: ejected by success rate")
+
+	// the requests stay in the window until it slides over them
+	requests, _ := d.peers["10.0.0.1"].window()
+	assert.Equal(t, 100, requests)
+	for i := 0; i < windowBuckets-1; i++ {
+		d.Report("10.0.0.1", 200)
+		d.evaluate(time.Now())
+	}
+	requests, _ = d.peers["10.0.0.1"].window()
+	assert.Equal(t, windowBuckets-1, requests)
+	d.evaluate(time.Now())
+	requests, _ = d.peers["10.0.0.1"].window()
+	assert.Equal(t, windowBuckets-2, requests)
+
+	// not enough request volume
+	d.Remove("10.0.0.0")
+	for i := 0; i < windowBuckets; i++ {
+		d.evaluate(time.Now())
+	}
+	for i := 0; i < 9; i++ {
+		d.Report("10.0.0.1", 500)
+		d.Report("10.0.0.2", 200)
+		d.Report("10.0.0.3", 200)
+	}
+	d.evaluate(time.Now())
+	assert.False(t, d.Ejected("10.0.0.1"))
+}
@@ -0,0 +1,10 @@
+// Package p2c provides power of two choices balancing with peak EWMA
+//
+// Two healthy peers are sampled randomly and the one with the lower load
+// score is picked. The score of a peer is its peak exponentially-weighted
+// moving average (EWMA) of the response time multiplied by the number of
+// outstanding requests, so a slow peer quickly loses its share of traffic.
+//
+// the basic idea is from finagle and linkerd, refer details in following link
+// https://linkerd.io/2016/03/16/beyond-round-robin-load-balancing-for-latency/
+package p2c
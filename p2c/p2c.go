@@ -0,0 +1,299 @@
+package p2c
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDecay is the time window of the EWMA.
+const DefaultDecay = 10 * time.Second
+
+// penalty is the cost of a peer which has outstanding requests but
+// no response time observed yet, so it is not flooded before the first
+// response comes back.
+const penalty = float64(math.MaxInt64 >> 16)
+
+// Peer represents a backend server.
+type Peer struct {
+	sync.Mutex
+	addr    string
+	weight  int
+	pending int64
+	// peak EWMA of the response time, in nanoseconds
+	cost  float64
+	stamp time.Time
+	down  bool
+	// the time of joining or recovering, used for slow start
+	start time.Time
+}
+
+// CreatePeer return a Peer object.
+func CreatePeer(addr string, weight int) *Peer {
+	if weight <= 0 {
+		weight = 1
+	}
+	return &Peer{
+		addr:   addr,
+		weight: weight,
+		stamp:  time.Now(),
+	}
+}
+
+func (p *Peer) String() string {
+	p.Lock()
+	defer p.Unlock()
+	return fmt.Sprintf("%s: (w=%d, pending=%d, ewma=%v)",
+		p.addr, p.weight, p.pending, time.Duration(p.cost))
+}
+
+// score returns the load of the peer, the lower the better.
+// The weight ramps up linearly from a tenth in slow start.
+func (p *Peer) score(slowStart time.Duration, now time.Time) float64 {
+	p.Lock()
+	defer p.Unlock()
+	cost := p.cost
+	if cost == 0 && p.pending != 0 {
+		cost = penalty
+	}
+	weight := float64(p.weight)
+	if elapsed := now.Sub(p.start); !p.start.IsZero() && elapsed < slowStart {
+		weight *= math.Max(0.1, float64(elapsed)/float64(slowStart))
+	}
+	return cost * float64(p.pending+1) / weight
+}
+
+func (p *Peer) observe(rtt time.Duration, decay time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(p.stamp)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	p.stamp = now
+
+	sample := float64(rtt)
+	if sample > p.cost {
+		// peak sensitive: jump to the slower response time at once
+		p.cost = sample
+		return
+	}
+	w := math.Exp(-float64(elapsed) / float64(decay))
+	p.cost = p.cost*w + sample*(1-w)
+}
+
+// Pool is a group of Peers.
+type Pool struct {
+	sync.RWMutex
+	peers     []*Peer
+	downNum   int
+	decay     time.Duration
+	slowStart time.Duration
+
+	rnd     *rand.Rand
+	rndLock sync.Mutex
+}
+
+// New returns a Pool object.
+func New() *Pool {
+	return &Pool{
+		decay: DefaultDecay,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// SetSlowStart sets the duration in which the weight of a new or recovered
+// peer ramps up linearly, the peers added before are not affected.
+func (p *Pool) SetSlowStart(d time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.slowStart = d
+}
+
+func (p *Pool) String() string {
+	p.RLock()
+	defer p.RUnlock()
+	result := []string{}
+	for _, peer := range p.peers {
+		result = append(result, peer.addr)
+	}
+	sort.Strings(result)
+	return strings.Join(result, ", ")
+}
+
+// Size return the number of the peer.
+func (p *Pool) Size() int {
+	p.RLock()
+	defer p.RUnlock()
+	return len(p.peers)
+}
+
+func (p *Pool) indexOfPeer(addr string) int {
+	for i, peer := range p.peers {
+		if peer.addr == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *Pool) findPeer(addr string) *Peer {
+	p.RLock()
+	defer p.RUnlock()
+	if idx := p.indexOfPeer(addr); idx >= 0 {
+		return p.peers[idx]
+	}
+	return nil
+}
+
+// Add append a peer to the pool if not exists.
+func (p *Pool) Add(addr string, args ...interface{}) {
+	if addr == "" {
+		return
+	}
+	weight := 1
+	if len(args) > 0 {
+		if w, ok := args[0].(int); ok {
+			weight = w
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if idx := p.indexOfPeer(addr); idx >= 0 {
+		return
+	}
+	peer := CreatePeer(addr, weight)
+	if p.slowStart > 0 {
+		peer.start = time.Now()
+	}
+	p.peers = append(p.peers, peer)
+}
+
+// Remove removes the peer from the pool.
+func (p *Pool) Remove(addr string) {
+	p.Lock()
+	defer p.Unlock()
+
+	if idx := p.indexOfPeer(addr); idx >= 0 {
+		if p.peers[idx].down {
+			p.downNum--
+		}
+		p.peers = append(p.peers[:idx], p.peers[idx+1:]...)
+	}
+}
+
+func (p *Pool) setPeerStatus(addr string, isDown bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	idx := p.indexOfPeer(addr)
+	if idx < 0 {
+		return
+	}
+	peer := p.peers[idx]
+	if peer.down != isDown {
+		if isDown {
+			p.downNum++
+		} else {
+			p.downNum--
+		}
+		peer.Lock()
+		peer.down = isDown
+		if !isDown && p.slowStart > 0 {
+			peer.start = time.Now()
+		}
+		peer.Unlock()
+	}
+}
+
+// DownPeer mark the peer down.
+func (p *Pool) DownPeer(addr string) {
+	p.setPeerStatus(addr, true)
+}
+
+// UpPeer mark the peer up.
+func (p *Pool) UpPeer(addr string) {
+	p.setPeerStatus(addr, false)
+}
+
+// Acquire increases the number of outstanding requests of the peer.
+func (p *Pool) Acquire(addr string) {
+	if peer := p.findPeer(addr); peer != nil {
+		peer.Lock()
+		peer.pending++
+		peer.Unlock()
+	}
+}
+
+// Release decreases the number of outstanding requests of the peer.
+func (p *Pool) Release(addr string) {
+	if peer := p.findPeer(addr); peer != nil {
+		peer.Lock()
+		if peer.pending > 0 {
+			peer.pending--
+		}
+		peer.Unlock()
+	}
+}
+
+// Observe feeds the response time of a request into the EWMA of the peer.
+func (p *Pool) Observe(addr string, rtt time.Duration) {
+	if peer := p.findPeer(addr); peer != nil {
+		peer.observe(rtt, p.decay)
+	}
+}
+
+func (p *Pool) intn(n int) int {
+	p.rndLock.Lock()
+	defer p.rndLock.Unlock()
+	return p.rnd.Intn(n)
+}
+
+// Get samples two healthy peers and returns the less loaded one.
+func (p *Pool) Get(args ...interface{}) string {
+	p.RLock()
+	defer p.RUnlock()
+
+	if len(p.peers) <= 0 || p.downNum >= len(p.peers) {
+		return ""
+	}
+
+	healthy := make([]*Peer, 0, len(p.peers)-p.downNum)
+	for _, peer := range p.peers {
+		if !peer.down {
+			healthy = append(healthy, peer)
+		}
+	}
+	if len(healthy) == 1 {
+		return healthy[0].addr
+	}
+
+	i := p.intn(len(healthy))
+	j := p.intn(len(healthy) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := healthy[i], healthy[j]
+	now := time.Now()
+	if b.score(p.slowStart, now) < a.score(p.slowStart, now) {
+		return b.addr
+	}
+	return a.addr
+}
+
+// CreatePool return a Pool object.
+func CreatePool(pairs map[string]int) *Pool {
+	pool := New()
+	for addr, weight := range pairs {
+		pool.Add(addr, weight)
+	}
+	return pool
+}
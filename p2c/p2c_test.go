@@ -0,0 +1,132 @@
+package p2c
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func countGet(pool *Pool, n int) map[string]int {
+	result := map[string]int{}
+	for i := 0; i < n; i++ {
+		result[pool.Get()]++
+	}
+	return result
+}
+
+func TestGetEmpty(t *testing.T) {
+	pool := New()
+	assert.Equal(t, "", pool.Get())
+
+	pool.Add("", 1)
+	assert.Equal(t, 0, pool.Size())
+}
+
+func TestGetSinglePeer(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1})
+	assert.Equal(t, "a", pool.Get())
+}
+
+func TestGetPreferFaster(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1, "b": 1})
+	pool.rnd = rand.New(rand.NewSource(1))
+	pool.Observe("a", 100*time.Millisecond)
+	pool.Observe("b", 10*time.Millisecond)
+
+	result := countGet(pool, 100)
+	assert.Equal(t, 100, result["b"])
+}
+
+func TestGetPreferLessPending(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1, "b": 1})
+	pool.Observe("a", 10*time.Millisecond)
+	pool.Observe("b", 10*time.Millisecond)
+
+	pool.Acquire("a")
+	assert.Equal(t, "b", pool.Get())
+
+	pool.Acquire("b")
+	pool.Acquire("b")
+	assert.Equal(t, "a", pool.Get())
+
+	pool.Release("b")
+	pool.Release("b")
+	pool.Release("b")
+	assert.Equal(t, int64(0), pool.findPeer("b").pending)
+	assert.Equal(t, "b", pool.Get())
+}
+
+func TestPendingWithoutObservation(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1, "b": 1})
+	pool.Observe("b", time.Second)
+	pool.Acquire("a")
+	assert.Equal(t, "b", pool.Get())
+}
+
+func TestPeakEWMA(t *testing.T) {
+	peer := CreatePeer("a", 1)
+	peer.observe(10*time.Millisecond, DefaultDecay)
+	assert.Equal(t, float64(10*time.Millisecond), peer.cost)
+
+	// jump to the peak at once
+	peer.observe(100*time.Millisecond, DefaultDecay)
+	assert.Equal(t, float64(100*time.Millisecond), peer.cost)
+
+	// decay slowly to the faster response
+	peer.stamp = time.Now().Add(-DefaultDecay)
+	peer.observe(10*time.Millisecond, DefaultDecay)
+	assert.True(t, peer.cost < float64(100*time.Millisecond))
+	assert.True(t, peer.cost > float64(10*time.Millisecond))
+}
+
+func TestDownPeer(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1, "b": 1, "c": 1})
+	pool.DownPeer("a")
+	pool.DownPeer("b")
+	result := countGet(pool, 10)
+	assert.Equal(t, 10, result["c"])
+
+	pool.UpPeer("a")
+	result = countGet(pool, 100)
+	assert.Equal(t, 0, result["b"])
+	assert.Equal(t, 100, result["a"]+result["c"])
+
+	pool.DownPeer("a")
+	pool.DownPeer("b")
+	pool.DownPeer("c")
+	assert.Equal(t, "", pool.Get())
+
+	pool.Remove("a")
+	assert.Equal(t, 2, pool.Size())
+	assert.Equal(t, 2, pool.downNum)
+	assert.Equal(t, "b, c", pool.String())
+}
+
+func TestSlowStart(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1})
+	pool.SetSlowStart(10 * time.Second)
+	assert.True(t, pool.findPeer("a").start.IsZero())
+
+	pool.Add("b", 1)
+	peer := pool.findPeer("b")
+	assert.False(t, peer.start.IsZero())
+	pool.Observe("a", 10*time.Millisecond)
+	pool.Observe("b", 5*time.Millisecond)
+
+	// the weight of b is 0.1, a is preferred though b is faster
+	now := peer.start
+	assert.Equal(t, "a", pool.Get())
+	assert.InDelta(t, float64(50*time.Millisecond), peer.score(pool.slowStart, now), 1)
+
+	// 50% of slow start
+	assert.InDelta(t, float64(10*time.Millisecond), peer.score(pool.slowStart, now.Add(5*time.Second)), 1)
+
+	peer.start = time.Now().Add(-10 * time.Second)
+	assert.Equal(t, "b", pool.Get())
+
+	pool.DownPeer("b")
+	pool.UpPeer("b")
+	assert.True(t, time.Since(peer.start) < time.Second)
+}
@@ -0,0 +1,10 @@
+// Package rendezvous provides weighted rendezvous (highest random weight) hashing balancing
+//
+// Every peer is scored by hashing the key together with the peer address,
+// the peer with the highest score wins. When a peer leaves, only the keys
+// it owned are remapped, and the weighted score gives each peer a share of
+// keys exactly proportional to its weight without virtual nodes.
+//
+// the weighted scoring is from the following link
+// https://www.snia.org/sites/default/files/SDC15_presentations/dist_sys/Jason_Resch_New_Consistent_Hashings_Rev.pdf
+package rendezvous
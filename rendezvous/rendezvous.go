@@ -0,0 +1,210 @@
+package rendezvous
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Peer defines a single server.
+type Peer struct {
+	addr   string
+	weight int
+	down   bool
+	// the time of joining or recovering, used for slow start
+	start time.Time
+}
+
+// Pool is a set of Peers.
+type Pool struct {
+	sync.RWMutex
+	peers     []*Peer
+	downNum   int
+	slowStart time.Duration
+}
+
+// New returns a Pool object.
+func New() *Pool {
+	return &Pool{}
+}
+
+// mix is the finalizer of murmur3, fnv alone is poorly distributed for
+// similar keys like "127.0.0.1:10001" and "127.0.0.1:10002".
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// score returns weight / -ln(u), u is the hash of key and peer in (0, 1).
+// The weight ramps up linearly from a tenth in slow start.
+func (p *Peer) score(key string, slowStart time.Duration, now time.Time) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(p.addr))
+	u := (float64(mix(h.Sum64())>>11) + 0.5) / (1 << 53)
+	weight := float64(p.weight)
+	if elapsed := now.Sub(p.start); !p.start.IsZero() && elapsed < slowStart {
+		weight *= math.Max(0.1, float64(elapsed)/float64(slowStart))
+	}
+	return weight / -math.Log(u)
+}
+
+// SetSlowStart sets the duration in which the weight of a new or recovered
+// peer ramps up linearly, the peers added before are not affected.
+func (p *Pool) SetSlowStart(d time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.slowStart = d
+}
+
+func (p *Pool) String() string {
+	p.RLock()
+	defer p.RUnlock()
+	result := []string{}
+	for _, peer := range p.peers {
+		result = append(result, peer.addr)
+	}
+	sort.Strings(result)
+	return strings.Join(result, ", ")
+}
+
+// Size return the number of peers.
+func (p *Pool) Size() int {
+	p.RLock()
+	defer p.RUnlock()
+	return len(p.peers)
+}
+
+func (p *Pool) indexOfPeer(addr string) int {
+	for i, peer := range p.peers {
+		if peer.addr == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// Add adds a peer by address, the weight is in args[0].
+func (p *Pool) Add(addr string, args ...interface{}) {
+	if addr == "" {
+		return
+	}
+	weight := 1
+	if len(args) > 0 {
+		if w, ok := args[0].(int); ok && w > 0 {
+			weight = w
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if idx := p.indexOfPeer(addr); idx >= 0 {
+		return
+	}
+	peer := &Peer{addr: addr, weight: weight}
+	if p.slowStart > 0 {
+		peer.start = time.Now()
+	}
+	p.peers = append(p.peers, peer)
+}
+
+// Remove deletes a peer by address.
+func (p *Pool) Remove(addr string) {
+	p.Lock()
+	defer p.Unlock()
+
+	if idx := p.indexOfPeer(addr); idx >= 0 {
+		if p.peers[idx].down {
+			p.downNum--
+		}
+		p.peers = append(p.peers[:idx], p.peers[idx+1:]...)
+	}
+}
+
+func (p *Pool) setPeerStatus(addr string, isDown bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	idx := p.indexOfPeer(addr)
+	if idx < 0 {
+		return
+	}
+	peer := p.peers[idx]
+	if peer.down != isDown {
+		if isDown {
+			p.downNum++
+		} else {
+			p.downNum--
+		}
+		peer.down = isDown
+		if !isDown && p.slowStart > 0 {
+			peer.start = time.Now()
+		}
+	}
+}
+
+// DownPeer mark the peer down.
+func (p *Pool) DownPeer(addr string) {
+	p.setPeerStatus(addr, true)
+}
+
+// UpPeer mark the peer up.
+func (p *Pool) UpPeer(addr string) {
+	p.setPeerStatus(addr, false)
+}
+
+// Get returns the healthy peer with the highest score for the key.
+func (p *Pool) Get(args ...interface{}) string {
+	return p.GetExcluding(nil, args...)
+}
+
+// GetExcluding is Get but skips the excluded peers, the key is mapped to
+// the peer of the next highest score.
+func (p *Pool) GetExcluding(exclude map[string]bool, args ...interface{}) string {
+	if len(args) == 0 {
+		return ""
+	}
+	key, ok := args[0].(string)
+	if !ok {
+		return ""
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+
+	var best *Peer
+	bestScore := 0.0
+	now := time.Now()
+	for _, peer := range p.peers {
+		if peer.down || exclude[peer.addr] {
+			continue
+		}
+		score := peer.score(key, p.slowStart, now)
+		if best == nil || score > bestScore {
+			best = peer
+			bestScore = score
+		}
+	}
+	if best != nil {
+		return best.addr
+	}
+	return ""
+}
+
+// CreatePool returns a Pool object.
+func CreatePool(pairs map[string]int) *Pool {
+	pool := New()
+	for addr, weight := range pairs {
+		pool.Add(addr, weight)
+	}
+	return pool
+}
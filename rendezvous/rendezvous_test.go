@@ -0,0 +1,123 @@
+package rendezvous
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func lookupAll(pool *Pool, n int) []string {
+	result := make([]string, n)
+	for i := 0; i < n; i++ {
+		result[i] = pool.Get(fmt.Sprintf("key-%d", i))
+	}
+	return result
+}
+
+func TestGetEmpty(t *testing.T) {
+	pool := New()
+	assert.Equal(t, "", pool.Get("any"))
+	assert.Equal(t, "", pool.Get())
+	assert.Equal(t, "", pool.Get(10))
+
+	pool.Add("", 1)
+	assert.Equal(t, 0, pool.Size())
+}
+
+func TestWeight(t *testing.T) {
+	pool := CreatePool(map[string]int{"1.1.1.1": 1, "2.2.2.2": 3})
+	count := map[string]int{}
+	for _, peer := range lookupAll(pool, 20000) {
+		count[peer]++
+	}
+	t.Logf("%v", count)
+	assert.InDelta(t, 0.25, float64(count["1.1.1.1"])/20000, 0.02)
+	assert.InDelta(t, 0.75, float64(count["2.2.2.2"])/20000, 0.02)
+}
+
+func TestRemapOnlyOwnKeys(t *testing.T) {
+	pool := CreatePool(map[string]int{"1.1.1.1": 1, "2.2.2.2": 2, "3.3.3.3": 1})
+	before := lookupAll(pool, 5000)
+
+	pool.DownPeer("2.2.2.2")
+	after := lookupAll(pool, 5000)
+	for i := range before {
+		if before[i] != "2.2.2.2" {
+			assert.Equal(t, before[i], after[i])
+		} else {
+			assert.NotEqual(t, "2.2.2.2", after[i])
+		}
+	}
+
+	pool.UpPeer("2.2.2.2")
+	assert.Equal(t, before, lookupAll(pool, 5000))
+
+	pool.Remove("2.2.2.2")
+	assert.Equal(t, after, lookupAll(pool, 5000))
+	assert.Equal(t, "1.1.1.1, 3.3.3.3", pool.String())
+}
+
+func TestDownPeer(t *testing.T) {
+	pool := CreatePool(map[string]int{"1.1.1.1": 1, "2.2.2.2": 1})
+	pool.Add("2.2.2.2", 5)
+	assert.Equal(t, 2, pool.Size())
+
+	pool.DownPeer("1.1.1.1")
+	pool.DownPeer("2.2.2.2")
+	assert.Equal(t, 2, pool.downNum)
+	assert.Equal(t, "", pool.Get("any"))
+
+	pool.Remove("1.1.1.1")
+	assert.Equal(t, 1, pool.downNum)
+	pool.UpPeer("2.2.2.2")
+	assert.Equal(t, "2.2.2.2", pool.Get("any"))
+}
+
+func TestSlowStart(t *testing.T) {
+	pool := CreatePool(map[string]int{"1.1.1.1": 1})
+	pool.SetSlowStart(10 * time.Second)
+	assert.True(t, pool.peers[0].start.IsZero())
+
+	pool.Add("2.2.2.2", 1)
+	peer := pool.peers[1]
+	assert.False(t, peer.start.IsZero())
+
+	count := func() int {
+		n := 0
+		for _, addr := range lookupAll(pool, 10000) {
+			if addr == "2.2.2.2" {
+				n++
+			}
+		}
+		return n
+	}
+	// a tenth of the weight at the beginning of slow start
+	ramping := count()
+	t.Logf("ramping %d", ramping)
+	assert.InDelta(t, 10000*0.1/1.1, ramping, 300)
+
+	peer.start = time.Now().Add(-10 * time.Second)
+	assert.InDelta(t, 5000, count(), 300)
+
+	pool.DownPeer("2.2.2.2")
+	pool.UpPeer("2.2.2.2")
+	assert.True(t, time.Since(peer.start) < time.Second)
+}
+
+func TestGetExcluding(t *testing.T) {
+	pool := CreatePool(map[string]int{"1.1.1.1": 1, "2.2.2.2": 1, "3.3.3.3": 1})
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		peer := pool.Get(key)
+		assert.Equal(t, peer, pool.GetExcluding(nil, key))
+		// the excluded peer is skipped like a down one
+		other := pool.GetExcluding(map[string]bool{peer: true}, key)
+		pool.DownPeer(peer)
+		assert.Equal(t, pool.Get(key), other)
+		pool.UpPeer(peer)
+	}
+	all := map[string]bool{"1.1.1.1": true, "2.2.2.2": true, "3.3.3.3": true}
+	assert.Equal(t, "", pool.GetExcluding(all, "any"))
+}
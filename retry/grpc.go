@@ -0,0 +1,186 @@
+package retry
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+)
+
+// errReplaced is returned to the body reader of a former try.
+var errReplaced = errors.New("retry: request body is replaced by the next try")
+
+// replayBody records the request body read by the tries, so that the next
+// try replays it and then reads on, the streaming request is not blocked.
+type replayBody struct {
+	sync.Mutex
+	body io.ReadCloser
+	buf  []byte
+	try  int
+	// stop recording once the response is committed
+	done bool
+	// serializes the reads of body
+	readLock sync.Mutex
+}
+
+// reader returns the body reader of a new try.
+func (b *replayBody) reader() io.ReadCloser {
+	b.Lock()
+	defer b.Unlock()
+	b.try++
+	return &replayReader{b: b, try: b.try}
+}
+
+func (b *replayBody) stop() {
+	b.Lock()
+	defer b.Unlock()
+	b.done = true
+}
+
+type replayReader struct {
+	b   *replayBody
+	try int
+	off int
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	if n, ok, err := r.replay(p); ok {
+		return n, err
+	}
+	b := r.b
+	b.readLock.Lock()
+	defer b.readLock.Unlock()
+	// a former try may have read on in the meantime
+	if n, ok, err := r.replay(p); ok {
+		return n, err
+	}
+
+	n, err := b.body.Read(p)
+	b.Lock()
+	defer b.Unlock()
+	if r.try != b.try {
+		// kept for the next try
+		b.buf = append(b.buf, p[:n]...)
+		return 0, errReplaced
+	}
+	if !b.done {
+		b.buf = append(b.buf, p[:n]...)
+		r.off += n
+	}
+	return n, err
+}
+
+// replay reads the recorded body, ok is false if all of it is read.
+func (r *replayReader) replay(p []byte) (n int, ok bool, err error) {
+	b := r.b
+	b.Lock()
+	defer b.Unlock()
+	if r.try != b.try {
+		return 0, true, errReplaced
+	}
+	if r.off < len(b.buf) {
+		n = copy(p, b.buf[r.off:])
+		r.off += n
+		return n, true, nil
+	}
+	if b.done {
+		b.buf = nil
+		r.off = 0
+	}
+	return 0, false, nil
+}
+
+// Close leaves the request body to the server.
+func (r *replayReader) Close() error {
+	return nil
+}
+
+// grpcResponseWriter holds the headers until the response is known not to
+// be retried, and then streams the response.
+type grpcResponseWriter struct {
+	http.ResponseWriter
+	header    http.Header
+	body      *replayBody
+	last      bool
+	retry     bool
+	committed bool
+}
+
+func (w *grpcResponseWriter) Header() http.Header {
+	if w.committed {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *grpcResponseWriter) WriteHeader(statusCode int) {
+	if w.retry || w.committed {
+		return
+	}
+	if !w.last && shouldRetryGRPC(statusCode, w.header) {
+		w.retry = true
+		return
+	}
+	dst := w.ResponseWriter.Header()
+	for k, v := range w.header {
+		dst[k] = v
+	}
+	w.committed = true
+	w.body.stop()
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *grpcResponseWriter) Write(data []byte) (int, error) {
+	if !w.committed {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.retry {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *grpcResponseWriter) Flush() {
+	if !w.committed {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// shouldRetryGRPC returns true if the request fails before reaching the
+// application, e.g. the peer is down or returns a trailers-only response
+// with status UNAVAILABLE.
+func shouldRetryGRPC(code int, header http.Header) bool {
+	if code != http.StatusOK {
+		return shouldRetry(code)
+	}
+	return header.Get("Grpc-Status") == strconv.Itoa(int(codes.Unavailable))
+}
+
+// GRPC resends the request in case of UNAVAILABLE, the request body is
+// replayed, and the response is streamed once it is not to be retried.
+func GRPC(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := &replayBody{body: r.Body}
+		for count := 1; ; count++ {
+			r.Body = body.reader()
+			ww := &grpcResponseWriter{
+				ResponseWriter: w,
+				header:         http.Header{},
+				body:           body,
+				last:           count >= TRY,
+			}
+			next.ServeHTTP(ww, r)
+			if !ww.retry {
+				return
+			}
+			log.Debugf("[Retry]%dth try grpc request is unavailable", count)
+		}
+	})
+}
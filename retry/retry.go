@@ -12,6 +12,8 @@ import (
 
 type wrapResponseWriter struct {
 	http.ResponseWriter
+	// the header of the last try
+	header http.Header
 	buffer *bytes.Buffer
 	code   int
 }
@@ -19,15 +21,17 @@ type wrapResponseWriter struct {
 func newWrapResponseWriter(w http.ResponseWriter) *wrapResponseWriter {
 	return &wrapResponseWriter{
 		ResponseWriter: w,
+		header:         http.Header{},
 		buffer:         bytes.NewBuffer([]byte("")),
 		code:           0,
 	}
 }
 
+func (w *wrapResponseWriter) Header() http.Header {
+	return w.header
+}
+
 func (w *wrapResponseWriter) WriteHeader(statusCode int) {
-	for k := range w.ResponseWriter.Header() {
-		delete(w.ResponseWriter.Header(), k)
-	}
 	w.code = statusCode
 }
 
@@ -72,6 +76,7 @@ func Retry(next http.Handler) http.Handler {
 		var count = 1
 		for {
 			r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+			ww.header = http.Header{}
 			next.ServeHTTP(ww, r)
 			log.Debugf("[Retry]%dth try request, response code %d", count, ww.code)
 			if !shouldRetry(ww.code) || count >= TRY {
@@ -84,6 +89,9 @@ func Retry(next http.Handler) http.Handler {
 			ww.code = http.StatusOK
 		}
 
+		for k, v := range ww.header {
+			w.Header()[k] = v
+		}
 		ww.ResponseWriter.WriteHeader(ww.code)
 		io.Copy(w, ww.buffer)
 	})
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -67,3 +68,77 @@ func TestProxyRetryFail(t *testing.T) {
 	res := rr.Result()
 	assert.Equal(t, http.StatusInternalServerError, res.StatusCode)
 }
+
+func TestRetryHeader(t *testing.T) {
+	var count = 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		if count == 1 {
+			w.Header().Set("X-Failed", "true")
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("X-Server", "s1")
+		w.Write([]byte("ok"))
+	})
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	rr := httptest.NewRecorder()
+	Retry(handler).ServeHTTP(rr, req)
+
+	// only the header of the last try is written
+	res := rr.Result()
+	assert.Equal(t, 2, count)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "s1", res.Header.Get("X-Server"))
+	assert.Equal(t, "", res.Header.Get("X-Failed"))
+}
+
+func TestGRPCRetry(t *testing.T) {
+	var count = 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		// the first try reads a part of the body
+		if count == 1 {
+			r.Body.Read(make([]byte, 3))
+			w.Header().Set("Grpc-Status", "14")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Write(body)
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	})
+
+	req := httptest.NewRequest("POST", "/grpc.health.v1.Health/Check", strings.NewReader("message"))
+	rr := httptest.NewRecorder()
+	GRPC(handler).ServeHTTP(rr, req)
+
+	res := rr.Result()
+	assert.Equal(t, 2, count)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "", res.Header.Get("Grpc-Status"))
+	assert.Equal(t, "0", res.Trailer.Get("Grpc-Status"))
+	respBody, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "message", string(respBody))
+}
+
+func TestGRPCRetryFail(t *testing.T) {
+	var count = 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count++
+		w.Header().Set("Grpc-Status", "14")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	req := httptest.NewRequest("POST", "/grpc.health.v1.Health/Check", nil)
+	rr := httptest.NewRecorder()
+	GRPC(handler).ServeHTTP(rr, req)
+
+	res := rr.Result()
+	assert.Equal(t, TRY, count)
+	assert.Equal(t, "14", res.Header.Get("Grpc-Status"))
+}
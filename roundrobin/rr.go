@@ -6,8 +6,13 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// slowStartScale scales the weights in slow start, so that a peer of
+// weight 1 can ramp up too.
+const slowStartScale = 100
+
 // Peer represents a backend server.
 type Peer struct {
 	addr            string
@@ -15,6 +20,8 @@ type Peer struct {
 	effectiveWeight int
 	currentWeight   int
 	down            bool
+	// the time of joining or recovering, used for slow start
+	start time.Time
 	sync.RWMutex
 }
 
@@ -38,12 +45,34 @@ func CreatePeer(addr string, weight int) *Peer {
 
 // Pool is a group of Peers, one Peer can not belong to multiple Pool.
 type Pool struct {
-	peers   []*Peer
-	current uint64
-	downNum int
+	peers     []*Peer
+	current   uint64
+	downNum   int
+	slowStart time.Duration
 	sync.RWMutex
 }
 
+// SetSlowStart sets the duration in which the weight of a new or recovered
+// peer ramps up linearly, the peers added before are not affected.
+func (p *Pool) SetSlowStart(d time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	p.slowStart = d
+}
+
+// slowStartWeight returns the scaled weight of the peer in slow start.
+func (p *Pool) slowStartWeight(peer *Peer, now time.Time) int {
+	weight := peer.weight * slowStartScale
+	elapsed := now.Sub(peer.start)
+	if peer.start.IsZero() || elapsed >= p.slowStart {
+		return weight
+	}
+	if w := int(int64(weight) * int64(elapsed) / int64(p.slowStart)); w > 1 {
+		return w
+	}
+	return 1
+}
+
 func (p *Pool) String() string {
 	p.RLock()
 	defer p.RUnlock()
@@ -79,6 +108,9 @@ func (p *Pool) Add(addr string, args ...interface{}) {
 	p.Lock()
 	defer p.Unlock()
 
+	if p.slowStart > 0 {
+		peer.start = time.Now()
+	}
 	if peer.down {
 		p.downNum++
 	}
@@ -107,10 +139,14 @@ func (p *Pool) setPeerStatus(addr string, isDown bool) {
 			} else {
 				p.downNum--
 			}
+			slowStart := p.slowStart
 			p.Unlock()
 
 			peer.Lock()
 			peer.down = isDown
+			if !isDown && slowStart > 0 {
+				peer.start = time.Now()
+			}
 			peer.Unlock()
 		}
 	}
@@ -150,14 +186,19 @@ func (p *Pool) Get(args ...interface{}) string {
 
 	var best *Peer
 	total := 0
+	now := time.Now()
 	for _, peer := range p.peers {
 		if peer.down {
 			continue
 		}
 		peer.Lock()
 
-		total += peer.effectiveWeight
-		peer.currentWeight += peer.effectiveWeight
+		weight := peer.effectiveWeight
+		if p.slowStart > 0 {
+			weight = p.slowStartWeight(peer, now)
+		}
+		total += weight
+		peer.currentWeight += weight
 
 		if peer.effectiveWeight < peer.weight {
 			peer.effectiveWeight++
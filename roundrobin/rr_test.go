@@ -3,6 +3,7 @@ package roundrobin
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -163,3 +164,38 @@ func TestDownPeer(t *testing.T) {
 	expectedOrder = ",,,,,"
 	testGetPeer(t, pool, 6, expectedOrder)
 }
+
+func TestSlowStart(t *testing.T) {
+	pool := CreatePool(map[string]int{"a": 1, "b": 1})
+	pool.SetSlowStart(10 * time.Second)
+	assert.True(t, pool.peers[0].start.IsZero())
+
+	pool.Add("c", 1)
+	peer := pool.peers[2]
+	assert.False(t, peer.start.IsZero())
+
+	// 1s of 10s, c has 10% of the weight
+	peer.start = time.Now().Add(-time.Second)
+	count := map[string]int{}
+	for i := 0; i < 210; i++ {
+		count[pool.Get()]++
+	}
+	assert.Equal(t, 100, count["a"])
+	assert.Equal(t, 100, count["b"])
+	assert.Equal(t, 10, count["c"])
+
+	// slow start is over
+	peer.start = time.Now().Add(-10 * time.Second)
+	count = map[string]int{}
+	for i := 0; i < 30; i++ {
+		count[pool.Get()]++
+	}
+	assert.Equal(t, 10, count["c"])
+
+	// ramp up again after recovering
+	pool.DownPeer("c")
+	pool.UpPeer("c")
+	assert.True(t, time.Since(peer.start) < time.Second)
+	assert.Equal(t, 1, pool.slowStartWeight(peer, peer.start))
+	assert.Equal(t, 50, pool.slowStartWeight(peer, peer.start.Add(5*time.Second)))
+}
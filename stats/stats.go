@@ -15,6 +15,11 @@ type Stats struct {
 	Path       map[string]uint64
 	InBytes    uint64
 	OutBytes   uint64
+	InPackets  uint64
+	OutPackets uint64
+	// the requests sent over a new or a reused upstream connection
+	NewConns    uint64
+	ReusedConns uint64
 }
 
 // New returns a Stats object.
@@ -30,23 +35,38 @@ func New() *Stats {
 
 // Data is used for holding one record.
 type Data struct {
-	StatusCode string
-	Method     string
-	Path       string
-	InBytes    uint64
-	OutBytes   uint64
+	StatusCode  string
+	Method      string
+	Path        string
+	InBytes     uint64
+	OutBytes    uint64
+	InPackets   uint64
+	OutPackets  uint64
+	NewConns    uint64
+	ReusedConns uint64
 }
 
-// Inc adds the data.
+// Inc adds the data, the empty keys are skipped, e.g. there is no status
+// code, method or path of a tcp connection.
 func (s *Stats) Inc(d *Data) {
 	s.Lock()
 	defer s.Unlock()
 
-	s.StatusCode[d.StatusCode]++
-	s.Method[d.Method]++
-	s.Path[d.Path]++
+	if d.StatusCode != "" {
+		s.StatusCode[d.StatusCode]++
+	}
+	if d.Method != "" {
+		s.Method[d.Method]++
+	}
+	if d.Path != "" {
+		s.Path[d.Path]++
+	}
 	s.InBytes += d.InBytes
 	s.OutBytes += d.OutBytes
+	s.InPackets += d.InPackets
+	s.OutPackets += d.OutPackets
+	s.NewConns += d.NewConns
+	s.ReusedConns += d.ReusedConns
 }
 
 func sortedMapString(dict map[string]uint64) string {
@@ -71,6 +91,10 @@ const (
 	PATH     = "path"
 	INBYTES  = "recv_bytes"
 	OUTBYTES = "send_bytes"
+	INPKTS   = "recv_packets"
+	OUTPKTS  = "send_packets"
+	NEWCONNS = "new_conns"
+	REUSED   = "reused_conns"
 )
 
 func (s *Stats) String() string {
@@ -81,12 +105,27 @@ func (s *Stats) String() string {
 		return fmt.Sprintf("%s: %v", head, msg)
 	}
 
-	result := []string{
-		toS(STATUS, sortedMapString(s.StatusCode)),
-		toS(METHOD, sortedMapString(s.Method)),
-		toS(PATH, sortedMapString(s.Path)),
-		toS(INBYTES, s.InBytes),
-		toS(OUTBYTES, s.OutBytes),
+	result := []string{}
+	for _, m := range []struct {
+		head string
+		dict map[string]uint64
+	}{
+		{STATUS, s.StatusCode},
+		{METHOD, s.Method},
+		{PATH, s.Path},
+	} {
+		if len(m.dict) > 0 {
+			result = append(result, toS(m.head, sortedMapString(m.dict)))
+		}
+	}
+	result = append(result, toS(INBYTES, s.InBytes), toS(OUTBYTES, s.OutBytes))
+	// only the datagrams are counted
+	if s.InPackets > 0 || s.OutPackets > 0 {
+		result = append(result, toS(INPKTS, s.InPackets), toS(OUTPKTS, s.OutPackets))
+	}
+	// only the multiplexed connections are counted
+	if s.NewConns > 0 || s.ReusedConns > 0 {
+		result = append(result, toS(NEWCONNS, s.NewConns), toS(REUSED, s.ReusedConns))
 	}
 
 	return strings.Join(result, "\n")
@@ -31,3 +31,26 @@ func TestString(t *testing.T) {
 	expect := "status_code: 200:1\nmethod: GET:1\npath: /test:1\nrecv_bytes: 24\nsend_bytes: 1024"
 	assert.Equal(t, expect, s.String())
 }
+
+func TestSkipEmptyKey(t *testing.T) {
+	s := New()
+	s.Inc(&Data{InBytes: 10, OutBytes: 20})
+	assert.Equal(t, 0, len(s.StatusCode))
+	assert.Equal(t, "recv_bytes: 10\nsend_bytes: 20", s.String())
+}
+
+func TestPackets(t *testing.T) {
+	s := New()
+	s.Inc(&Data{InBytes: 10, InPackets: 1})
+	s.Inc(&Data{OutBytes: 30, OutPackets: 1})
+	s.Inc(&Data{InBytes: 10, InPackets: 1})
+	assert.Equal(t, "recv_bytes: 20\nsend_bytes: 30\nrecv_packets: 2\nsend_packets: 1", s.String())
+}
+
+func TestConns(t *testing.T) {
+	s := New()
+	s.Inc(&Data{StatusCode: "200", NewConns: 1})
+	s.Inc(&Data{StatusCode: "200", ReusedConns: 1})
+	s.Inc(&Data{StatusCode: "200", ReusedConns: 1})
+	assert.Equal(t, "status_code: 200:3\nrecv_bytes: 0\nsend_bytes: 0\nnew_conns: 1\nreused_conns: 2", s.String())
+}